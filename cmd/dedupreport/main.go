@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/zggz/securefileserver/pkg/fileserver"
+)
+
+func main() {
+	datapath := flag.String("data", "", "(Required) The data directory the server was run with")
+	blobpath := flag.String("blobs", "", "(Required) The directory passed to the server as -dedup")
+	keyfile := flag.String("keyfile", "", "The file of encryption keys the server was run with, if any. FILESERVER_ENCRYPTION_KEYS may hold the keys instead")
+
+	flag.Parse()
+
+	if *datapath == "" || *blobpath == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// the server may be running, so leave its unfinished uploads alone
+	var tree, blobs fileserver.Storage = fileserver.OpenLocalStorage(*datapath, ""), fileserver.OpenLocalStorage(*blobpath, "")
+	if *keyfile != "" || os.Getenv("FILESERVER_ENCRYPTION_KEYS") != "" {
+		var keyring *fileserver.Keyring
+		var err error
+		if *keyfile != "" {
+			keyring, err = fileserver.LoadKeyring(*keyfile)
+		} else {
+			keyring, err = fileserver.ParseKeyring(os.Getenv("FILESERVER_ENCRYPTION_KEYS"))
+		}
+		if err != nil {
+			fmt.Print("Error loading encryption keys: ")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		tree, blobs = fileserver.MakeEncryptedStorage(tree, keyring), fileserver.MakeEncryptedStorage(blobs, keyring)
+	}
+
+	storage, err := fileserver.MakeDedupStorage(tree, blobs)
+	if err != nil {
+		fmt.Print("Error reading the deduplicated files: ")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	report, err := storage.Report()
+	if err != nil {
+		fmt.Print("Error reading the blobs: ")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Files:         %d (%d bytes)\n", report.Files, report.LogicalBytes)
+	fmt.Printf("Stored blobs:  %d (%d bytes)\n", report.Blobs, report.StoredBytes)
+	percent := 0.0
+	if report.LogicalBytes > 0 {
+		percent = 100 * float64(report.Saved()) / float64(report.LogicalBytes)
+	}
+	fmt.Printf("Saved:         %d bytes (%.1f%%)\n", report.Saved(), percent)
+	if report.Plain > 0 {
+		fmt.Printf("Not deduplicated: %d files, stored as they are. Check -data and -keyfile if this is unexpected\n", report.Plain)
+	}
+	if report.Unreferenced > 0 {
+		fmt.Printf("Unreferenced:  %d blobs (%d bytes), removed when the server is started with -dedupgc\n", report.Unreferenced, report.UnreferencedBytes)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/zggz/securefileserver/pkg/fileserver"
+)
+
+func main() {
+	datapath := flag.String("data", "", "(Required) The data directory to encrypt. Stop the server first")
+	keyfile := flag.String("keyfile", "", "The key file the server is run with. FILESERVER_ENCRYPTION_KEYS may hold the keys instead")
+	trashDir := flag.String("trash", "", "The trash directory the server is run with, whose deleted files are encrypted and rewrapped too")
+	versionDir := flag.String("versions", "", "The version directory the server is run with, whose previous versions are encrypted and rewrapped too")
+
+	flag.Parse()
+
+	if *datapath == "" || (*keyfile == "" && os.Getenv("FILESERVER_ENCRYPTION_KEYS") == "") {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var keyring *fileserver.Keyring
+	var err error
+	if *keyfile != "" {
+		keyring, err = fileserver.LoadKeyring(*keyfile)
+	} else {
+		keyring, err = fileserver.ParseKeyring(os.Getenv("FILESERVER_ENCRYPTION_KEYS"))
+	}
+	if err != nil {
+		fmt.Print("Error loading encryption keys: ")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// files not yet encrypted are encrypted, and files encrypted with a key other than the first are rewrapped
+	storage := fileserver.MakeEncryptedStorage(fileserver.MakeLocalStorage(*datapath, ""), keyring)
+	encrypted, rewrapped, err := storage.Rewrap()
+	fmt.Printf("Encrypted %d files and rewrapped the keys of %d files\n", encrypted, rewrapped)
+	for _, dir := range []string{*trashDir, *versionDir} {
+		if err != nil || dir == "" {
+			continue
+		}
+		encrypted, rewrapped, err = storage.RewrapCopies(dir)
+		fmt.Printf("Encrypted %d files and rewrapped the keys of %d files in %s\n", encrypted, rewrapped, dir)
+	}
+	if err != nil {
+		fmt.Print("Stopped after the following error: ")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *trashDir == "" || *versionDir == "" {
+		fmt.Println("Older keys can be removed from the key file once the trash and version directories the server uses have been rewrapped too")
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/zggz/securefileserver/pkg/auth"
 	"golang.org/x/crypto/bcrypt"
@@ -47,6 +51,21 @@ func main() {
 	delread := flag.String("del-read", "", "If creating to or editing an auth file, disable reading for the account at this path (only for edit)")
 	delwrite := flag.String("del-write", "", "If creating to or editing an auth file, disable writing for the account at this path (only for edit)")
 
+	quotabytes := flag.Int64("quota-bytes", -1, "If creating or editing an account, limit how many bytes can be stored in the paths it can write. 0 removes the limit")
+	quotafiles := flag.Int64("quota-files", -1, "If creating or editing an account, limit how many files can be stored in the paths it can write. 0 removes the limit")
+
+	addtoken := flag.String("add-token", "", "Creates an API token with this name for the username, printing its secret. The secret is only shown this once")
+	listtokens := flag.Bool("list-tokens", false, "Lists the API tokens of the username. Does not edit.")
+	revoketoken := flag.String("revoke-token", "", "Removes the API token with this name from the username")
+	tokenexpires := flag.Duration("token-expires", 0, "If creating a token, how long it lasts, such as 720h. Default is to never expire")
+	tokenread := flag.String("token-read", "", "If creating a token, comma separated paths it can read, which the account must be able to read. Default is everything the account can read")
+	tokenwrite := flag.String("token-write", "", "If creating a token, comma separated paths it can write, which the account must be able to write. Default is everything the account can write")
+	tokenreadonly := flag.Bool("token-readonly", false, "If creating a token, stop it writing anything")
+
+	addcert := flag.String("add-cert", "", "If editing an account, let a client certificate with this identity act as the account, such as cn:name, uri:spiffe://..., email:name@example.com or spki:<sha256 hex>")
+	delcert := flag.String("del-cert", "", "If editing an account, stop a client certificate with this identity acting as the account")
+	certidentities := flag.String("cert-identities", "", "Prints the identities of the PEM certificate in this file which -add-cert takes. Does not edit.")
+
 	flag.Parse()
 
 	if *authfile == "" {
@@ -81,6 +100,11 @@ func main() {
 		}
 	}
 
+	if *add && strings.HasPrefix(*username, auth.JWTUserPrefix) {
+		fmt.Println("Usernames starting with " + auth.JWTUserPrefix + " are kept for accounts from JWTs")
+		os.Exit(1)
+	}
+
 	if *add && *username != "" && *password != "" {
 		hashedpass, hasherr := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
 
@@ -106,6 +130,14 @@ func main() {
 			fmt.Println("Account has access to write path " + *addwrite)
 			newAcc.Writeable = append(newAcc.Writeable, *addwrite)
 		}
+		if *quotabytes > 0 {
+			fmt.Printf("Account can store %d bytes\n", *quotabytes)
+			newAcc.QuotaBytes = *quotabytes
+		}
+		if *quotafiles > 0 {
+			fmt.Printf("Account can store %d files\n", *quotafiles)
+			newAcc.QuotaFiles = *quotafiles
+		}
 		authdb.AddUser(newAcc)
 	} else if *add && (*username == "" || *password == "") {
 		fmt.Println("Did not add user because no username or password was passed")
@@ -136,6 +168,9 @@ func main() {
 		fmt.Println("Found account with " + acc.User)
 		fmt.Println("Account has access to read paths " + strings.Join(acc.Readable, ", "))
 		fmt.Println("Account has access to write paths " + strings.Join(acc.Writeable, ", "))
+		fmt.Printf("Account quota is %d bytes and %d files (0 is no limit)\n", acc.QuotaBytes, acc.QuotaFiles)
+		fmt.Printf("Account has %d API tokens\n", len(acc.Tokens))
+		fmt.Println("Account can use client certificates " + strings.Join(acc.Certificates, ", "))
 	}
 
 	if *edit {
@@ -176,7 +211,134 @@ func main() {
 				acc.Writeable = remove(acc.Writeable, *delwrite)
 			}
 
+			if *quotabytes >= 0 {
+				fmt.Printf("Changing byte quota to %d\n", *quotabytes)
+				acc.QuotaBytes = *quotabytes
+			}
+
+			if *quotafiles >= 0 {
+				fmt.Printf("Changing file quota to %d\n", *quotafiles)
+				acc.QuotaFiles = *quotafiles
+			}
+
+			if *addcert != "" && !contains(acc.Certificates, *addcert) {
+				// a certificate listed by two accounts can't be used at all, so don't let that happen
+				for _, other := range db {
+					if other.User != acc.User && contains(other.Certificates, *addcert) {
+						fmt.Println("Client certificate " + *addcert + " is already used by " + other.User)
+						os.Exit(1)
+					}
+				}
+				fmt.Println("Adding client certificate " + *addcert)
+				acc.Certificates = append(acc.Certificates, *addcert)
+			}
+
+			if *delcert != "" && contains(acc.Certificates, *delcert) {
+				fmt.Println("Removing client certificate " + *delcert)
+				acc.Certificates = remove(acc.Certificates, *delcert)
+			}
+
 			authdb.AddUser(acc)
 		}
 	}
+
+	if *certidentities != "" {
+		data, readerr := ioutil.ReadFile(*certidentities)
+		if readerr != nil {
+			fmt.Print("Recieved error reading the certificate: ")
+			fmt.Println(readerr)
+			os.Exit(1)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			fmt.Println("No PEM certificate in " + *certidentities)
+			os.Exit(1)
+		}
+		cert, parseerr := x509.ParseCertificate(block.Bytes)
+		if parseerr != nil {
+			fmt.Print("Recieved error parsing the certificate: ")
+			fmt.Println(parseerr)
+			os.Exit(1)
+		}
+		for _, identity := range auth.CertificateIdentities(cert) {
+			fmt.Println(identity)
+		}
+	}
+
+	if *addtoken != "" {
+		acc, found := authdb.GetAll()[*username]
+		if !found {
+			fmt.Println("User did not exist")
+			os.Exit(1)
+		}
+
+		var expires time.Time
+		if *tokenexpires > 0 {
+			expires = time.Now().Add(*tokenexpires).UTC().Truncate(time.Second)
+		}
+		token, secret, tokenerr := auth.NewToken(acc, *addtoken, expires, splitPaths(*tokenread), splitPaths(*tokenwrite), *tokenreadonly)
+		if tokenerr != nil {
+			fmt.Print("Recieved error while creating the token: ")
+			fmt.Println(tokenerr)
+			os.Exit(1)
+		}
+		acc.Tokens = append(acc.Tokens, token)
+		authdb.AddUser(acc)
+
+		fmt.Println("Created token " + token.Name + " for " + acc.User + ". Store the secret now, it will not be shown again:")
+		fmt.Println(secret)
+	}
+
+	if *listtokens {
+		acc, found := authdb.GetAll()[*username]
+		if !found {
+			fmt.Println("User did not exist")
+			os.Exit(1)
+		}
+		for _, token := range acc.Tokens {
+			fmt.Println(describeToken(token))
+		}
+	}
+
+	if *revoketoken != "" {
+		acc, found := authdb.GetAll()[*username]
+		if !found {
+			fmt.Println("User did not exist")
+		} else if !acc.RemoveToken(*revoketoken) {
+			fmt.Println("Account has no token called " + *revoketoken)
+		} else {
+			fmt.Println("Revoking token " + *revoketoken)
+			authdb.AddUser(acc)
+		}
+	}
+}
+
+func splitPaths(list string) []string {
+	var paths []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func describeToken(token auth.Token) string {
+	description := "Token " + token.Name + " created " + token.Created.Format(time.RFC3339)
+	if token.Expires.IsZero() {
+		description += ", never expires"
+	} else if token.Expired() {
+		description += ", expired " + token.Expires.Format(time.RFC3339)
+	} else {
+		description += ", expires " + token.Expires.Format(time.RFC3339)
+	}
+	if len(token.Readable) > 0 {
+		description += ", reads " + strings.Join(token.Readable, ", ")
+	}
+	if token.ReadOnly {
+		description += ", read only"
+	} else if len(token.Writeable) > 0 {
+		description += ", writes " + strings.Join(token.Writeable, ", ")
+	}
+	return description
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/zggz/securefileserver/pkg/auth"
@@ -14,11 +16,41 @@ import (
 
 func main() {
 	authfile := flag.String("auth", "", "(Required) Auth configuration location. Make sure this isn't in the data directory")
+	authCacheSize := flag.Int("authcachesize", auth.DefaultCredentialCacheSize, "How many successful password checks to remember")
+	authCacheTTL := flag.Duration("authcachettl", auth.DefaultCredentialCacheTTL, "How long a successful password check is remembered, so Basic auth doesn't run bcrypt on every request. 0 checks every time")
+	basicSessions := flag.Bool("basicsessions", false, "Give clients using Basic auth a session cookie, so the password is only checked once per session while they send it back")
 	certs := flag.String("cert", "certs", "Where to cache SSL certificates on disk")
+	clientCA := flag.String("clientca", "", "PEM bundle of CAs to verify client certificates against, which act as the accounts listing them in Certificates. Clients without one can still use a password. Needs tls. Default is not to ask for client certificates")
+	clientCRL := flag.String("clientcrl", "", "File of PEM or DER revocation lists for client certificates from those CAs, read again when it changes")
 	datapath := flag.String("data", "", "(Required) Data directory to serve and store from")
+	dedupDir := flag.String("dedup", "", "Directory to keep the contents of files in once per distinct content, leaving only references in data, which must then always be served with this flag. Files already in data are served as they are until replaced. Default is to store files as they are")
+	dedupGC := flag.Bool("dedupgc", false, "With -dedup, remove blobs no file refers to when starting, such as those left by a crash. Skipped if any file is not a reference")
+	davProps := flag.String("davprops", "", "Where to keep WebDAV dead properties on disk. Make sure this isn't in the data directory. Default is to keep them in memory")
+	digestIndex := flag.String("digestindex", "", "Where to keep the index of file digests on disk. Make sure this isn't in the data directory. Default is to keep it in memory")
 	host := flag.String("host", "", "Hostname of this server which we will request certificate for. Required if tls")
+	jwtConfig := flag.String("jwt", "", "JSON file configuring JWT bearer authentication: JWKS (a file or URL), Issuer, Audience, Leeway in seconds, UserClaim, GroupsClaim with Groups mapping each group to Readable and Writeable paths, ReadClaim and WriteClaim. Default is to disable JWTs")
+	keyFile := flag.String("keyfile", "", "File of keys to encrypt stored files with, one base64 encoded 32 byte key per line. The first key encrypts new files and unfinished tus uploads, the others are kept to read files from before a key rotation. FILESERVER_ENCRYPTION_KEYS may hold the keys instead. Default is to store files unencrypted")
+	legacyDigest := flag.Bool("legacydigest", true, "If true also answer the obsolete Want-Digest header with a hex Digest header")
 	maxBodySize := flag.Int64("maxbody", 1<<30, "Maximum size of file uploads")
+	maxExtract := flag.Int64("maxextract", 0, "Maximum size an archive uploaded with ?extract=1 may unpack to. Defaults to ten times maxbody")
+	prune := flag.Bool("prune", false, "If true remove directories made for an upload once a DELETE leaves them empty")
+	quota := flag.String("quota", "", "Limits on what may be stored under each path, as prefix=bytes:files pairs separated by commas, e.g. /=100000000000:0,/scratch=1000000000:10000. Zero means no limit")
+	s3Bucket := flag.String("s3bucket", "", "Bucket of an S3 compatible object store to serve and store from instead of the data directory. Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	s3Endpoint := flag.String("s3endpoint", "", "URL of the S3 compatible object store, e.g. http://localhost:9000. Defaults to AWS in s3region")
+	s3PartSize := flag.Int64("s3partsize", 16<<20, "Uploads larger than this are sent to the object store in parts of this size, which are buffered in memory")
+	s3Prefix := flag.String("s3prefix", "", "Prefix of the keys files are stored under in the bucket")
+	s3Region := flag.String("s3region", "us-east-1", "Region of the bucket")
+	sessionTTL := flag.Duration("sessionttl", 12*time.Hour, "How long a login from the file browser's login page lasts")
+	shareKeys := flag.String("sharekeys", "", "File of keys to sign share links with, one base64 encoded key of at least 16 bytes per line. The first key signs new links, and the file is read again when it changes. Default is to disable share and drop links")
+	shares := flag.String("shares", "", "Where to keep share and drop links and their usage on disk. Make sure this isn't in the data directory. Default is to keep them in memory")
+	staging := flag.String("staging", "", "Directory to hold uploads until they complete. Must be on the same filesystem as data. Defaults to alongside each file")
+	trashDir := flag.String("trash", "", "Directory DELETE moves files to instead of removing them. Must be outside data but on the same filesystem. Default is to disable the trash")
+	trashRetention := flag.Duration("trashretention", 30*24*time.Hour, "How long deleted files are kept in the trash")
+	tusDir := flag.String("tusdir", "", "Directory to keep unfinished tus resumable uploads in. Must be on the same filesystem as data. Default is to disable tus")
+	tusExpiry := flag.Duration("tusexpiry", 24*time.Hour, "How long an unfinished tus upload is kept after its last chunk")
 	tls := flag.Bool("tls", false, "If true use TLS with certificate. Default is to run on http only")
+	versionDir := flag.String("versions", "", "Directory to keep previous versions of replaced and deleted files in. Make sure this isn't in the data directory. Default is to disable version history")
+	versionPolicy := flag.String("versionpolicy", "", "How long versions are kept under each path, as prefix=keepLast:days pairs separated by commas, e.g. /=20:90,/releases=5:0. Zero means no limit")
 	flag.Parse()
 
 	if *tls && *host == "" {
@@ -26,7 +58,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *datapath == "" {
+	if *datapath == "" && *s3Bucket == "" {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -38,12 +70,160 @@ func main() {
 		os.Exit(2)
 	}
 	authdb := auth.MakeAuthFromStore(accountsstore)
+	authdb.SetCredentialCache(*authCacheTTL, *authCacheSize)
 
-	https.StartServer(*tls, *certs, *host, "", "", fileserver.MakeRequestHandler(authdb, *datapath, *maxBodySize, true), &http.Server{
+	var jwtAuth *auth.JWTAuthenticator
+	if *jwtConfig != "" {
+		config, configerror := auth.LoadJWTConfig(*jwtConfig)
+		if configerror == nil {
+			jwtAuth, configerror = auth.MakeJWTAuthenticator(config)
+		}
+		if configerror != nil {
+			fmt.Print("Error setting up JWT authentication: ")
+			fmt.Println(configerror)
+			os.Exit(2)
+		}
+	}
+
+	digestCache := fileserver.MakeEmptyDigestIndex()
+	if *digestIndex != "" {
+		var indexerror error
+		digestCache, indexerror = fileserver.MakeDigestIndex(*digestIndex)
+		if indexerror != nil {
+			fmt.Print("Error loading digest index: ")
+			fmt.Println(indexerror)
+			os.Exit(2)
+		}
+		// the index is saved a little after it changes, so save what is left when asked to stop
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-stop
+			digestCache.Save()
+			os.Exit(0)
+		}()
+	}
+
+	versionPolicies, policyerror := fileserver.ParseVersionPolicies(*versionPolicy)
+	if policyerror != nil {
+		fmt.Println(policyerror)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	pathQuotas, quotaerror := fileserver.ParsePathQuotas(*quota)
+	if quotaerror != nil {
+		fmt.Println(quotaerror)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var storage fileserver.Storage
+	if *s3Bucket != "" {
+		s3, s3error := fileserver.MakeS3Storage(fileserver.S3Config{
+			Endpoint:     *s3Endpoint,
+			Region:       *s3Region,
+			Bucket:       *s3Bucket,
+			Prefix:       *s3Prefix,
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			PartSize:     *s3PartSize,
+		})
+		if s3error != nil {
+			fmt.Println(s3error)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		storage = s3
+	}
+
+	var keyring *fileserver.Keyring
+	if *keyFile != "" || os.Getenv("FILESERVER_ENCRYPTION_KEYS") != "" {
+		var keyerror error
+		if *keyFile != "" {
+			keyring, keyerror = fileserver.LoadKeyring(*keyFile)
+		} else {
+			keyring, keyerror = fileserver.ParseKeyring(os.Getenv("FILESERVER_ENCRYPTION_KEYS"))
+		}
+		if keyerror != nil {
+			fmt.Print("Error loading encryption keys: ")
+			fmt.Println(keyerror)
+			os.Exit(2)
+		}
+		if storage == nil {
+			storage = fileserver.MakeLocalStorage(*datapath, *staging)
+		}
+		storage = fileserver.MakeEncryptedStorage(storage, keyring)
+	}
+
+	if *dedupDir != "" {
+		tree := storage
+		if tree == nil {
+			tree = fileserver.MakeLocalStorage(*datapath, *staging)
+		}
+		if direrror := os.MkdirAll(*dedupDir, 0700); direrror != nil {
+			fmt.Print("Error creating the dedup directory: ")
+			fmt.Println(direrror)
+			os.Exit(2)
+		}
+		var blobs fileserver.Storage = fileserver.MakeLocalStorage(*dedupDir, "")
+		if keyring != nil {
+			blobs = fileserver.MakeEncryptedStorage(blobs, keyring)
+			// the trash and version history keep their copies as stored, which dedup can't give them encrypted
+			if *versionDir != "" || *trashDir != "" {
+				fmt.Println("-trash and -versions can't be used with both -dedup and encryption, as their copies would not be encrypted")
+				os.Exit(1)
+			}
+		}
+		dedup, dedupError := fileserver.MakeDedupStorage(tree, blobs)
+		if dedupError != nil {
+			fmt.Print("Error reading the deduplicated files: ")
+			fmt.Println(dedupError)
+			os.Exit(2)
+		}
+		if *dedupGC {
+			if removed, gcerror := dedup.CollectGarbage(); gcerror != nil {
+				fmt.Print("Not removing unreferenced blobs: ")
+				fmt.Println(gcerror)
+			} else {
+				fmt.Printf("Removed %d unreferenced blobs\n", removed)
+			}
+		}
+		storage = dedup
+	}
+
+	https.StartServerWithOptions(*tls, *certs, *host, "", "", fileserver.MakeRequestHandlerWithOptions(authdb, *datapath, fileserver.Options{
+		MaxBodySize:          *maxBodySize,
+		TruncateLongRequests: true,
+		PruneEmptyDirs:       *prune,
+		StagingDir:           *staging,
+		Storage:              storage,
+		LegacyDigest:         *legacyDigest,
+		DigestCache:          digestCache,
+		TusDir:               *tusDir,
+		TusExpiry:            *tusExpiry,
+		DavPropsFile:         *davProps,
+		SessionTTL:           *sessionTTL,
+		BasicSessions:        *basicSessions,
+		MaxExtractSize:       *maxExtract,
+		VersionDir:           *versionDir,
+		VersionPolicies:      versionPolicies,
+		TrashDir:             *trashDir,
+		TrashRetention:       *trashRetention,
+		PathQuotas:           pathQuotas,
+		ShareKeyFile:         *shareKeys,
+		ShareFile:            *shares,
+		JWT:                  jwtAuth,
+	}), &http.Server{
 		ReadHeaderTimeout: 30 * time.Second,
 		ReadTimeout:       70 * time.Second,
 		WriteTimeout:      10 * time.Second,
 		MaxHeaderBytes:    1 << 20,
 		//ErrorLog:          errLog,
+	}, https.Options{
+		ClientCAFile:  *clientCA,
+		ClientCRLFile: *clientCRL,
 	})
+	digestCache.Save()
 }
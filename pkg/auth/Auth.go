@@ -1,6 +1,9 @@
 package auth
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // store can be any key value store. It is what we use as the backing for our
 type store interface {
@@ -17,6 +20,7 @@ type store interface {
 type Auth struct {
 	store          store
 	defaultAccount Account
+	credentials    *credentialCache
 }
 
 // MakeAuth creates an auth from an underlying store
@@ -24,6 +28,7 @@ func MakeAuth(store store, defaultAccount Account) *Auth {
 	return &Auth{
 		store:          store,
 		defaultAccount: defaultAccount,
+		credentials:    makeCredentialCache(DefaultCredentialCacheTTL, DefaultCredentialCacheSize),
 	}
 }
 
@@ -42,17 +47,38 @@ func (auth Auth) GetDefault() Account {
 	return auth.defaultAccount
 }
 
+// SetCredentialCache changes how long and how many successful password checks are remembered. A ttl of zero
+// turns the cache off, so every check runs bcrypt
+func (auth *Auth) SetCredentialCache(ttl time.Duration, size int) {
+	if ttl <= 0 || size <= 0 {
+		auth.credentials = nil
+		return
+	}
+	auth.credentials = makeCredentialCache(ttl, size)
+}
+
 // GetAccount gets an account if the username and password match
 func (auth Auth) GetAccount(username string, password []byte) (Account, error) {
 	toCheck, exists := auth.store.Get(username)
 	if exists {
+		if toCheck.Hash != "" && auth.credentials.check(username, password, toCheck.Hash) {
+			return toCheck, nil
+		}
 		if toCheck.CheckPassword(password) {
+			if toCheck.Hash != "" {
+				auth.credentials.add(username, password, toCheck.Hash)
+			}
 			return toCheck, nil
 		}
 	}
 	return Account{}, errors.New("Failed to Authenticate")
 }
 
+// GetUser looks up an account without checking a password, for requests already authenticated another way
+func (auth Auth) GetUser(username string) (Account, bool) {
+	return auth.store.Get(username)
+}
+
 // GetAll allows unsecured access to the auth database
 func (auth Auth) GetAll() map[string]Account {
 	return auth.store.GetAll()
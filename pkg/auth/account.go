@@ -12,6 +12,16 @@ type Account struct {
 	Readable  []string
 	Writeable []string
 	Hash      string
+	// QuotaBytes and QuotaFiles limit how much can be stored in the paths the account can write. Zero means no limit
+	QuotaBytes int64
+	QuotaFiles int64
+	// Tokens are API tokens which act as the account
+	Tokens []Token
+	// Certificates are identities of client certificates which act as the account, see CertificateIdentities
+	Certificates []string
+
+	// scope is the token the account was authenticated with, which narrows what it can do
+	scope *Token
 }
 
 // GetName returns the name of the Account
@@ -37,12 +47,20 @@ func canAccess(acl []string, qpath string) bool {
 
 // CanRead returns true if the Account can read the queried path
 func (account Account) CanRead(queriedpath string) bool {
-	return canAccess(account.Readable, queriedpath)
+	return canAccess(account.Readable, queriedpath) && (account.scope == nil || account.scope.allowsRead(queriedpath))
 }
 
 // CanWrite returns true if the Account can write the queried path
 func (account Account) CanWrite(queriedpath string) bool {
-	return canAccess(account.Writeable, queriedpath)
+	return canAccess(account.Writeable, queriedpath) && (account.scope == nil || account.scope.allowsWrite(queriedpath))
+}
+
+// GetToken returns the name of the API token the account was authenticated with, or "" if it wasn't
+func (account Account) GetToken() string {
+	if account.scope == nil {
+		return ""
+	}
+	return account.scope.Name
 }
 
 // CheckPassword checks a password against the Account
@@ -52,3 +70,9 @@ func (account Account) CheckPassword(password []byte) bool {
 	}
 	return bcrypt.CompareHashAndPassword([]byte(account.Hash), password) == nil
 }
+
+// HashPassword hashes a password the way CheckPassword expects, for anything else protected by a password
+func HashPassword(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	return string(hash), err
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// CertificateIdentities returns the names an Account can list in Certificates to be used with a verified client
+// certificate: "cn:" and the subject common name, "uri:" and "email:" with each such subject alternative name,
+// and "spki:" with the hex SHA-256 fingerprint of the public key, which stays the same when it is renewed
+func CertificateIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, "cn:"+cert.Subject.CommonName)
+	}
+	for _, uri := range cert.URIs {
+		identities = append(identities, "uri:"+uri.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		identities = append(identities, "email:"+email)
+	}
+	fingerprint := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return append(identities, "spki:"+hex.EncodeToString(fingerprint[:]))
+}
+
+// GetCertificateAccount gets the account listing an identity of a client certificate. The certificate must
+// already have been verified against the trusted CAs. A certificate whose identities are listed by more than
+// one account is refused, rather than acting as whichever is found first
+func (auth Auth) GetCertificateAccount(cert *x509.Certificate) (Account, error) {
+	identities := CertificateIdentities(cert)
+	var matched []Account
+	for _, account := range auth.store.GetAll() {
+		if account.hasCertificate(identities) {
+			matched = append(matched, account)
+		}
+	}
+	if len(matched) > 1 {
+		fmt.Println("Refusing a client certificate listed by more than one account, such as " + matched[0].User + " and " + matched[1].User)
+	}
+	if len(matched) != 1 {
+		return Account{}, errors.New("Failed to Authenticate")
+	}
+	return matched[0], nil
+}
+
+func (account Account) hasCertificate(identities []string) bool {
+	for _, listed := range account.Certificates {
+		for _, identity := range identities {
+			if listed == identity {
+				return true
+			}
+		}
+	}
+	return false
+}
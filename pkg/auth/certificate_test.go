@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestCertificate(t *testing.T, cn string, uri string, email string) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if uri != "" {
+		parsed, _ := url.Parse(uri)
+		template.URIs = []*url.URL{parsed}
+	}
+	if email != "" {
+		template.EmailAddresses = []string{email}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestCertificateAccounts(t *testing.T) {
+	byName := makeTestCertificate(t, "build-agent", "", "")
+	byURI := makeTestCertificate(t, "", "spiffe://example.com/backup", "")
+	byEmail := makeTestCertificate(t, "someone", "", "ops@example.com")
+	byKey := makeTestCertificate(t, "renewed", "", "")
+	unknown := makeTestCertificate(t, "stranger", "spiffe://example.com/other", "stranger@example.com")
+
+	identities := CertificateIdentities(byKey)
+	spki := identities[len(identities)-1]
+	if !strings.HasPrefix(spki, "spki:") || len(spki) != len("spki:")+64 {
+		t.Fatalf("Got identities %v", identities)
+	}
+
+	authdb := MakeAuthFromStore(MakeEmptyGoCacheStore(filepath.Join(t.TempDir(), "auth.json")))
+	authdb.AddUser(Account{User: "ci", Certificates: []string{"cn:build-agent", "uri:spiffe://example.com/backup"}})
+	authdb.AddUser(Account{User: "ops", Certificates: []string{"email:ops@example.com", spki}})
+	shared := makeTestCertificate(t, "build-agent", "", "ops@example.com")
+
+	var tests = []struct {
+		description string
+		cert        *x509.Certificate
+		user        string
+	}{
+		{"common name", byName, "ci"},
+		{"URI", byURI, "ci"},
+		{"email", byEmail, "ops"},
+		{"public key", byKey, "ops"},
+		{"not listed", unknown, ""},
+		{"listed by two accounts", shared, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			account, err := authdb.GetCertificateAccount(tt.cert)
+			if account.GetName() != tt.user || (err == nil) != (tt.user != "") {
+				t.Errorf("Got %q, %v, want %q", account.GetName(), err, tt.user)
+			}
+		})
+	}
+}
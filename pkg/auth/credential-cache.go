@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// DefaultCredentialCacheTTL and DefaultCredentialCacheSize are how long a checked password is remembered and how
+// many are remembered, unless changed with SetCredentialCache
+const DefaultCredentialCacheTTL = 5 * time.Minute
+const DefaultCredentialCacheSize = 10000
+
+// credentialCache remembers username and password pairs which passed the bcrypt check, so a client sending
+// Basic auth on every request only pays for bcrypt once in a while. Entries are keyed by an HMAC of the pair
+// under a key made at startup, so neither is ever kept, and hold the hash they were checked against so a
+// changed password or reloaded auth file stops them matching straight away
+type credentialCache struct {
+	lock    sync.Mutex
+	key     []byte
+	ttl     time.Duration
+	size    int
+	entries map[[sha256.Size]byte]credentialEntry
+}
+
+type credentialEntry struct {
+	hash    string
+	expires time.Time
+}
+
+func makeCredentialCache(ttl time.Duration, size int) *credentialCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		// without a secret key the cache could be used to guess passwords offline, so don't have one
+		return nil
+	}
+	return &credentialCache{key: key, ttl: ttl, size: size, entries: make(map[[sha256.Size]byte]credentialEntry)}
+}
+
+func (cache *credentialCache) id(username string, password []byte) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, cache.key)
+	// the length keeps "ab"+"c" and "a"+"bc" apart
+	mac.Write([]byte{byte(len(username) >> 8), byte(len(username))})
+	mac.Write([]byte(username))
+	mac.Write(password)
+	var id [sha256.Size]byte
+	copy(id[:], mac.Sum(nil))
+	return id
+}
+
+// check returns true if the pair was checked against hash recently
+func (cache *credentialCache) check(username string, password []byte, hash string) bool {
+	if cache == nil {
+		return false
+	}
+	id := cache.id(username, password)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, found := cache.entries[id]
+	if !found {
+		return false
+	}
+	if entry.hash != hash || time.Now().After(entry.expires) {
+		delete(cache.entries, id)
+		return false
+	}
+	return true
+}
+
+// add remembers that the pair matched hash, making room by dropping expired entries and then any others
+func (cache *credentialCache) add(username string, password []byte, hash string) {
+	if cache == nil {
+		return
+	}
+	id := cache.id(username, password)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if len(cache.entries) >= cache.size {
+		now := time.Now()
+		for k, v := range cache.entries {
+			if now.After(v.expires) {
+				delete(cache.entries, k)
+			}
+		}
+		for k := range cache.entries {
+			if len(cache.entries) < cache.size {
+				break
+			}
+			delete(cache.entries, k)
+		}
+	}
+	cache.entries[id] = credentialEntry{hash: hash, expires: time.Now().Add(cache.ttl)}
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCredentialCache(t *testing.T) {
+	hash := func(password string) string {
+		h, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		return string(h)
+	}
+	authdb := MakeAuthFromStore(MakeEmptyGoCacheStore(filepath.Join(t.TempDir(), "auth.json")))
+	authdb.AddUser(Account{User: "alice", Hash: hash("first")})
+
+	var tests = []struct {
+		description string
+		password    string
+		valid       bool
+		cached      int
+	}{
+		{"right password", "first", true, 1},
+		{"remembered", "first", true, 1},
+		{"wrong password isn't remembered", "wrong", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			_, err := authdb.GetAccount("alice", []byte(tt.password))
+			if (err == nil) != tt.valid || len(authdb.credentials.entries) != tt.cached {
+				t.Errorf("Got %v with %d remembered, want valid %t with %d", err, len(authdb.credentials.entries), tt.valid, tt.cached)
+			}
+		})
+	}
+
+	// a changed hash, as after a reload of the auth file, stops the remembered password working
+	authdb.AddUser(Account{User: "alice", Hash: hash("second")})
+	if _, err := authdb.GetAccount("alice", []byte("first")); err == nil {
+		t.Error("Old password still worked after it was changed")
+	}
+	if _, err := authdb.GetAccount("alice", []byte("second")); err != nil {
+		t.Error(err)
+	}
+
+	// the cache stays within its size, and forgets passwords once they expire
+	authdb.SetCredentialCache(time.Hour, 2)
+	for _, user := range []string{"a", "b", "c"} {
+		authdb.AddUser(Account{User: user, Hash: hash(user)})
+		authdb.GetAccount(user, []byte(user))
+	}
+	if len(authdb.credentials.entries) != 2 {
+		t.Errorf("Remembered %d passwords, want 2", len(authdb.credentials.entries))
+	}
+	authdb.SetCredentialCache(time.Nanosecond, 10)
+	authdb.GetAccount("a", []byte("a"))
+	time.Sleep(time.Millisecond)
+	if authdb.credentials.check("a", []byte("a"), authdb.GetAll()["a"].Hash) {
+		t.Error("Remembered a password past its TTL")
+	}
+}
@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRefresh is how often keys fetched from a URL are fetched again, and jwksRetry how soon a token signed by
+// an unknown key may fetch them early, so tokens made up to look like a rotation can't hammer the provider
+const jwksRefresh = time.Hour
+const jwksRetry = time.Minute
+
+// JWTUserPrefix starts the name of every account made from a JWT, so a token can never act as an account of the
+// same name in the auth file, such as to see its trash or share links. Auth file accounts can't start with it
+const JWTUserPrefix = "jwt:"
+
+// GroupPaths are the paths a group from a JWT grants. "{user}" in a path is replaced by the account name, which
+// is JWTUserPrefix and the user claim. Tokens whose claim holds a glob character, a slash or is . or .. are refused
+type GroupPaths struct {
+	Readable  []string
+	Writeable []string
+}
+
+// JWTConfig says which JWTs to trust and how their claims become an Account. JWKS is a file or http(s) URL of
+// the identity provider's JSON Web Key Set. Issuer and Audience must match the iss and aud claims, and Leeway is
+// how many seconds clocks may disagree by when checking exp and nbf. UserClaim
+// (default "sub") names the account, GroupsClaim lists groups looked up in Groups, and ReadClaim and
+// WriteClaim list paths directly
+type JWTConfig struct {
+	JWKS        string
+	Issuer      string
+	Audience    string
+	Leeway      int64
+	UserClaim   string
+	GroupsClaim string
+	Groups      map[string]GroupPaths
+	ReadClaim   string
+	WriteClaim  string
+}
+
+// LoadJWTConfig reads a JWTConfig from a JSON file
+func LoadJWTConfig(filename string) (JWTConfig, error) {
+	var config JWTConfig
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// jwk is one key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtKey is a public key with the algorithm it verifies
+type jwtKey struct {
+	id  string
+	alg string
+	key crypto.PublicKey
+}
+
+func parseJWK(key jwk) (jwtKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch key.Kty {
+	case "RSA":
+		n, nerr := decode(key.N)
+		e, eerr := decode(key.E)
+		if nerr != nil || eerr != nil || len(e) == 0 || len(e) > 4 {
+			return jwtKey{}, errors.New("Invalid RSA key " + key.Kid)
+		}
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if public.N.BitLen() < 2048 {
+			return jwtKey{}, errors.New("RSA key " + key.Kid + " is shorter than 2048 bits")
+		}
+		return jwtKey{id: key.Kid, alg: "RS256", key: public}, nil
+	case "EC":
+		x, xerr := decode(key.X)
+		y, yerr := decode(key.Y)
+		if key.Crv != "P-256" || xerr != nil || yerr != nil {
+			return jwtKey{}, errors.New("Invalid or unsupported EC key " + key.Kid)
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return jwtKey{}, errors.New("EC key " + key.Kid + " is not on its curve")
+		}
+		return jwtKey{id: key.Kid, alg: "ES256", key: public}, nil
+	case "OKP":
+		x, err := decode(key.X)
+		if key.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return jwtKey{}, errors.New("Invalid or unsupported OKP key " + key.Kid)
+		}
+		return jwtKey{id: key.Kid, alg: "EdDSA", key: ed25519.PublicKey(x)}, nil
+	}
+	return jwtKey{}, errors.New("Unsupported key type " + key.Kty)
+}
+
+// parseJWKS reads the keys of a key set which can verify signatures, skipping any it doesn't support
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	var keys []jwtKey
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		parsed, err := parseJWK(key)
+		if err != nil {
+			fmt.Print("Skipping a key in the JWKS: ")
+			fmt.Println(err)
+			continue
+		}
+		if key.Alg != "" && key.Alg != parsed.alg {
+			continue
+		}
+		keys = append(keys, parsed)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No usable keys in the JWKS")
+	}
+	return keys, nil
+}
+
+// JWTAuthenticator turns JWTs signed by a trusted identity provider into Accounts
+type JWTAuthenticator struct {
+	config JWTConfig
+	client *http.Client
+
+	lock    sync.Mutex
+	keys    []jwtKey
+	fetched time.Time
+	modTime time.Time
+	size    int64
+}
+
+// MakeJWTAuthenticator makes a JWTAuthenticator, loading the keys straight away so a bad JWKS is found early
+func MakeJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	if config.JWKS == "" || config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("JWT authentication needs a JWKS, an issuer and an audience")
+	}
+	if config.UserClaim == "" {
+		config.UserClaim = "sub"
+	}
+	a := &JWTAuthenticator{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+	if _, err := a.currentKeys(false); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *JWTAuthenticator) remote() bool {
+	return strings.HasPrefix(a.config.JWKS, "https://") || strings.HasPrefix(a.config.JWKS, "http://")
+}
+
+// currentKeys returns the keys, reading the file again if it changed or fetching the URL again once it is due.
+// unknown asks for an early fetch as a token named a key we don't have
+func (a *JWTAuthenticator) currentKeys(unknown bool) ([]jwtKey, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.remote() {
+		info, err := os.Stat(a.config.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		if a.keys != nil && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+			return a.keys, nil
+		}
+		data, err := ioutil.ReadFile(a.config.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		a.keys, a.modTime, a.size = keys, info.ModTime(), info.Size()
+		return keys, nil
+	}
+
+	since := time.Since(a.fetched)
+	if a.keys != nil && since < jwksRefresh && (!unknown || since < jwksRetry) {
+		return a.keys, nil
+	}
+	a.fetched = time.Now()
+	keys, err := a.fetch()
+	if err != nil {
+		if a.keys != nil {
+			// keep trusting the keys we have rather than locking everyone out while the provider is down
+			fmt.Print("The following error occured while fetching the JWKS: ")
+			fmt.Println(err)
+			return a.keys, nil
+		}
+		return nil, err
+	}
+	a.keys = keys
+	return keys, nil
+}
+
+func (a *JWTAuthenticator) fetch() ([]jwtKey, error) {
+	resp, err := a.client.Get(a.config.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Fetching the JWKS got %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+var errInvalidJWT = errors.New("Failed to Authenticate")
+
+// verify checks the signature of signed by key for alg
+func (key jwtKey) verify(alg string, signed string, signature []byte) bool {
+	if key.alg != alg {
+		return false
+	}
+	digest := sha256.Sum256([]byte(signed))
+	switch public := key.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS signatures are r and s as fixed size big endian numbers, not ASN.1
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(public, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(public, []byte(signed), signature)
+	}
+	return false
+}
+
+// Authenticate checks a JWT's signature, issuer, audience and lifetime, and returns the Account its claims map to
+func (a *JWTAuthenticator) Authenticate(token string) (Account, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Account{}, errInvalidJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerData, herr := base64.RawURLEncoding.DecodeString(parts[0])
+	signature, serr := base64.RawURLEncoding.DecodeString(parts[2])
+	if herr != nil || serr != nil || json.Unmarshal(headerData, &header) != nil {
+		return Account{}, errInvalidJWT
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" && header.Alg != "EdDSA" {
+		return Account{}, errInvalidJWT
+	}
+
+	verified := false
+	for _, unknown := range []bool{false, true} {
+		keys, err := a.currentKeys(unknown)
+		if err != nil {
+			fmt.Print("The following error occured while loading the JWKS: ")
+			fmt.Println(err)
+			return Account{}, errInvalidJWT
+		}
+		known := false
+		for _, key := range keys {
+			if header.Kid != "" && key.id != header.Kid {
+				continue
+			}
+			known = true
+			if key.verify(header.Alg, parts[0]+"."+parts[1], signature) {
+				verified = true
+				break
+			}
+		}
+		// only a key id we have never seen is worth fetching the keys again for
+		if verified || known || header.Kid == "" {
+			break
+		}
+	}
+	if !verified {
+		return Account{}, errInvalidJWT
+	}
+
+	claimData, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Account{}, errInvalidJWT
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimData, &claims); err != nil {
+		return Account{}, errInvalidJWT
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return Account{}, err
+	}
+	return a.account(claims)
+}
+
+// checkClaims makes sure the token is for us, from who we trust, and current
+func (a *JWTAuthenticator) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); iss != a.config.Issuer {
+		return errInvalidJWT
+	}
+	audience := false
+	for _, aud := range claimStrings(claims["aud"]) {
+		audience = audience || aud == a.config.Audience
+	}
+	if !audience {
+		return errInvalidJWT
+	}
+
+	now := time.Now()
+	leeway := time.Duration(a.config.Leeway) * time.Second
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return errInvalidJWT
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errInvalidJWT
+	}
+	return nil
+}
+
+// account maps the claims onto an Account, so the usual CanRead and CanWrite apply
+func (a *JWTAuthenticator) account(claims map[string]interface{}) (Account, error) {
+	user, _ := claims[a.config.UserClaim].(string)
+	// the name goes into paths in place of {user}, so it mustn't be able to match or climb out to other paths
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, "*?[\\/") {
+		return Account{}, errInvalidJWT
+	}
+	user = JWTUserPrefix + user
+	account := Account{User: user, Readable: []string{}, Writeable: []string{}}
+	if a.config.GroupsClaim != "" {
+		for _, group := range claimStrings(claims[a.config.GroupsClaim]) {
+			paths := a.config.Groups[group]
+			for _, p := range paths.Readable {
+				account.Readable = append(account.Readable, strings.Replace(p, "{user}", user, -1))
+			}
+			for _, p := range paths.Writeable {
+				account.Writeable = append(account.Writeable, strings.Replace(p, "{user}", user, -1))
+			}
+		}
+	}
+	if a.config.ReadClaim != "" {
+		account.Readable = append(account.Readable, claimPaths(claims[a.config.ReadClaim])...)
+	}
+	if a.config.WriteClaim != "" {
+		account.Writeable = append(account.Writeable, claimPaths(claims[a.config.WriteClaim])...)
+	}
+	return account, nil
+}
+
+// claimStrings reads a claim which may be a single string or a list of them
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// claimPaths reads a path claim, ignoring anything which isn't an absolute path
+func claimPaths(claim interface{}) []string {
+	var paths []string
+	for _, p := range claimStrings(claim) {
+		if strings.HasPrefix(p, "/") {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func (s testSigner) jwk() map[string]string {
+	key := map[string]string{"kid": s.kid, "use": "sig"}
+	switch public := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		key["kty"], key["n"], key["e"] = "RSA", b64.EncodeToString(public.N.Bytes()), b64.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		key["kty"], key["crv"], key["x"], key["y"] = "EC", "P-256", b64.EncodeToString(public.X.Bytes()), b64.EncodeToString(public.Y.Bytes())
+	case ed25519.PublicKey:
+		key["kty"], key["crv"], key["x"] = "OKP", "Ed25519", b64.EncodeToString(public)
+	}
+	return key
+}
+
+func (s testSigner) sign(t *testing.T, header map[string]string, claims map[string]interface{}) string {
+	if header == nil {
+		header = map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"}
+	}
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(headerJSON) + "." + b64.EncodeToString(claimsJSON)
+
+	var signature []byte
+	var err error
+	digest := sha256.Sum256([]byte(signed))
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64.EncodeToString(signature)
+}
+
+func writeJWKS(t *testing.T, filename string, signers ...testSigner) []byte {
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if filename != "" {
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rs := testSigner{"rsa", "RS256", rsaKey}
+	es := testSigner{"ec", "ES256", ecKey}
+	ed := testSigner{"ed", "EdDSA", edKey}
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	unknown := testSigner{"other", "ES256", otherKey}
+
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, rs, es, ed)
+	authenticator, err := MakeJWTAuthenticator(JWTConfig{
+		JWKS:        jwks,
+		Issuer:      "https://id.example.com",
+		Audience:    "files",
+		UserClaim:   "preferred_username",
+		GroupsClaim: "groups",
+		Groups: map[string]GroupPaths{
+			"staff": {Readable: []string{"/shared"}, Writeable: []string{"/home/{user}"}},
+		},
+		ReadClaim:  "file_read",
+		WriteClaim: "file_write",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":                "https://id.example.com",
+			"aud":                []string{"other", "files"},
+			"sub":                "1234",
+			"preferred_username": "alice",
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"groups":             []string{"staff", "unknown"},
+			"file_read":          "/reports",
+			"file_write":         []string{"/uploads", "relative"},
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+
+	var tests = []struct {
+		description string
+		token       string
+		valid       bool
+	}{
+		{"RS256", rs.sign(t, nil, claims(nil)), true},
+		{"ES256", es.sign(t, nil, claims(nil)), true},
+		{"EdDSA", ed.sign(t, nil, claims(nil)), true},
+		{"without a key id", es.sign(t, map[string]string{"alg": "ES256"}, claims(nil)), true},
+		{"single audience", rs.sign(t, nil, claims(map[string]interface{}{"aud": "files"})), true},
+		{"wrong issuer", rs.sign(t, nil, claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"wrong audience", rs.sign(t, nil, claims(map[string]interface{}{"aud": "other"})), false},
+		{"expired", rs.sign(t, nil, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), false},
+		{"no expiry", rs.sign(t, nil, claims(map[string]interface{}{"exp": nil})), false},
+		{"not yet valid", rs.sign(t, nil, claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), false},
+		{"no user", rs.sign(t, nil, claims(map[string]interface{}{"preferred_username": ""})), false},
+		{"user matching every path", rs.sign(t, nil, claims(map[string]interface{}{"preferred_username": "*"})), false},
+		{"user with a pattern", rs.sign(t, nil, claims(map[string]interface{}{"preferred_username": "al[a-z]ce"})), false},
+		{"user with a slash", rs.sign(t, nil, claims(map[string]interface{}{"preferred_username": "alice/../bob"})), false},
+		{"user climbing out", rs.sign(t, nil, claims(map[string]interface{}{"preferred_username": ".."})), false},
+		{"unknown key", unknown.sign(t, nil, claims(nil)), false},
+		{"key id of another key", es.sign(t, map[string]string{"alg": "ES256", "kid": "rsa"}, claims(nil)), false},
+		{"algorithm doesn't match the key", es.sign(t, map[string]string{"alg": "RS256", "kid": "ec"}, claims(nil)), false},
+		{"unsigned", b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + b64.EncodeToString([]byte(`{"sub":"alice"}`)) + ".", false},
+		{"not a JWT", "sfs_0123_abc", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			_, err := authenticator.Authenticate(tt.token)
+			if (err == nil) != tt.valid {
+				t.Errorf("Got %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+
+	// changing the claims breaks the signature
+	parts := strings.Split(rs.sign(t, nil, claims(nil)), ".")
+	admin, _ := json.Marshal(claims(map[string]interface{}{"file_write": "/"}))
+	if _, err := authenticator.Authenticate(parts[0] + "." + b64.EncodeToString(admin) + "." + parts[2]); err == nil {
+		t.Error("Accepted a token with changed claims")
+	}
+
+	account, _ := authenticator.Authenticate(ed.sign(t, nil, claims(nil)))
+	if account.GetName() != "jwt:alice" || !account.CanRead("/shared/a") || !account.CanRead("/reports/b") || account.CanRead("/other") {
+		t.Errorf("Got read access %v for %s", account.Readable, account.GetName())
+	}
+	if !account.CanWrite("/home/jwt:alice/a") || !account.CanWrite("/uploads/b") || account.CanWrite("/home/alice") || account.CanWrite("/shared/a") {
+		t.Errorf("Got write access %v", account.Writeable)
+	}
+
+	// a key set served over HTTP is fetched again when a token names a key it doesn't have yet
+	served := writeJWKS(t, "", rs)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	}))
+	defer server.Close()
+	remote, err := MakeJWTAuthenticator(JWTConfig{JWKS: server.URL, Issuer: "https://id.example.com", Audience: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served = writeJWKS(t, "", rs, unknown)
+	if _, err := remote.Authenticate(unknown.sign(t, nil, claims(nil))); err == nil {
+		t.Error("Fetched the keys again straight away")
+	}
+	remote.fetched = time.Now().Add(-jwksRetry)
+	if account, err := remote.Authenticate(unknown.sign(t, nil, claims(nil))); err != nil || account.GetName() != "jwt:1234" {
+		t.Errorf("Got %q, %v after rotating keys", account.GetName(), err)
+	}
+}
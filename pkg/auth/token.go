@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// tokenPrefix starts every API token, so they are easy to spot in configuration and logs
+const tokenPrefix = "sfs_"
+
+// Token lets a program act as an Account without its password, by sending "Authorization: Bearer <secret>".
+// Only a hash of the secret is kept. Readable and Writeable narrow what the account can do, where empty
+// means everything the account can do, and a ReadOnly token can't write at all. A zero Expires never expires
+type Token struct {
+	ID        string
+	Name      string
+	Hash      string
+	Created   time.Time
+	Expires   time.Time
+	Readable  []string
+	Writeable []string
+	ReadOnly  bool
+}
+
+// Expired returns true once the token can no longer be used
+func (token Token) Expired() bool {
+	return !token.Expires.IsZero() && time.Now().After(token.Expires)
+}
+
+func (token Token) allowsRead(queriedpath string) bool {
+	return len(token.Readable) == 0 || canAccess(token.Readable, queriedpath)
+}
+
+func (token Token) allowsWrite(queriedpath string) bool {
+	return !token.ReadOnly && (len(token.Writeable) == 0 || canAccess(token.Writeable, queriedpath))
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken makes a token called name for account, returning it along with the secret to hand to whoever will
+// use it. The secret can't be recovered later. The token's paths must be ones the account can already use
+func NewToken(account Account, name string, expires time.Time, readable []string, writeable []string, readOnly bool) (Token, string, error) {
+	if name == "" {
+		return Token{}, "", errors.New("Tokens need a name")
+	}
+	if _, found := account.FindToken(name); found {
+		return Token{}, "", errors.New("The account already has a token called " + name)
+	}
+	if readOnly && len(writeable) > 0 {
+		return Token{}, "", errors.New("A read only token can't have write paths")
+	}
+	for _, p := range readable {
+		if !account.CanRead(p) {
+			return Token{}, "", errors.New("The account can't read " + p)
+		}
+	}
+	for _, p := range writeable {
+		if !account.CanWrite(p) {
+			return Token{}, "", errors.New("The account can't write " + p)
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return Token{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return Token{}, "", err
+	}
+	token := Token{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Created:   time.Now().UTC().Truncate(time.Second),
+		Expires:   expires,
+		Readable:  readable,
+		Writeable: writeable,
+		ReadOnly:  readOnly,
+	}
+	// the id is hex so the first underscore after the prefix always ends it
+	full := tokenPrefix + token.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	token.Hash = hashToken(full)
+	return token, full, nil
+}
+
+// FindToken returns the account's token called name
+func (account Account) FindToken(name string) (Token, bool) {
+	for _, token := range account.Tokens {
+		if token.Name == name {
+			return token, true
+		}
+	}
+	return Token{}, false
+}
+
+// RemoveToken takes the token called name off the account, returning false if it had none
+func (account *Account) RemoveToken(name string) bool {
+	for i, token := range account.Tokens {
+		if token.Name == name {
+			account.Tokens = append(account.Tokens[:i:i], account.Tokens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// GetTokenAccount gets the account owning an API token, limited to what the token allows
+func (auth Auth) GetTokenAccount(secret string) (Account, error) {
+	invalid := errors.New("Failed to Authenticate")
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return Account{}, invalid
+	}
+	parts := strings.SplitN(strings.TrimPrefix(secret, tokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return Account{}, invalid
+	}
+
+	hash := hashToken(secret)
+	for _, account := range auth.store.GetAll() {
+		for _, token := range account.Tokens {
+			if token.ID != parts[0] {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 || token.Expired() {
+				return Account{}, invalid
+			}
+			scope := token
+			account.scope = &scope
+			return account, nil
+		}
+	}
+	return Account{}, invalid
+}
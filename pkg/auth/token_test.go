@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	owner := Account{User: "ci", Readable: []string{"/"}, Writeable: []string{"/builds", "/cache"}}
+	authdb := MakeAuthFromStore(MakeEmptyGoCacheStore(filepath.Join(t.TempDir(), "auth.json")))
+
+	newToken := func(name string, expires time.Time, readable []string, writeable []string, readOnly bool) string {
+		token, secret, err := NewToken(owner, name, expires, readable, writeable, readOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner.Tokens = append(owner.Tokens, token)
+		authdb.AddUser(owner)
+		return secret
+	}
+	full := newToken("full", time.Time{}, nil, nil, false)
+	scoped := newToken("scoped", time.Now().Add(time.Hour), []string{"/builds"}, []string{"/builds/nightly"}, false)
+	readOnly := newToken("readonly", time.Time{}, nil, nil, true)
+	expired := newToken("expired", time.Now().Add(-time.Minute), nil, nil, false)
+
+	var tests = []struct {
+		description string
+		secret      string
+		path        string
+		read        bool
+		write       bool
+	}{
+		{"full token reads", full, "/docs/a", true, false},
+		{"full token writes", full, "/cache/a", true, true},
+		{"scoped token reads inside", scoped, "/builds/1", true, false},
+		{"scoped token doesn't read outside", scoped, "/docs/a", false, false},
+		{"scoped token writes inside", scoped, "/builds/nightly/1", true, true},
+		{"scoped token doesn't write outside", scoped, "/cache/a", false, false},
+		{"read only token", readOnly, "/cache/a", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			account, err := authdb.GetTokenAccount(tt.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if account.CanRead(tt.path) != tt.read || account.CanWrite(tt.path) != tt.write {
+				t.Errorf("Got read %t write %t, want %t %t", account.CanRead(tt.path), account.CanWrite(tt.path), tt.read, tt.write)
+			}
+		})
+	}
+
+	for description, secret := range map[string]string{"expired": expired, "tampered": full + "x", "malformed": "sfs_nothing", "empty": ""} {
+		if _, err := authdb.GetTokenAccount(secret); err == nil {
+			t.Errorf("Accepted a %s token", description)
+		}
+	}
+
+	if _, _, err := NewToken(owner, "full", time.Time{}, nil, nil, false); err == nil {
+		t.Error("Made a second token with the same name")
+	}
+	if _, _, err := NewToken(owner, "wider", time.Time{}, nil, []string{"/docs"}, false); err == nil {
+		t.Error("Made a token which writes more than its account")
+	}
+
+	owner.RemoveToken("full")
+	authdb.AddUser(owner)
+	if _, err := authdb.GetTokenAccount(full); err == nil {
+		t.Error("Accepted a revoked token")
+	}
+}
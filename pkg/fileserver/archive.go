@@ -0,0 +1,276 @@
+package fileserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// archiveManifest is the name of the sha256sum compatible manifest added as the last entry of every archive, as the
+// digests are only known once the files have been streamed into it
+const archiveManifest = "SHA256SUMS"
+
+// archiveWriter is the part of zip and tar that differs between the two formats
+type archiveWriter interface {
+	addDir(name string, info os.FileInfo) error
+	// addFile copies exactly info.Size() bytes of r into the archive
+	addFile(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) addDir(name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	_, err = a.CreateHeader(header)
+	return err
+}
+
+func (a zipArchive) addFile(name string, info os.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	w, err := a.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, r, info.Size())
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (a tarArchive) addDir(name string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	header.Uname, header.Gname = "", ""
+	return a.WriteHeader(header)
+}
+
+func (a tarArchive) addFile(name string, info os.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Uname, header.Gname = "", ""
+	if err := a.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.CopyN(a.Writer, r, info.Size())
+	return err
+}
+
+func (a tarArchive) Close() error {
+	if err := a.Writer.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// manifestInfo describes the generated manifest to the archive writers
+type manifestInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (m manifestInfo) Name() string       { return archiveManifest }
+func (m manifestInfo) Size() int64        { return m.size }
+func (m manifestInfo) Mode() os.FileMode  { return 0644 }
+func (m manifestInfo) ModTime() time.Time { return m.modTime }
+func (m manifestInfo) IsDir() bool        { return false }
+func (m manifestInfo) Sys() interface{}   { return nil }
+
+// archiveFilter holds the include and exclude globs of an archive request. A pattern containing a slash
+// is matched against the path within the archive, otherwise against the name alone
+type archiveFilter struct {
+	include []string
+	exclude []string
+}
+
+func globMatches(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		subject := path.Base(name)
+		if strings.Contains(pattern, "/") {
+			subject = name
+		}
+		if match, _ := path.Match(pattern, subject); match {
+			return true
+		}
+	}
+	return false
+}
+
+// parseArchiveFilter reads the include and exclude query parameters, rejecting malformed globs
+func parseArchiveFilter(query map[string][]string) (archiveFilter, error) {
+	filter := archiveFilter{include: query["include"], exclude: query["exclude"]}
+	for _, pattern := range append(append([]string{}, filter.include...), filter.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return filter, fmt.Errorf("Invalid glob %q", pattern)
+		}
+	}
+	return filter, nil
+}
+
+// archiveState is carried through the walk of the directory being archived
+type archiveState struct {
+	archive  archiveWriter
+	user     auth.Account
+	filter   archiveFilter
+	manifest bytes.Buffer
+	rootName string
+}
+
+// addTree adds everything under relativePath the account may read, with names starting at name.
+// Symlinks are left out as they may point outside the data directory
+func (h fileHandler) addTree(state *archiveState, relativePath string, name string) error {
+	infos, err := h.storage.ReadDir(relativePath)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		childPath := path.Join(relativePath, info.Name())
+		childName := path.Join(name, info.Name())
+		inner := strings.TrimPrefix(childName, state.rootName+"/")
+		if isStagingName(info.Name()) || info.Mode()&os.ModeSymlink != 0 || globMatches(state.filter.exclude, inner) {
+			continue
+		}
+		// the generated manifest takes the place of anything of the same name at the top
+		if inner == archiveManifest {
+			continue
+		}
+
+		if info.IsDir() {
+			// a directory's contents may be readable even if it isn't, so descend either way
+			if state.user.CanRead(childPath) && len(state.filter.include) == 0 {
+				if err := state.archive.addDir(childName, info); err != nil {
+					return err
+				}
+			}
+			if err := h.addTree(state, childPath, childName); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !info.Mode().IsRegular() || !state.user.CanRead(childPath) {
+			continue
+		}
+		if len(state.filter.include) > 0 && !globMatches(state.filter.include, inner) {
+			continue
+		}
+
+		if err := h.addArchiveFile(state, childPath, childName, inner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h fileHandler) addArchiveFile(state *archiveState, relativePath string, name string, inner string) error {
+	f, err := h.storage.Open(relativePath)
+	if err != nil {
+		// removed since the directory was read
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	// the header is written from the open file, so a file replaced by an upload meanwhile is still consistent
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.New()
+	if err := state.archive.addFile(name, info, io.TeeReader(f, digest)); err != nil {
+		return err
+	}
+	fmt.Fprintf(&state.manifest, "%s  %s\n", hex.EncodeToString(digest.Sum(nil)), inner)
+	return nil
+}
+
+// archiveHandler streams the directory at relativePath as a zip or gzipped tar built while it is sent,
+// so nothing is written to disk. Query parameters: archive=zip|tar.gz, include=<glob> and exclude=<glob>,
+// each of which may be repeated. A SHA256SUMS manifest of the included files is added last, in place of
+// anything of that name at the top
+func (h fileHandler) archiveHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	format := r.URL.Query().Get("archive")
+	if format != "zip" && format != "tar.gz" {
+		http.Error(w, "Invalid archive format, use zip or tar.gz", 400)
+		return
+	}
+	filter, filtererr := parseArchiveFilter(r.URL.Query())
+	if filtererr != nil {
+		http.Error(w, filtererr.Error(), 400)
+		return
+	}
+
+	rootName := path.Base(relativePath)
+	if relativePath == "/" {
+		rootName = "archive"
+	}
+
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rootName+"."+format))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	state := &archiveState{user: user, filter: filter, rootName: rootName}
+	if format == "zip" {
+		state.archive = zipArchive{zip.NewWriter(w)}
+	} else {
+		gz := gzip.NewWriter(w)
+		state.archive = tarArchive{Writer: tar.NewWriter(gz), gz: gz}
+	}
+
+	// the headers are already sent so all we can do with an error is stop, leaving the archive truncated
+	err := h.addTree(state, relativePath, rootName)
+	if err == nil {
+		info := manifestInfo{size: int64(state.manifest.Len()), modTime: time.Now()}
+		err = state.archive.addFile(rootName+"/"+archiveManifest, info, &state.manifest)
+	}
+	if err == nil {
+		err = state.archive.Close()
+	}
+	if err != nil {
+		fmt.Print("The following error occured while archiving " + relativePath + ": ")
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,137 @@
+package fileserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// readArchive returns the files in a zip or tar.gz body with their contents
+func readArchive(t *testing.T, format string, body []byte) map[string]string {
+	files := make(map[string]string)
+	if format == "zip" {
+		z, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range z.File {
+			if strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			files[f.Name] = string(data)
+		}
+		return files
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		data, _ := ioutil.ReadAll(tr)
+		files[header.Name] = string(data)
+	}
+	return files
+}
+
+func archiveNames(files map[string]string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if !strings.HasSuffix(name, archiveManifest) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestArchive(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{})
+	writeTestFile(t, dataDir, "/rel/a.txt", "hello")
+	writeTestFile(t, dataDir, "/rel/b.log", "log")
+	writeTestFile(t, dataDir, "/rel/sub/c.txt", "nested")
+	writeTestFile(t, dataDir, "/rel/private/d.txt", "secret")
+	writeTestFile(t, dataDir, "/rel/.upload-123", "partial")
+
+	var tests = []struct {
+		description string
+		target      string
+		user        string
+		status      int
+		files       []string
+	}{
+		{"zip", "/rel/?archive=zip", "writer", 200, []string{"rel/a.txt", "rel/b.log", "rel/private/d.txt", "rel/sub/c.txt"}},
+		{"tar.gz", "/rel/?archive=tar.gz", "writer", 200, []string{"rel/a.txt", "rel/b.log", "rel/private/d.txt", "rel/sub/c.txt"}},
+		{"include by name", "/rel/?archive=zip&include=*.txt", "writer", 200, []string{"rel/a.txt", "rel/private/d.txt", "rel/sub/c.txt"}},
+		{"exclude directory", "/rel/?archive=tar.gz&exclude=sub&exclude=private", "writer", 200, []string{"rel/a.txt", "rel/b.log"}},
+		{"include by path", "/rel/?archive=zip&include=sub/*", "writer", 200, []string{"rel/sub/c.txt"}},
+		{"bad format", "/rel/?archive=rar", "writer", 400, nil},
+		{"bad glob", "/rel/?archive=zip&include=[", "writer", 400, nil},
+	}
+
+	if rec := doRequest(handler, http.MethodGet, "/rel/?archive=zip", "", "", nil); rec.Code != 401 {
+		t.Errorf("Anonymous archive got %d", rec.Code)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			rec := doRequest(handler, http.MethodGet, tt.target, tt.user, "", nil)
+			if rec.Code != tt.status {
+				t.Fatalf("Got %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status != 200 {
+				return
+			}
+			format := "zip"
+			if strings.Contains(tt.target, "tar.gz") {
+				format = "tar.gz"
+			}
+			files := readArchive(t, format, rec.Body.Bytes())
+			if names := archiveNames(files); !reflect.DeepEqual(names, tt.files) {
+				t.Errorf("Got files %v, want %v", names, tt.files)
+			}
+
+			manifest := files["rel/"+archiveManifest]
+			if strings.Count(manifest, "\n") != len(tt.files) {
+				t.Errorf("Manifest has the wrong number of entries:\n%s", manifest)
+			}
+			if strings.Contains(tt.target, "include=*.txt") && !strings.Contains(manifest, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  a.txt\n") {
+				t.Errorf("Manifest is missing the digest of a.txt:\n%s", manifest)
+			}
+		})
+	}
+
+	// a file named like the manifest never stands in for it, whether or not it is filtered out
+	writeTestFile(t, dataDir, "/rel/"+archiveManifest, "forged")
+	for _, target := range []string{"/rel/?archive=zip", "/rel/?archive=zip&exclude=" + archiveManifest, "/rel/?archive=zip&include=*.log"} {
+		rec := doRequest(handler, http.MethodGet, target, "writer", "", nil)
+		manifest := readArchive(t, "zip", rec.Body.Bytes())["rel/"+archiveManifest]
+		if strings.Contains(manifest, "forged") || !strings.Contains(manifest, "  b.log\n") {
+			t.Errorf("Got manifest %q for %s", manifest, target)
+		}
+	}
+}
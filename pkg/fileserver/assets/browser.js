@@ -0,0 +1,80 @@
+(function () {
+	"use strict";
+
+	var csrf = document.body.dataset.csrf;
+	// the path is unescaped, so each segment is encoded again to be used in a URL
+	var base = document.body.dataset.path.split("/").map(encodeURIComponent).join("/").replace(/\/?$/, "/");
+	var status = document.getElementById("status");
+
+	function request(method, url, body, headers) {
+		headers = headers || {};
+		if (csrf) {
+			headers["X-CSRF-Token"] = csrf;
+		}
+		return fetch(url, { method: method, body: body, headers: headers, credentials: "same-origin" }).then(function (res) {
+			if (!res.ok) {
+				return res.text().then(function (text) { throw new Error(res.status + " " + text.trim()); });
+			}
+			return res;
+		});
+	}
+
+	function upload(files) {
+		var queue = Array.prototype.slice.call(files);
+		var done = 0;
+		function next() {
+			if (queue.length === 0) {
+				location.reload();
+				return;
+			}
+			var file = queue.shift();
+			status.textContent = "Uploading " + file.name + " (" + (done + 1) + " of " + (done + queue.length + 1) + ")";
+			request("PUT", base + encodeURIComponent(file.name), file).then(function () {
+				done++;
+				next();
+			}, function (err) {
+				status.textContent = "Upload of " + file.name + " failed: " + err.message;
+			});
+		}
+		next();
+	}
+
+	var input = document.getElementById("upload");
+	if (input) {
+		input.addEventListener("change", function () { upload(input.files); });
+	}
+
+	var mkdir = document.getElementById("mkdir");
+	if (mkdir) {
+		mkdir.addEventListener("click", function () {
+			var name = prompt("Folder name");
+			if (name) {
+				request("MKCOL", base + encodeURIComponent(name) + "/").then(function () { location.reload(); }, function (err) { alert(err.message); });
+			}
+		});
+	}
+
+	document.querySelectorAll("button.delete").forEach(function (button) {
+		button.addEventListener("click", function () {
+			var isDir = button.dataset.dir === "true";
+			var what = isDir ? "this folder and everything in it" : "this file";
+			if (confirm("Delete " + what + "?")) {
+				request("DELETE", button.dataset.href, null, isDir ? { "X-Recursive": "true" } : {}).then(function () { location.reload(); }, function (err) { alert(err.message); });
+			}
+		});
+	});
+
+	var drop = document.getElementById("drop");
+	if (drop.classList.contains("droppable")) {
+		drop.addEventListener("dragover", function (e) {
+			e.preventDefault();
+			drop.classList.add("dragging");
+		});
+		drop.addEventListener("dragleave", function () { drop.classList.remove("dragging"); });
+		drop.addEventListener("drop", function (e) {
+			e.preventDefault();
+			drop.classList.remove("dragging");
+			upload(e.dataTransfer.files);
+		});
+	}
+})();
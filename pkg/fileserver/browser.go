@@ -0,0 +1,250 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+//go:embed assets
+var assets embed.FS
+
+var templates = template.Must(template.ParseFS(assets, "assets/*.html"))
+
+// assetTypes are the content types of the files served with ?asset=
+var assetTypes = map[string]string{
+	"browser.css": "text/css; charset=utf-8",
+	"browser.js":  "text/javascript; charset=utf-8",
+}
+
+type crumb struct {
+	Name string
+	Href string
+}
+
+type browserRow struct {
+	Name     string
+	Href     string
+	IsDir    bool
+	Size     string
+	ModTime  string
+	CanWrite bool
+}
+
+type browserPage struct {
+	Path      string
+	Crumbs    []crumb
+	Entries   []browserRow
+	SortLinks map[string]string
+	User      string
+	Session   bool
+	CSRF      string
+	CanWrite  bool
+}
+
+type loginPage struct {
+	Next   string
+	Failed bool
+}
+
+// humanSize formats a byte count the way people read it, e.g. 1.5 MB
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// wantsHTML returns true if the request looks like it came from a browser
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// wantsBrowser returns true if a directory should be shown with the file browser rather than
+// handed to serveFile, which serves the directory's index.html if it has one
+func (h fileHandler) wantsBrowser(r *http.Request, relativePath string) bool {
+	if _, browse := r.URL.Query()["browse"]; browse {
+		return true
+	}
+	_, err := h.storage.Stat(path.Join(relativePath, "index.html"))
+	return err != nil
+}
+
+func render(w http.ResponseWriter, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		fmt.Print("The following error occured while rendering " + name + ": ")
+		fmt.Println(err)
+		http.Error(w, "Template Error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// assetHandler serves the embedded stylesheet and script. They hold nothing private so need no login
+func assetHandler(w http.ResponseWriter, r *http.Request, name string) {
+	contentType, ok := assetTypes[name]
+	if !ok {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	data, err := assets.ReadFile("assets/" + name)
+	if err != nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write(data)
+}
+
+// localRedirect only allows redirects to a path on this server, never to another site
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginHandler shows the login page on GET, and on POST checks the credentials and starts a session
+func (h fileHandler) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		render(w, 200, "login.html", loginPage{Next: localRedirect(r.URL.Path)})
+		return
+	}
+
+	next := localRedirect(r.PostFormValue("next"))
+	user, err := h.accounts.GetAccount(r.PostFormValue("username"), []byte(r.PostFormValue("password")))
+	if err != nil || user.GetName() == "" {
+		fmt.Printf("Failed login for %q from %s\n", r.PostFormValue("username"), r.RemoteAddr)
+		render(w, 401, "login.html", loginPage{Next: next, Failed: true})
+		return
+	}
+
+	token, s, err := h.sessions.create(user, h.sessionTTL())
+	if err != nil {
+		http.Error(w, "Could not create session", 500)
+		return
+	}
+	fmt.Printf("Login for %s from %s\n", user.GetName(), r.RemoteAddr)
+	setSessionCookie(w, r, token, s.Expires)
+	http.Redirect(w, r, next, 303)
+}
+
+// logoutHandler ends the session. It is a form post, so the CSRF token comes in the form rather than a header
+func (h fileHandler) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Supported", 405)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if s, found := h.sessions.get(cookie.Value); found {
+			if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(s.CSRF)) != 1 {
+				http.Error(w, "Forbidden", 403)
+				return
+			}
+			h.sessions.remove(cookie.Value)
+		}
+	}
+	setSessionCookie(w, r, "", time.Unix(0, 0))
+	http.Redirect(w, r, "?login", 303)
+}
+
+// browserHandler renders a directory as a page with breadcrumbs, sortable columns and,
+// when the account can write, upload, delete and new folder controls
+func (h fileHandler) browserHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account, s *session) {
+	// the page uses relative links, so directories need their trailing slash like serveFile gives them
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		target := r.URL.Path + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, 301)
+		return
+	}
+
+	entries, err := h.collectEntries(relativePath, 1, user, nil)
+	if err != nil {
+		http.Error(w, "Could not read directory", 500)
+		return
+	}
+
+	field := r.URL.Query().Get("sort")
+	desc := r.URL.Query().Get("order") == "desc"
+	less := listCompare(field)
+	// directories first, then whatever the columns are sorted by
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if (a.Type == "dir") != (b.Type == "dir") {
+			return a.Type == "dir"
+		}
+		if desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+
+	page := browserPage{
+		Path:      relativePath,
+		User:      user.GetName(),
+		Session:   s != nil,
+		CanWrite:  user.CanWrite(relativePath),
+		SortLinks: make(map[string]string),
+	}
+	if s != nil {
+		page.CSRF = s.CSRF
+	}
+
+	page.Crumbs = append(page.Crumbs, crumb{Name: "Home", Href: "/"})
+	href := "/"
+	for _, part := range strings.Split(strings.Trim(relativePath, "/"), "/") {
+		if part != "" {
+			href += url.PathEscape(part) + "/"
+			page.Crumbs = append(page.Crumbs, crumb{Name: part, Href: href})
+		}
+	}
+
+	for _, f := range []string{"name", "size", "mtime"} {
+		order := "asc"
+		if (f == field || (f == "name" && field == "")) && !desc {
+			order = "desc"
+		}
+		page.SortLinks[f] = "?sort=" + f + "&order=" + order
+	}
+
+	for _, e := range entries {
+		row := browserRow{
+			Name:     e.Name,
+			Href:     href + url.PathEscape(e.Name),
+			IsDir:    e.Type == "dir",
+			Size:     humanSize(e.Size),
+			ModTime:  e.ModTime.Local().Format("2006-01-02 15:04"),
+			CanWrite: e.CanWrite,
+		}
+		if row.IsDir {
+			row.Href += "/"
+		}
+		page.Entries = append(page.Entries, row)
+	}
+
+	render(w, 200, "browser.html", page)
+}
@@ -0,0 +1,151 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// login posts the login form and returns the session cookie and the page's CSRF token
+func login(t *testing.T, handler http.Handler, user string) (*http.Cookie, string) {
+	form := url.Values{"username": {user}, "password": {"password"}, "next": {"/"}}
+	req := httptest.NewRequest(http.MethodPost, "/?login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 303 {
+		t.Fatalf("Login as %s got %d", user, rec.Code)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("Login as %s did not set an HttpOnly session cookie", user)
+	}
+
+	page := doCookieRequest(handler, http.MethodGet, "/", cookie, "", nil)
+	body := page.Body.String()
+	start := strings.Index(body, `data-csrf="`) + len(`data-csrf="`)
+	return cookie, body[start : start+strings.IndexByte(body[start:], '"')]
+}
+
+func doCookieRequest(handler http.Handler, method string, target string, cookie *http.Cookie, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.AddCookie(cookie)
+	req.Header.Set("Accept", "text/html")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBrowserPages(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{})
+	writeTestFile(t, dataDir, "/docs/report.txt", "hello")
+	writeTestFile(t, dataDir, "/site/index.html", "<p>site</p>")
+	html := map[string]string{"Accept": "text/html"}
+
+	var tests = []struct {
+		description string
+		target      string
+		user        string
+		headers     map[string]string
+		status      int
+		contains    []string
+		excludes    []string
+	}{
+		{"anonymous browser gets the login page", "/docs/", "", html, 401, []string{`action="?login"`}, nil},
+		{"anonymous client gets basic auth", "/docs/", "", nil, 401, []string{"Unauthorised"}, nil},
+		{"basic forces the prompt", "/?basic", "", html, 401, []string{"Unauthorised"}, nil},
+		{"assets need no login", "/docs/?asset=browser.js", "", nil, 200, []string{"X-CSRF-Token"}, nil},
+		{"unknown asset", "/?asset=secret", "", nil, 404, nil, nil},
+		{"writer sees controls", "/docs/", "writer", html, 200, []string{"report.txt", "5 B", `id="upload"`, `class="delete"`}, nil},
+		{"reader sees no controls", "/docs/", "reader", html, 200, []string{"report.txt"}, []string{`id="upload"`, `class="delete"`}},
+		{"index.html is served", "/site/", "reader", html, 200, []string{"<p>site</p>"}, nil},
+		{"browse overrides index.html", "/site/?browse", "reader", html, 200, []string{"index.html"}, nil},
+		{"trailing slash redirect", "/docs?sort=size", "reader", html, 301, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			rec := doRequest(handler, http.MethodGet, tt.target, tt.user, "", tt.headers)
+			if rec.Code != tt.status {
+				t.Fatalf("Got %d, want %d", rec.Code, tt.status)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(rec.Body.String(), s) {
+					t.Errorf("Body does not contain %q", s)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(rec.Body.String(), s) {
+					t.Errorf("Body contains %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestBrowserSession(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{})
+
+	form := url.Values{"username": {"writer"}, "password": {"password"}, "next": {"https://evil.example/"}}
+	req := httptest.NewRequest(http.MethodPost, "/?login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 303 || rec.Header().Get("Location") != "/" {
+		t.Errorf("Login redirected to %q, want a local path", rec.Header().Get("Location"))
+	}
+
+	cookie, csrf := login(t, handler, "writer")
+	if csrf == "" {
+		t.Fatal("No CSRF token on the page")
+	}
+
+	if rec := doCookieRequest(handler, http.MethodPut, "/a.txt", cookie, "data", nil); rec.Code != 403 {
+		t.Errorf("PUT without CSRF token got %d", rec.Code)
+	}
+	if rec := doCookieRequest(handler, http.MethodPut, "/a.txt", cookie, "data", map[string]string{"X-CSRF-Token": csrf}); rec.Code != 201 {
+		t.Errorf("PUT with CSRF token got %d", rec.Code)
+	}
+	if rec := doCookieRequest(handler, "MKCOL", "/new", cookie, "", map[string]string{"X-CSRF-Token": csrf}); rec.Code != 201 {
+		t.Errorf("MKCOL with CSRF token got %d", rec.Code)
+	}
+	if !exists(dataDir, "/a.txt") || !exists(dataDir, "/new") {
+		t.Error("Session requests did not write")
+	}
+
+	logout := url.Values{"csrf": {csrf}}
+	req = httptest.NewRequest(http.MethodPost, "/?logout", strings.NewReader(logout.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 303 {
+		t.Errorf("Logout got %d", rec.Code)
+	}
+	if rec := doCookieRequest(handler, http.MethodGet, "/", cookie, "", nil); rec.Code != 401 {
+		t.Errorf("Session still valid after logout, got %d", rec.Code)
+	}
+}
+
+func TestBadLogin(t *testing.T) {
+	handler, _ := makeTestHandler(t, Options{})
+	form := url.Values{"username": {"nobody"}, "password": {"password"}}
+	req := httptest.NewRequest(http.MethodPost, "/?login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 401 || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Bad login got %d with cookies %v", rec.Code, rec.Result().Cookies())
+	}
+}
@@ -0,0 +1,132 @@
+package fileserver
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// formatETag builds a strong entity tag from the sha-256 of a file's contents
+func formatETag(sum []byte) string {
+	return "\"" + hex.EncodeToString(sum) + "\""
+}
+
+// etagFor returns the strong entity tag of the file name
+func (h fileHandler) etagFor(name string) (string, error) {
+	digests, err := h.fileDigests(name, []string{"sha-256"})
+	if err != nil {
+		return "", err
+	}
+	return formatETag(digests["sha-256"]), nil
+}
+
+// insertETag sets the ETag of a file being served so http.ServeContent can answer If-None-Match and If-Match with it.
+// The digest comes from the storage or the DigestCache when they have it, and without either the file is hashed
+func (h fileHandler) insertETag(w http.ResponseWriter, name string) {
+	if etag, err := h.etagFor(name); err == nil {
+		w.Header().Set("ETag", etag)
+	}
+}
+
+// etagListMatches does a strong comparison of etag against a comma separated If-Match or If-None-Match list
+func etagListMatches(list string, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		// weak tags never match strongly
+		if candidate == etag && !strings.HasPrefix(candidate, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates If-Match, If-Unmodified-Since and If-None-Match in the order of RFC 9110
+// for a request which changes name. If a precondition fails it responds with 412 and returns false
+func (h fileHandler) checkPreconditions(w http.ResponseWriter, r *http.Request, name string) bool {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	ifUnmodifiedSince := r.Header.Get("If-Unmodified-Since")
+	if ifMatch == "" && ifNoneMatch == "" && ifUnmodifiedSince == "" {
+		return true
+	}
+
+	info, staterr := h.storage.Stat(name)
+	exists := staterr == nil
+
+	// only hash the file if a tag actually has to be compared
+	var etag string
+	currentETag := func() string {
+		if etag == "" && exists && !info.IsDir() {
+			etag, _ = h.etagFor(name)
+		}
+		return etag
+	}
+
+	failed := false
+	if ifMatch != "" {
+		if !exists {
+			failed = true
+		} else if strings.TrimSpace(ifMatch) != "*" {
+			failed = !etagListMatches(ifMatch, currentETag())
+		}
+	} else if ifUnmodifiedSince != "" && exists {
+		if since, err := http.ParseTime(ifUnmodifiedSince); err == nil {
+			failed = info.ModTime().Truncate(time.Second).After(since)
+		}
+	}
+
+	if !failed && ifNoneMatch != "" && exists {
+		if strings.TrimSpace(ifNoneMatch) == "*" {
+			failed = true
+		} else {
+			failed = etagListMatches(ifNoneMatch, currentETag())
+		}
+	}
+
+	if failed {
+		http.Error(w, "Precondition Failed", 412)
+		return false
+	}
+	return true
+}
+
+// pathLocks serialises changes to the same path, so a precondition checked just before
+// a file is replaced or removed still holds when it happens
+type pathLocks struct {
+	mutex sync.Mutex
+	held  map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+func makePathLocks() *pathLocks {
+	return &pathLocks{held: make(map[string]*pathLock)}
+}
+
+// lock blocks until no one else holds the lock for diskPath, and returns the function to release it
+func (locks *pathLocks) lock(diskPath string) func() {
+	locks.mutex.Lock()
+	l, found := locks.held[diskPath]
+	if !found {
+		l = &pathLock{}
+		locks.held[diskPath] = l
+	}
+	l.refs++
+	locks.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		locks.mutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(locks.held, diskPath)
+		}
+		locks.mutex.Unlock()
+	}
+}
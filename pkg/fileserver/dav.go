@@ -0,0 +1,455 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+	"golang.org/x/net/webdav"
+)
+
+// davMethods are the WebDAV methods handed to webdav.Handler. GET, PUT and DELETE stay with our own handlers
+var davMethods = []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"}
+
+// davInfiniteTimeout asks the lock system for a lock which never expires
+const davInfiniteTimeout = -1
+
+// davFileSystem exposes the data directory to webdav.Handler on behalf of one account,
+// enforcing its read and write permissions on every path touched
+type davFileSystem struct {
+	h    fileHandler
+	user auth.Account
+}
+
+// check returns an error if name is hidden from clients or the account lacks permission for it
+func (fs davFileSystem) check(name string, write bool) error {
+	if isStagingName(path.Base(name)) {
+		return os.ErrNotExist
+	}
+	if !fs.user.CanRead(name) || (write && !fs.user.CanWrite(name)) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (fs davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := fs.check(name, true); err != nil {
+		return err
+	}
+	// MKCOL must neither replace anything nor create missing parents
+	if _, err := fs.h.storage.Stat(name); err == nil {
+		return os.ErrExist
+	}
+	if info, err := fs.h.storage.Stat(path.Dir(name)); err != nil || !info.IsDir() {
+		return os.ErrNotExist
+	}
+	// a collection made by a client is never pruned, even if an upload once made a directory of the same name
+	fs.h.created.forget(name)
+	return fs.h.storage.MkdirAll(name)
+}
+
+func (fs davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if err := fs.check(name, write); err != nil {
+		return nil, err
+	}
+
+	// replacing a file goes through Storage.Create like a PUT, so readers never see it half written
+	if flag&os.O_CREATE != 0 && flag&os.O_TRUNC != 0 {
+		f, err := fs.h.storage.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{staged: f, fs: fs, name: name}, nil
+	}
+
+	// webdav.Handler also opens with O_RDWR to patch properties, but never writes to a file in place
+	f, err := fs.h.storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{file: f, fs: fs, name: name}, nil
+}
+
+func (fs davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	if name == "/" {
+		return os.ErrPermission
+	}
+	if err := fs.check(name, true); err != nil {
+		return err
+	}
+
+	if fs.h.trash != nil {
+		if _, err := fs.h.storage.Stat(name); os.IsNotExist(err) {
+			return nil
+		}
+		if err := fs.h.moveToTrash(name, fs.user); err != nil {
+			return err
+		}
+	} else {
+		if err := fs.h.saveTreeVersions(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := fs.h.storage.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	fs.h.davProps.forget(name)
+	fs.h.created.forget(name)
+	if fs.h.DigestCache != nil {
+		fs.h.DigestCache.Forget(name)
+	}
+	return nil
+}
+
+func (fs davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if oldName == "/" || newName == "/" {
+		return os.ErrPermission
+	}
+	if err := fs.check(oldName, true); err != nil {
+		return err
+	}
+	if err := fs.check(newName, true); err != nil {
+		return err
+	}
+
+	if err := fs.h.storage.Rename(oldName, newName); err != nil {
+		return err
+	}
+	fs.h.davProps.move(oldName, newName)
+	fs.h.created.forget(oldName)
+	fs.h.created.forget(newName)
+	if fs.h.DigestCache != nil {
+		fs.h.DigestCache.Forget(oldName)
+		fs.h.DigestCache.Forget(newName)
+	}
+	return nil
+}
+
+func (fs davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if err := fs.check(name, false); err != nil {
+		return nil, err
+	}
+	info, err := fs.h.storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{FileInfo: info, fs: fs, name: name}, nil
+}
+
+// davFile adds dead properties, permission filtered listings and staged writes to a file from Storage.
+// It is either open for reading with file, or being written with staged
+type davFile struct {
+	file   StorageFile
+	staged StagedFile
+	fs     davFileSystem
+	name   string
+	// entries are what is left to return from Readdir, nil until it is first called
+	entries []os.FileInfo
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.file == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.file.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.file == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.file.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.staged == nil {
+		return 0, os.ErrPermission
+	}
+	return f.staged.Write(p)
+}
+
+func (f *davFile) Close() error {
+	if f.staged == nil {
+		return f.file.Close()
+	}
+
+	unlock := f.fs.h.locks.lock(f.name)
+	defer unlock()
+	if err := f.fs.h.saveVersion(f.name); err != nil {
+		f.staged.Abort()
+		return err
+	}
+	if _, err := f.staged.Commit(); err != nil {
+		return err
+	}
+	if f.fs.h.DigestCache != nil {
+		f.fs.h.DigestCache.Forget(f.name)
+	}
+	return nil
+}
+
+// Readdir leaves out staged uploads and anything the account can't read
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.entries == nil {
+		infos, err := f.fs.h.storage.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = append([]os.FileInfo{}, infos...)
+	}
+
+	infos := f.entries
+	if count > 0 {
+		if len(infos) == 0 {
+			return nil, io.EOF
+		}
+		if len(infos) > count {
+			infos = infos[:count]
+		}
+	}
+	f.entries = f.entries[len(infos):]
+
+	visible := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		child := path.Join(f.name, info.Name())
+		if f.fs.check(child, false) == nil {
+			visible = append(visible, davFileInfo{FileInfo: info, fs: f.fs, name: child})
+		}
+	}
+	return visible, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	var info os.FileInfo
+	var err error
+	if f.file != nil {
+		info, err = f.file.Stat()
+	} else {
+		info, err = f.fs.h.storage.Stat(f.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{FileInfo: info, fs: f.fs, name: f.name}, nil
+}
+
+func (f *davFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return f.fs.h.davProps.get(f.name), nil
+}
+
+func (f *davFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if !f.fs.user.CanWrite(f.name) {
+		return nil, os.ErrPermission
+	}
+	return f.fs.h.davProps.patch(f.name, patches), nil
+}
+
+// davFileInfo reports the same strong ETag in PROPFIND as GET does
+type davFileInfo struct {
+	os.FileInfo
+	fs   davFileSystem
+	name string
+}
+
+func (info davFileInfo) ETag(ctx context.Context) (string, error) {
+	if info.IsDir() || info.fs.h.DigestCache == nil {
+		return "", webdav.ErrNotImplemented
+	}
+	return info.fs.h.etagFor(info.name)
+}
+
+// davDestination returns the path relative to the data directory a COPY or MOVE targets
+func davDestination(r *http.Request) (string, bool) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	return path.Clean("/" + u.Path), true
+}
+
+// davHandler serves the WebDAV class 1 and 2 methods. The source path has already been checked as readable
+func (h fileHandler) davHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	switch r.Method {
+	case "PROPPATCH", "MKCOL", "LOCK", "UNLOCK", "MOVE":
+		if !user.CanWrite(relativePath) {
+			requestAuth(w)
+			return
+		}
+	}
+
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		destination, ok := davDestination(r)
+		if !ok {
+			http.Error(w, "Invalid Destination", 400)
+			return
+		}
+		if !user.CanWrite(destination) {
+			requestAuth(w)
+			return
+		}
+		if isStagingName(path.Base(destination)) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+	}
+
+	// copies and moves are checked against the quotas with the source's size, as the destination and any
+	// source moved away are replaced by it, then counted for what actually changed once done
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		destination, _ := davDestination(r)
+		before := h.quotas.snapshot(destination)
+		source := h.quotas.snapshot(relativePath)
+		replaced := before
+		if r.Method == "MOVE" && before != nil {
+			replaced = make(map[string]int64, len(before)+len(source))
+			for name, size := range before {
+				replaced[name] = size
+			}
+			for name, size := range source {
+				replaced[name] = size
+			}
+		}
+		reserved, quotaerr := h.quotas.reserve(user, replaced, movedFiles(source, relativePath, destination))
+		if quotaerr != nil {
+			http.Error(w, "Insufficient Storage", 507)
+			return
+		}
+		defer h.quotas.release(reserved)
+		defer h.quotas.settle(destination, before)
+		if r.Method == "MOVE" {
+			defer h.quotas.settle(relativePath, source)
+		}
+	}
+
+	dav := &webdav.Handler{
+		FileSystem: davFileSystem{h: h, user: user},
+		LockSystem: h.davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				fmt.Print("The following error occured while handling " + r.Method + " for " + r.URL.Path + ": ")
+				fmt.Println(err)
+			}
+		},
+	}
+	dav.ServeHTTP(w, r)
+}
+
+// davIfList is one parenthesised list of an If header, with the resource it is tagged to if any
+type davIfList struct {
+	resource   string
+	conditions []webdav.Condition
+}
+
+// parseDavIf parses an RFC 4918 If header such as `(<urn:uuid:1>) (Not ["etag"])` or
+// `</a/b> (<urn:uuid:1>)` into its lists. Returns false if the header is malformed
+func parseDavIf(header string) ([]davIfList, bool) {
+	var lists []davIfList
+	resource := ""
+	s := strings.TrimSpace(header)
+
+	for s != "" {
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, false
+			}
+			resource = s[1:end]
+			s = s[end+1:]
+		case '(':
+			end := strings.IndexByte(s, ')')
+			if end < 0 {
+				return nil, false
+			}
+			list := davIfList{resource: resource}
+			inner := strings.TrimSpace(s[1:end])
+			for inner != "" {
+				not := false
+				if strings.HasPrefix(inner, "Not") {
+					not = true
+					inner = strings.TrimSpace(inner[3:])
+				}
+				var closer byte
+				switch {
+				case strings.HasPrefix(inner, "<"):
+					closer = '>'
+				case strings.HasPrefix(inner, "["):
+					closer = ']'
+				default:
+					return nil, false
+				}
+				stop := strings.IndexByte(inner, closer)
+				if stop < 0 {
+					return nil, false
+				}
+				if closer == '>' {
+					list.conditions = append(list.conditions, webdav.Condition{Not: not, Token: inner[1:stop]})
+				} else {
+					list.conditions = append(list.conditions, webdav.Condition{Not: not, ETag: inner[1:stop]})
+				}
+				inner = strings.TrimSpace(inner[stop+1:])
+			}
+			if len(list.conditions) == 0 {
+				return nil, false
+			}
+			lists = append(lists, list)
+			s = s[end+1:]
+		default:
+			return nil, false
+		}
+		s = strings.TrimSpace(s)
+	}
+	return lists, len(lists) > 0
+}
+
+// confirmDavLocks makes sure a PUT or DELETE of relativePath does not break a WebDAV lock held by
+// someone else, the same way webdav.Handler checks its own methods. It returns a function to release
+// the confirmation once the change is made, or responds with 412 or 423 and returns false
+func (h fileHandler) confirmDavLocks(w http.ResponseWriter, r *http.Request, relativePath string) (func(), bool) {
+	now := time.Now()
+	header := r.Header.Get("If")
+
+	if header == "" {
+		// a temporary lock conflicts with any lock held by another client
+		token, err := h.davLocks.Create(now, webdav.LockDetails{Root: relativePath, Duration: davInfiniteTimeout, ZeroDepth: true})
+		if err == webdav.ErrLocked {
+			http.Error(w, "Locked", webdav.StatusLocked)
+			return nil, false
+		} else if err != nil {
+			http.Error(w, "Lock Error", 500)
+			return nil, false
+		}
+		return func() { h.davLocks.Unlock(now, token) }, true
+	}
+
+	lists, ok := parseDavIf(header)
+	if !ok {
+		http.Error(w, "Invalid If Header", 400)
+		return nil, false
+	}
+	// the lists are alternatives, any one confirming is enough
+	for _, list := range lists {
+		resource := relativePath
+		if list.resource != "" {
+			u, err := url.Parse(list.resource)
+			if err != nil || (u.Host != "" && u.Host != r.Host) {
+				continue
+			}
+			resource = path.Clean("/" + u.Path)
+		}
+		if release, err := h.davLocks.Confirm(now, resource, "", list.conditions...); err == nil {
+			return release, true
+		}
+	}
+	http.Error(w, "Precondition Failed", 412)
+	return nil, false
+}
@@ -0,0 +1,136 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+// davProps holds WebDAV dead properties, set with PROPPATCH, keyed by the path relative to the data directory.
+// It is optionally written to a file so properties survive restarts
+type davProps struct {
+	filename string
+	lock     sync.RWMutex
+	props    map[string][]webdav.Property
+}
+
+func makeDavProps(filename string) (*davProps, error) {
+	store := &davProps{filename: filename, props: make(map[string][]webdav.Property)}
+	if filename == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.props); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *davProps) get(name string) map[xml.Name]webdav.Property {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	props := make(map[xml.Name]webdav.Property, len(store.props[name]))
+	for _, p := range store.props[name] {
+		props[p.XMLName] = p
+	}
+	return props
+}
+
+// patch applies the patches in order. Dead properties can't fail validation so every patch succeeds
+func (store *davProps) patch(name string, patches []webdav.Proppatch) []webdav.Propstat {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	props := make(map[xml.Name]webdav.Property, len(store.props[name]))
+	for _, p := range store.props[name] {
+		props[p.XMLName] = p
+	}
+
+	status := webdav.Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			status.Props = append(status.Props, webdav.Property{XMLName: p.XMLName})
+			if patch.Remove {
+				delete(props, p.XMLName)
+			} else {
+				props[p.XMLName] = p
+			}
+		}
+	}
+
+	list := make([]webdav.Property, 0, len(props))
+	for _, p := range props {
+		list = append(list, p)
+	}
+	if len(list) == 0 {
+		delete(store.props, name)
+	} else {
+		store.props[name] = list
+	}
+	store.save()
+	return []webdav.Propstat{status}
+}
+
+// move renames the properties of name and everything under it to newName
+func (store *davProps) move(name string, newName string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	moved := make(map[string][]webdav.Property)
+	for k, v := range store.props {
+		if k == name || strings.HasPrefix(k, prefix) {
+			delete(store.props, k)
+			moved[newName+strings.TrimPrefix(k, name)] = v
+		}
+	}
+	for k, v := range moved {
+		store.props[k] = v
+	}
+	store.save()
+}
+
+// forget drops the properties of name and everything under it
+func (store *davProps) forget(name string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for k := range store.props {
+		if k == name || strings.HasPrefix(k, prefix) {
+			delete(store.props, k)
+		}
+	}
+	store.save()
+}
+
+// save writes the properties to disk if they are backed by a file. Must be called with the lock held
+func (store *davProps) save() {
+	if store.filename == "" {
+		return
+	}
+
+	data, jsonerr := json.Marshal(store.props)
+	if jsonerr != nil {
+		fmt.Println("Error encoding WebDAV properties: ", jsonerr)
+		return
+	}
+
+	if err := writeFileAtomic(store.filename, data); err != nil {
+		fmt.Println("Error saving WebDAV properties: ", err)
+	}
+}
@@ -0,0 +1,454 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// maxDedupRefSize bounds how much of a file is read looking for a reference
+const maxDedupRefSize = 4096
+
+var errNotDedupRef = errors.New("Not a deduplicated file reference")
+
+// dedupRef is what a file in the tree of a DedupStorage holds instead of its contents
+type dedupRef struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// blobName is where the contents with the hex sha-256 sum are kept in the blob store
+func blobName(sum string) string {
+	return "/" + sum[:2] + "/" + sum
+}
+
+// isBlobName returns true for the names blobName gives, so nothing else in the blob store is ever collected
+func isBlobName(name string) bool {
+	sum := path.Base(name)
+	if len(sum) != 64 || name != blobName(sum) {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+// dedupFileInfo describes a file by the size of its contents rather than of its reference
+type dedupFileInfo struct {
+	os.FileInfo
+	ref dedupRef
+}
+
+func (info dedupFileInfo) Size() int64 {
+	return info.ref.Size
+}
+
+// DedupStorage implements Storage keeping each distinct content once. Directories and files are kept in tree,
+// but each file only holds a reference to its contents, which are kept in blobs named by their sha-256.
+// Blobs are reference counted and removed once nothing refers to them. tree must only be used through the DedupStorage.
+// Files already in tree which are not references, such as those from before dedup was turned on, are served as
+// they are until they are replaced
+type DedupStorage struct {
+	tree  Storage
+	blobs Storage
+	lock  sync.Mutex
+	refs  map[string]int
+}
+
+// MakeDedupStorage creates a DedupStorage, counting the references already in tree
+func MakeDedupStorage(tree Storage, blobs Storage) (*DedupStorage, error) {
+	storage := &DedupStorage{tree: tree, blobs: blobs, refs: make(map[string]int)}
+	plain, err := storage.walkRefs(func(name string, ref dedupRef) {
+		storage.refs[ref.SHA256]++
+	})
+	if err != nil {
+		return nil, err
+	}
+	if plain > 0 {
+		fmt.Printf("Found %d files which are not deduplicated file references, which are served as they are\n", plain)
+	}
+	return storage, nil
+}
+
+// walkRefs calls fn for every file in the tree with its reference, and returns how many files are not references
+func (storage *DedupStorage) walkRefs(fn func(name string, ref dedupRef)) (int, error) {
+	plain := 0
+	err := walkStorage(storage.tree, "/", func(name string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() || isStagingName(info.Name()) {
+			return nil
+		}
+		ref, err := storage.readRef(name)
+		if err == errNotDedupRef {
+			plain++
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(name, ref)
+		return nil
+	})
+	return plain, err
+}
+
+// CollectGarbage removes blobs nothing refers to, such as those left by a crash between storing a blob
+// and writing its reference. It returns how many blobs were removed. Nothing is removed while any file in the
+// tree is not a reference, as a tree from the wrong directory or read without its encryption key would
+// otherwise have every blob removed
+func (storage *DedupStorage) CollectGarbage() (int, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	refs := make(map[string]int)
+	plain, err := storage.walkRefs(func(name string, ref dedupRef) {
+		refs[ref.SHA256]++
+	})
+	if err != nil {
+		return 0, err
+	}
+	if plain > 0 {
+		return 0, fmt.Errorf("%d files are not deduplicated file references, check the data directory and encryption keys are right", plain)
+	}
+
+	removed := 0
+	err = walkStorage(storage.blobs, "/", func(name string, info os.FileInfo) error {
+		if info.IsDir() || !isBlobName(name) || refs[path.Base(name)] > 0 || storage.refs[path.Base(name)] > 0 {
+			return nil
+		}
+		if err := storage.blobs.Remove(name); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// DedupReport describes how much space deduplication saves
+type DedupReport struct {
+	// Files and LogicalBytes count every file as if it were stored on its own
+	Files        int
+	LogicalBytes int64
+	// Plain files are not references, and are stored as they are
+	Plain int
+	// Blobs and StoredBytes count the distinct contents actually stored
+	Blobs       int
+	StoredBytes int64
+	// Unreferenced blobs are waiting to be collected
+	Unreferenced      int
+	UnreferencedBytes int64
+}
+
+// Saved returns the bytes deduplication saves
+func (report DedupReport) Saved() int64 {
+	return report.LogicalBytes - report.StoredBytes
+}
+
+// Report counts the files and blobs. It only reads, so it is safe to run alongside a server using the same storage
+func (storage *DedupStorage) Report() (DedupReport, error) {
+	var report DedupReport
+	seen := make(map[string]bool)
+	var err error
+	report.Plain, err = storage.walkRefs(func(name string, ref dedupRef) {
+		report.Files++
+		report.LogicalBytes += ref.Size
+		if !seen[ref.SHA256] {
+			seen[ref.SHA256] = true
+			report.Blobs++
+			report.StoredBytes += ref.Size
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = walkStorage(storage.blobs, "/", func(name string, info os.FileInfo) error {
+		if !info.IsDir() && isBlobName(name) && !seen[path.Base(name)] {
+			report.Unreferenced++
+			report.UnreferencedBytes += info.Size()
+		}
+		return nil
+	})
+	return report, err
+}
+
+// readRef reads the reference held by the file name in the tree
+func (storage *DedupStorage) readRef(name string) (dedupRef, error) {
+	var ref dedupRef
+	f, err := storage.tree.Open(name)
+	if err != nil {
+		return ref, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxDedupRefSize))
+	if err != nil {
+		return ref, err
+	}
+	if json.Unmarshal(data, &ref) != nil || len(ref.SHA256) != 64 || !isBlobName(blobName(ref.SHA256)) {
+		return ref, errNotDedupRef
+	}
+	return ref, nil
+}
+
+// release drops a reference to a blob, removing it once nothing else refers to it. Must be called with the lock held
+func (storage *DedupStorage) release(sum string) {
+	storage.refs[sum]--
+	if storage.refs[sum] > 0 {
+		return
+	}
+	delete(storage.refs, sum)
+	if err := storage.blobs.Remove(blobName(sum)); err != nil && !os.IsNotExist(err) {
+		fmt.Print("The following error occured while removing the blob " + sum + ": ")
+		fmt.Println(err)
+	}
+}
+
+// treeRefs returns the references of every file at or under name. Must be called with the lock held
+func (storage *DedupStorage) treeRefs(name string) ([]dedupRef, error) {
+	var refs []dedupRef
+	err := walkStorage(storage.tree, name, func(p string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			if ref, err := storage.readRef(p); err == nil {
+				refs = append(refs, ref)
+			}
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return refs, err
+}
+
+// Open opens the blob a file refers to
+func (storage *DedupStorage) Open(name string) (StorageFile, error) {
+	info, err := storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	dedupInfo, ok := info.(dedupFileInfo)
+	if !ok {
+		return storage.tree.Open(name)
+	}
+	blob, err := storage.blobs.Open(blobName(dedupInfo.ref.SHA256))
+	if err != nil {
+		return nil, err
+	}
+	return dedupFile{StorageFile: blob, info: dedupInfo}, nil
+}
+
+// Stat describes a file with the size of its contents
+func (storage *DedupStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := storage.tree.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return info, err
+	}
+	ref, err := storage.readRef(name)
+	if err == errNotDedupRef {
+		return info, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return dedupFileInfo{FileInfo: info, ref: ref}, nil
+}
+
+// ReadDir lists the directory, reading each file's reference for its size
+func (storage *DedupStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := storage.tree.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if !info.Mode().IsRegular() || isStagingName(info.Name()) {
+			continue
+		}
+		if ref, err := storage.readRef(path.Join(name, info.Name())); err == nil {
+			infos[i] = dedupFileInfo{FileInfo: info, ref: ref}
+		}
+	}
+	return infos, nil
+}
+
+// Create stages the contents in the blob store, hashing them as they are written
+func (storage *DedupStorage) Create(name string) (StagedFile, error) {
+	if info, err := storage.tree.Stat(path.Dir(name)); err != nil || !info.IsDir() {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrNotExist}
+	}
+	incoming, err := stagingName("/")
+	if err != nil {
+		return nil, err
+	}
+	blob, err := storage.blobs.Create(incoming)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupUpload{storage: storage, name: name, incoming: incoming, blob: blob, digest: sha256.New()}, nil
+}
+
+// MkdirAll creates the directory in the tree
+func (storage *DedupStorage) MkdirAll(name string) error {
+	return storage.tree.MkdirAll(name)
+}
+
+// Rename moves a file or directory in the tree, releasing the blob of a file it replaces
+func (storage *DedupStorage) Rename(oldName string, newName string) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	replaced, replacederr := storage.readRef(newName)
+	if err := storage.tree.Rename(oldName, newName); err != nil {
+		return err
+	}
+	if replacederr == nil && path.Clean(oldName) != path.Clean(newName) {
+		storage.release(replaced.SHA256)
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory from the tree, releasing the blob of a file
+func (storage *DedupStorage) Remove(name string) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	ref, referr := storage.readRef(name)
+	if err := storage.tree.Remove(name); err != nil {
+		return err
+	}
+	if referr == nil {
+		storage.release(ref.SHA256)
+	}
+	return nil
+}
+
+// RemoveAll removes a file or directory from the tree, releasing the blobs of every file in it
+func (storage *DedupStorage) RemoveAll(name string) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	refs, err := storage.treeRefs(name)
+	if err != nil {
+		return err
+	}
+	if err := storage.tree.RemoveAll(name); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		storage.release(ref.SHA256)
+	}
+	return nil
+}
+
+// storedDigests returns the sha-256 the file is stored under, so it never has to be computed again
+func (storage *DedupStorage) storedDigests(info os.FileInfo) map[string][]byte {
+	dedupInfo, ok := info.(dedupFileInfo)
+	if !ok {
+		return nil
+	}
+	sum, err := hex.DecodeString(dedupInfo.ref.SHA256)
+	if err != nil {
+		return nil
+	}
+	return map[string][]byte{"sha-256": sum}
+}
+
+// dedupFile reads a blob, but describes the file referring to it
+type dedupFile struct {
+	StorageFile
+	info dedupFileInfo
+}
+
+func (f dedupFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// dedupUpload is a file being written to a DedupStorage
+type dedupUpload struct {
+	storage  *DedupStorage
+	name     string
+	incoming string
+	blob     StagedFile
+	digest   hash.Hash
+	size     int64
+}
+
+func (f *dedupUpload) Write(p []byte) (int, error) {
+	n, err := f.blob.Write(p)
+	f.digest.Write(p[:n])
+	f.size += int64(n)
+	return n, err
+}
+
+// Commit keeps the staged contents as a new blob unless one with the same sha-256 is already stored,
+// then points the file at it and releases the blob it referred to before
+func (f *dedupUpload) Commit() (os.FileInfo, error) {
+	storage := f.storage
+	if info, err := storage.tree.Stat(f.name); err == nil && info.IsDir() {
+		f.blob.Abort()
+		return nil, &os.PathError{Op: "commit", Path: f.name, Err: errors.New("is a directory")}
+	}
+	if _, err := f.blob.Commit(); err != nil {
+		return nil, err
+	}
+	ref := dedupRef{SHA256: hex.EncodeToString(f.digest.Sum(nil)), Size: f.size}
+	blob := blobName(ref.SHA256)
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if _, err := storage.blobs.Stat(blob); err == nil {
+		// a duplicate costs nothing more than its reference
+		storage.blobs.Remove(f.incoming)
+	} else {
+		err := storage.blobs.MkdirAll(path.Dir(blob))
+		if err == nil {
+			err = storage.blobs.Rename(f.incoming, blob)
+		}
+		if err != nil {
+			storage.blobs.Remove(f.incoming)
+			return nil, err
+		}
+	}
+
+	replaced, replacederr := storage.readRef(f.name)
+	info, err := storage.writeRef(f.name, ref)
+	if err != nil {
+		if storage.refs[ref.SHA256] == 0 {
+			storage.blobs.Remove(blob)
+		}
+		return nil, err
+	}
+	storage.refs[ref.SHA256]++
+	if replacederr == nil {
+		storage.release(replaced.SHA256)
+	}
+	return info, nil
+}
+
+func (f *dedupUpload) Abort() {
+	f.blob.Abort()
+}
+
+// writeRef points the file name at a blob. Must be called with the lock held
+func (storage *DedupStorage) writeRef(name string, ref dedupRef) (os.FileInfo, error) {
+	data, _ := json.Marshal(ref)
+	f, err := storage.tree.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Abort()
+		return nil, err
+	}
+	info, err := f.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return dedupFileInfo{FileInfo: info, ref: ref}, nil
+}
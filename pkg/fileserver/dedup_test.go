@@ -0,0 +1,114 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func countBlobs(blobs Storage) int {
+	count := 0
+	walkStorage(blobs, "/", func(name string, info os.FileInfo) error {
+		if isBlobName(name) {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func TestDedupStorage(t *testing.T) {
+	tree, blobs := MakeMemStorage(), MakeMemStorage()
+	storage, err := MakeDedupStorage(tree, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := makeTestHandler(t, Options{Storage: storage})
+
+	binary := "the same binary everywhere"
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		body        string
+		blobs       int
+	}{
+		{"first copy", http.MethodPut, "/a/tool.bin", binary, 1},
+		{"duplicate", http.MethodPut, "/b/tool.bin", binary, 1},
+		{"third copy", http.MethodPut, "/c/tool.bin", binary, 1},
+		{"overwrite with new content", http.MethodPut, "/a/tool.bin", "a newer build", 2},
+		{"overwrite the last copy of new content", http.MethodPut, "/a/tool.bin", binary, 1},
+		{"delete a copy", http.MethodDelete, "/b/tool.bin", "", 1},
+		{"delete a directory", http.MethodDelete, "/c?recursive", "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			if rec := doRequest(handler, tt.method, tt.target, "writer", tt.body, nil); rec.Code >= 300 {
+				t.Fatalf("Got %d", rec.Code)
+			}
+			if got := countBlobs(blobs); got != tt.blobs {
+				t.Errorf("Got %d blobs, want %d", got, tt.blobs)
+			}
+		})
+	}
+
+	rec := doRequest(handler, http.MethodGet, "/a/tool.bin", "reader", "", map[string]string{"Want-Repr-Digest": "sha-256=1"})
+	sum := sha256.Sum256([]byte(binary))
+	if rec.Body.String() != binary || rec.Header().Get("Repr-Digest") != "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":" {
+		t.Errorf("GET got %q with Repr-Digest %q", rec.Body.String(), rec.Header().Get("Repr-Digest"))
+	}
+	info, _ := storage.Stat("/a/tool.bin")
+	if info.Size() != int64(len(binary)) || storage.storedDigests(info)["sha-256"] == nil {
+		t.Errorf("Stat got size %d and stored digests %v", info.Size(), storage.storedDigests(info))
+	}
+
+	doRequest(handler, http.MethodPut, "/d/copy.bin", "writer", binary, nil)
+	report, err := storage.Report()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DedupReport{Files: 2, LogicalBytes: 2 * int64(len(binary)), Blobs: 1, StoredBytes: int64(len(binary))}
+	if report != want || report.Saved() != int64(len(binary)) {
+		t.Errorf("Got report %+v, want %+v", report, want)
+	}
+
+	// a blob left behind without a reference is collected, and counts survive a restart
+	blobs.MkdirAll("/00")
+	writeStorageFile(t, blobs, blobName("00000000000000000000000000000000000000000000000000000000000000ff"), "orphan")
+	restarted, err := MakeDedupStorage(tree, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := restarted.CollectGarbage(); err != nil || removed != 1 {
+		t.Errorf("CollectGarbage removed %d, %v", removed, err)
+	}
+	if err := restarted.RemoveAll("/a"); err != nil || countBlobs(blobs) != 1 {
+		t.Errorf("Removing one of two references left %d blobs, %v", countBlobs(blobs), err)
+	}
+	if err := restarted.Remove("/d/copy.bin"); err != nil || countBlobs(blobs) != 0 {
+		t.Errorf("Removing the last reference left %d blobs, %v", countBlobs(blobs), err)
+	}
+
+	// files from before dedup was turned on are served as they are, and stop garbage being collected
+	writeStorageFile(t, tree, "/old.txt", "written before dedup")
+	writeStorageFile(t, blobs, blobName("00000000000000000000000000000000000000000000000000000000000000ff"), "orphan")
+	upgraded, err := MakeDedupStorage(tree, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readStorageFile(upgraded, "/old.txt"); got != "written before dedup" {
+		t.Errorf("Plain file read as %q", got)
+	}
+	if removed, err := upgraded.CollectGarbage(); err == nil || removed != 0 || countBlobs(blobs) != 1 {
+		t.Errorf("CollectGarbage with a plain file removed %d, %v", removed, err)
+	}
+	if report, _ := upgraded.Report(); report.Plain != 1 {
+		t.Errorf("Report counted %d plain files", report.Plain)
+	}
+	writeStorageFile(t, upgraded, "/old.txt", "replaced after dedup")
+	if removed, err := upgraded.CollectGarbage(); err != nil || removed != 1 {
+		t.Errorf("CollectGarbage removed %d, %v once every file was a reference", removed, err)
+	}
+}
@@ -0,0 +1,192 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// wantsRecursiveDelete returns true if the client explicitly opted in to removing a whole
+// directory tree, either with ?recursive=true, an X-Recursive: true header or WebDAV's Depth: infinity
+func wantsRecursiveDelete(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Depth"), "infinity") {
+		return true
+	}
+	if values, ok := r.URL.Query()["recursive"]; ok {
+		if len(values) == 0 || values[0] == "" {
+			return true
+		}
+		recursive, _ := strconv.ParseBool(values[0])
+		return recursive
+	}
+	recursive, _ := strconv.ParseBool(r.Header.Get("X-Recursive"))
+	return recursive
+}
+
+// isDirEmpty returns true if the directory name has no entries
+func (h fileHandler) isDirEmpty(name string) (bool, error) {
+	infos, err := h.storage.ReadDir(name)
+	if err != nil {
+		return false, err
+	}
+	return len(infos) == 0, nil
+}
+
+// createdDirs remembers the directories which were made to hold an upload, the only ones pruned once they are
+// empty again. It is only kept in memory, so directories made before a restart are left alone
+type createdDirs struct {
+	lock sync.Mutex
+	dirs map[string]bool
+}
+
+func makeCreatedDirs() *createdDirs {
+	return &createdDirs{dirs: make(map[string]bool)}
+}
+
+func (c *createdDirs) has(dir string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.dirs[dir]
+}
+
+// forget drops name and everything under it, once it has been removed, moved or made on purpose
+func (c *createdDirs) forget(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for dir := range c.dirs {
+		if dir == name || strings.HasPrefix(dir, prefix) {
+			delete(c.dirs, dir)
+		}
+	}
+}
+
+// makeParents makes any missing directories above name, remembering them for pruning if it is enabled
+func (h fileHandler) makeParents(name string) error {
+	var missing []string
+	if h.PruneEmptyDirs {
+		for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+			if _, err := h.storage.Stat(dir); err == nil {
+				break
+			}
+			missing = append(missing, dir)
+		}
+	}
+	if err := h.storage.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	h.created.lock.Lock()
+	for _, dir := range missing {
+		h.created.dirs[dir] = true
+	}
+	h.created.lock.Unlock()
+	return nil
+}
+
+// pruneEmptyParents walks up from relativePath removing directories which are now empty. It stops at the first
+// directory that is not empty, is not writeable by the user, or was not made to hold an upload, which is always
+// true of the data directory
+func (h fileHandler) pruneEmptyParents(relativePath string, user auth.Account) {
+	for dir := path.Dir(relativePath); h.created.has(dir) && user.CanWrite(dir); dir = path.Dir(dir) {
+		// Remove refuses to remove a directory that still has entries
+		if err := h.storage.Remove(dir); err != nil {
+			return
+		}
+		h.created.forget(dir)
+	}
+}
+
+func (h fileHandler) deleteHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	if relativePath == "/" {
+		http.Error(w, "Cannot Delete Data Directory", 403)
+		return
+	}
+
+	unlock := h.locks.lock(relativePath)
+	defer unlock()
+
+	if !h.checkPreconditions(w, r, relativePath) {
+		return
+	}
+
+	info, staterr := h.storage.Stat(relativePath)
+	if os.IsNotExist(staterr) {
+		http.Error(w, "Not Found", 404)
+		return
+	} else if staterr != nil {
+		fmt.Print("The following error occured while trying to stat " + relativePath + ": ")
+		fmt.Println(staterr)
+		http.Error(w, "Stat Error", 500)
+		return
+	}
+
+	recursive := false
+	if info.IsDir() {
+		empty, emptyerr := h.isDirEmpty(relativePath)
+		if emptyerr != nil {
+			fmt.Print("The following error occured while trying to read the directory " + relativePath + ": ")
+			fmt.Println(emptyerr)
+			http.Error(w, "Read Error", 500)
+			return
+		}
+		if !empty && !wantsRecursiveDelete(r) {
+			http.Error(w, "Directory Not Empty", 409)
+			return
+		}
+		recursive = !empty
+	}
+
+	before := h.quotas.snapshot(relativePath)
+	defer h.quotas.settle(relativePath, before)
+
+	var removeerr error
+	if h.trash != nil {
+		// the trash keeps the whole tree, so there is no need for versions as well
+		removeerr = h.moveToTrash(relativePath, user)
+	} else {
+		if info.IsDir() {
+			removeerr = h.saveTreeVersions(relativePath)
+		} else {
+			removeerr = h.saveVersion(relativePath)
+		}
+		if removeerr != nil {
+			fmt.Print("The following error occured while keeping versions of " + relativePath + ": ")
+			fmt.Println(removeerr)
+			http.Error(w, "Version Error", 500)
+			return
+		}
+
+		if recursive {
+			removeerr = h.storage.RemoveAll(relativePath)
+		} else {
+			removeerr = h.storage.Remove(relativePath)
+		}
+	}
+
+	if removeerr != nil {
+		fmt.Print("The following error occured while trying to delete " + relativePath + ": ")
+		fmt.Println(removeerr)
+		http.Error(w, "Delete Error", 500)
+		return
+	}
+
+	fmt.Printf("Deleted %s for %s\n", relativePath, user.GetName())
+
+	if h.DigestCache != nil {
+		h.DigestCache.Forget(relativePath)
+	}
+	h.created.forget(relativePath)
+
+	if h.PruneEmptyDirs {
+		h.pruneEmptyParents(relativePath, user)
+	}
+
+	w.WriteHeader(204)
+}
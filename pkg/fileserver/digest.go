@@ -0,0 +1,118 @@
+package fileserver
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// digestAdvertisement lists every algorithm in hashAlgorithms as an RFC 9530 preference
+// dictionary, favouring the algorithms the RFC does not deprecate
+const digestAdvertisement = "sha-512=10, sha-256=10, sha-1=1, sha=1, md5=1"
+
+// parseWantDigest parses an RFC 9530 Want-Repr-Digest or Want-Content-Digest dictionary such as
+// "sha-256=10, sha-512=3" and returns the supported algorithms with a non zero weight, most preferred first.
+// Members which are malformed or unsupported are skipped
+func parseWantDigest(header string) []string {
+	type weighted struct {
+		algorithm string
+		weight    int
+	}
+	var wanted []weighted
+
+	for _, item := range strings.Split(header, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		// parameters on a member are allowed by structured fields but carry no meaning here
+		item = strings.SplitN(item, ";", 2)[0]
+		kv := strings.SplitN(item, "=", 2)
+
+		algorithm := strings.ToLower(strings.TrimSpace(kv[0]))
+		// a bare key is the boolean true, which has no defined weight so treat it as the lowest preference
+		weight := 1
+		if len(kv) == 2 {
+			n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+			if err != nil || n < 0 || n > 10 {
+				continue
+			}
+			weight = n
+		}
+
+		if _, ok := hashAlgorithms[algorithm]; ok && weight > 0 {
+			wanted = append(wanted, weighted{algorithm, weight})
+		}
+	}
+
+	sort.SliceStable(wanted, func(i, j int) bool { return wanted[i].weight > wanted[j].weight })
+
+	algorithms := make([]string, 0, len(wanted))
+	seen := make(map[string]bool)
+	for _, e := range wanted {
+		if !seen[e.algorithm] {
+			seen[e.algorithm] = true
+			algorithms = append(algorithms, e.algorithm)
+		}
+	}
+	return algorithms
+}
+
+// formatDigests formats digests as an RFC 9530 dictionary of byte sequences: sha-256=:base64:
+func formatDigests(algorithms []string, sums map[string][]byte) string {
+	items := make([]string, len(algorithms))
+	for i, a := range algorithms {
+		items[i] = a + "=:" + base64.StdEncoding.EncodeToString(sums[canonicalAlgorithm(a)]) + ":"
+	}
+	return strings.Join(items, ", ")
+}
+
+// insertHash adds the digest headers the client asked for to the response.
+// Repr-Digest describes the whole file. Content-Digest describes the response body, so it is only sent
+// on GET and HEAD when the body is the whole file, and never on a PUT where the body is just a status message
+func (h fileHandler) insertHash(w http.ResponseWriter, r *http.Request, name string) {
+	if h.LegacyDigest {
+		h.insertLegacyHash(w, r, name)
+	}
+
+	repr := parseWantDigest(r.Header.Get("Want-Repr-Digest"))
+	var content []string
+	if r.Method != http.MethodPut && r.Header.Get("Range") == "" {
+		content = parseWantDigest(r.Header.Get("Want-Content-Digest"))
+	}
+	if len(repr) == 0 && len(content) == 0 {
+		return
+	}
+
+	// hash the file once for the union of both lists
+	algorithms := append([]string{}, repr...)
+	for _, a := range content {
+		if !contains(algorithms, a) {
+			algorithms = append(algorithms, a)
+		}
+	}
+
+	sums, err := h.fileDigests(name, algorithms)
+	if err != nil {
+		return
+	}
+
+	if len(repr) > 0 {
+		w.Header().Set("Repr-Digest", formatDigests(repr, sums))
+	}
+	if len(content) > 0 {
+		w.Header().Set("Content-Digest", formatDigests(content, sums))
+	}
+}
+
+func contains(slice []string, val string) bool {
+	for _, item := range slice {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
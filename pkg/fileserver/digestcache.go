@@ -0,0 +1,184 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestIndexSaveDelay is how long changes to a DigestIndex are collected before the file is rewritten
+const digestIndexSaveDelay = 10 * time.Second
+
+// DigestCache remembers the digests of files so HEAD and GET do not have to reread them.
+// Implementations must only return digests stored for the same version of the file as info describes
+type DigestCache interface {
+	// Get returns the known digests of the file keyed by canonical algorithm name, or nil if there are none
+	Get(name string, info os.FileInfo) map[string][]byte
+	// Set records digests for this version of the file, merging with any already known
+	Set(name string, info os.FileInfo, digests map[string][]byte)
+	// Forget drops the file, and everything under it if it was a directory
+	Forget(name string)
+}
+
+// versionedInfo is implemented by the file infos of storages which name every version of a file, such as
+// S3 with the object's ETag, where the inode is always 0 and modification times only have second resolution
+type versionedInfo interface {
+	version() string
+}
+
+// storageVersion returns the storage's name for the version of the file info describes, or "" if it has none
+func storageVersion(info os.FileInfo) string {
+	if v, ok := info.(versionedInfo); ok {
+		return v.version()
+	}
+	return ""
+}
+
+type digestIndexEntry struct {
+	Size    int64
+	ModTime int64
+	Inode   uint64
+	Version string `json:",omitempty"`
+	Digests map[string][]byte
+}
+
+func (e digestIndexEntry) describes(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() && e.Inode == inode(info) &&
+		e.Version == storageVersion(info)
+}
+
+// DigestIndex implements DigestCache with an in memory index keyed by path, which is optionally
+// written to a sidecar file so it survives restarts. Changes are saved together a few seconds after the
+// first one, and by Save on shutdown. Entries are checked against the size, modification time and inode
+// of the file, and the version where the storage has one such as an S3 ETag, so files changed behind the server's back, or while changes were unsaved, are simply rehashed
+type DigestIndex struct {
+	filename string
+	lock     sync.RWMutex
+	entries  map[string]digestIndexEntry
+	// dirty is true while there are changes waiting to be saved
+	dirty    bool
+	saveLock sync.Mutex
+}
+
+// MakeEmptyDigestIndex creates a digest index which is only kept in memory
+func MakeEmptyDigestIndex() *DigestIndex {
+	return &DigestIndex{entries: make(map[string]digestIndexEntry)}
+}
+
+// MakeDigestIndex creates a digest index backed by filename, loading it if it already exists.
+// Make sure this isn't in the data directory
+func MakeDigestIndex(filename string) (*DigestIndex, error) {
+	index := MakeEmptyDigestIndex()
+	index.filename = filename
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &index.entries); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Get returns the digests known for this version of the file
+func (index *DigestIndex) Get(name string, info os.FileInfo) map[string][]byte {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	entry, found := index.entries[name]
+	if !found || !entry.describes(info) {
+		return nil
+	}
+	return entry.Digests
+}
+
+// Set records digests for this version of the file
+func (index *DigestIndex) Set(name string, info os.FileInfo, digests map[string][]byte) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	entry, found := index.entries[name]
+	if !found || !entry.describes(info) {
+		entry = digestIndexEntry{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			Inode:   inode(info),
+			Version: storageVersion(info),
+			Digests: make(map[string][]byte, len(digests)),
+		}
+	} else {
+		// copy rather than mutate a map a reader may still hold
+		merged := make(map[string][]byte, len(entry.Digests)+len(digests))
+		for a, sum := range entry.Digests {
+			merged[a] = sum
+		}
+		entry.Digests = merged
+	}
+	for a, sum := range digests {
+		entry.Digests[a] = sum
+	}
+
+	index.entries[name] = entry
+	index.changed()
+}
+
+// Forget removes the path and everything under it from the index
+func (index *DigestIndex) Forget(name string) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for k := range index.entries {
+		if k == name || strings.HasPrefix(k, prefix) {
+			delete(index.entries, k)
+		}
+	}
+	index.changed()
+}
+
+// changed schedules a save if the index is backed by a file and none is waiting. Must be called with the lock held
+func (index *DigestIndex) changed() {
+	if index.filename == "" || index.dirty {
+		return
+	}
+	index.dirty = true
+	time.AfterFunc(digestIndexSaveDelay, index.Save)
+}
+
+// Save writes any unsaved changes to the index to disk. Call it before exiting to keep the latest digests
+func (index *DigestIndex) Save() {
+	index.saveLock.Lock()
+	defer index.saveLock.Unlock()
+
+	index.lock.Lock()
+	if !index.dirty {
+		index.lock.Unlock()
+		return
+	}
+	// entries are replaced rather than changed, so encoding only needs the lock long enough to copy the map
+	entries := make(map[string]digestIndexEntry, len(index.entries))
+	for k, v := range index.entries {
+		entries[k] = v
+	}
+	index.dirty = false
+	index.lock.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		err = writeFileAtomic(index.filename, data)
+	}
+	if err != nil {
+		fmt.Println("Error saving digest index: ", err)
+		index.lock.Lock()
+		index.changed()
+		index.lock.Unlock()
+	}
+}
@@ -0,0 +1,275 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// maxDropNames is how many numbered names are tried for an upload before giving up
+const maxDropNames = 1000
+
+var errDropFull = errors.New("Drop Link File Limit Reached")
+
+// dropResponse lists the names uploads through a drop link were stored as
+type dropResponse struct {
+	Files []string `json:"files"`
+}
+
+// dropCreate makes a drop link to the directory relativePath, taking the optional form values expires,
+// bytes (the most the link can take in total) and files (the most files it can take)
+func (h fileHandler) dropCreate(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	if !user.CanWrite(relativePath) {
+		requestAuth(w)
+		return
+	}
+	if info, err := h.storage.Stat(relativePath); err != nil {
+		http.Error(w, "Not Found", 404)
+		return
+	} else if !info.IsDir() {
+		http.Error(w, "Not A Directory", 409)
+		return
+	}
+
+	link, ok := newShareLink(w, r, relativePath, user)
+	if !ok {
+		return
+	}
+	link.Drop, link.Subtree = true, true
+	var err error
+	if value := r.Form.Get("bytes"); value != "" {
+		if link.MaxBytes, err = strconv.ParseInt(value, 10, 64); err != nil || link.MaxBytes < 0 {
+			http.Error(w, "Invalid Byte Limit", 400)
+			return
+		}
+	}
+	if value := r.Form.Get("files"); value != "" {
+		if link.MaxFiles, err = strconv.Atoi(value); err != nil || link.MaxFiles < 0 {
+			http.Error(w, "Invalid File Limit", 400)
+			return
+		}
+	}
+	h.saveShare(w, link)
+}
+
+// reserveDrop sets aside room in the drop link id for one upload of size bytes, or all the room left if the
+// size is not known. It returns how much was set aside, where -1 means the link has no byte limit
+func (store *shareStore) reserveDrop(id string, size int64) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	link, ok := store.links[id]
+	if !ok || link.Revoked {
+		return 0, errShareExpired
+	}
+	pending := store.pending[id]
+	if link.MaxFiles > 0 && int64(link.Files)+pending.Files >= int64(link.MaxFiles) {
+		return 0, errDropFull
+	}
+
+	reserved := int64(-1)
+	if link.MaxBytes > 0 {
+		left := link.MaxBytes - link.Bytes - pending.Bytes
+		if size > left || left < 0 {
+			return 0, errQuotaExceeded
+		}
+		reserved = left
+		if size >= 0 {
+			reserved = size
+		}
+		pending.Bytes += reserved
+	}
+	pending.Files++
+	store.pending[id] = pending
+	return reserved, nil
+}
+
+// finishDrop gives back what reserveDrop set aside, and counts the upload if it was stored
+func (store *shareStore) finishDrop(id string, reserved int64, written int64, stored bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	pending := store.pending[id]
+	if reserved > 0 {
+		pending.Bytes -= reserved
+	}
+	pending.Files--
+	if pending == (quotaUsage{}) {
+		delete(store.pending, id)
+	} else {
+		store.pending[id] = pending
+	}
+
+	if link, ok := store.links[id]; ok && stored {
+		link.Bytes += written
+		link.Files++
+		if err := store.save(); err != nil {
+			fmt.Print("The following error occured while saving share links: ")
+			fmt.Println(err)
+		}
+	}
+}
+
+// claimDropName picks a name in dir for an upload called filename which no file has and no other upload through
+// a drop link is using, adding " (1)", " (2)" and so on before the extension. The caller releases it once done
+func (h fileHandler) claimDropName(dir string, filename string) (string, error) {
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+
+	h.shares.lock.Lock()
+	defer h.shares.lock.Unlock()
+	for i := 0; i < maxDropNames; i++ {
+		candidate := filename
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		name := path.Join(dir, candidate)
+		if _, err := h.storage.Stat(name); os.IsNotExist(err) && !h.shares.claimed[name] {
+			h.shares.claimed[name] = true
+			return name, nil
+		}
+	}
+	return "", errors.New("No free name for " + filename)
+}
+
+func (h fileHandler) releaseDropName(name string) {
+	h.shares.lock.Lock()
+	defer h.shares.lock.Unlock()
+	delete(h.shares.claimed, name)
+}
+
+// dropFilename returns the name an uploader gave a file without any directories, which browsers on Windows
+// may send with backslashes, or "" if it is unusable
+func dropFilename(filename string) string {
+	filename = path.Base(path.Clean("/" + filename[strings.LastIndex(filename, "\\")+1:]))
+	if filename == "/" || isStagingName(filename) {
+		return ""
+	}
+	return filename
+}
+
+// dropBody counts what is read of an upload, failing it once it goes past what its drop link set aside
+type dropBody struct {
+	io.ReadCloser
+	left int64
+	read int64
+}
+
+func (b *dropBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.left >= 0 && b.read > b.left {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// dropUpload stores body as filename in the directory of link, under a name no one else has. The upload is made
+// as the owner of the link, so it counts against their quota. It returns the name the file was stored as
+func (h fileHandler) dropUpload(w http.ResponseWriter, r *http.Request, link shareLink, owner auth.Account, filename string, body io.Reader, size int64) (string, bool) {
+	if filename = dropFilename(filename); filename == "" {
+		http.Error(w, "Invalid Filename", 400)
+		return "", false
+	}
+	name, err := h.claimDropName(link.Path, filename)
+	if err != nil {
+		http.Error(w, "No Free Filename", 409)
+		return "", false
+	}
+	defer h.releaseDropName(name)
+
+	reserved, err := h.shares.reserveDrop(link.ID, size)
+	if err == errQuotaExceeded {
+		http.Error(w, "Insufficient Storage", 507)
+		return "", false
+	} else if err != nil {
+		http.Error(w, err.Error(), 410)
+		return "", false
+	}
+
+	counted := &dropBody{ReadCloser: ioutil.NopCloser(body), left: reserved}
+	upload := r.Clone(r.Context())
+	upload.Body = counted
+	upload.ContentLength = size
+	// never replace anything, even a file which appeared after the name was picked
+	upload.Header.Set("If-None-Match", "*")
+	upload.Header.Del("If-Match")
+	upload.Header.Del("If-Unmodified-Since")
+	if body != r.Body {
+		// digests of the whole form say nothing about one file in it
+		for _, header := range []string{"Content-Digest", "Repr-Digest", "Digest", "Content-MD5"} {
+			upload.Header.Del(header)
+		}
+	}
+
+	stored, _ := h.uploadHandler(w, upload, name, owner)
+	h.shares.finishDrop(link.ID, reserved, counted.read, stored)
+	if stored {
+		fmt.Printf("Received %s through drop link %s from %s\n", name, link.ID, r.RemoteAddr)
+	}
+	return path.Base(name), stored
+}
+
+// dropHandler takes uploads through a drop link, either PUT to a file directly in its directory or a
+// multipart/form-data POST of any number of files to the directory. Nothing can be read through it
+func (h fileHandler) dropHandler(w http.ResponseWriter, r *http.Request, relativePath string, link shareLink) {
+	// a link only lasts as long as its owner can write where it drops files
+	owner, found := h.accounts.GetUser(link.Owner)
+	if !found || !owner.CanWrite(link.Path) {
+		http.Error(w, errShareExpired.Error(), 410)
+		return
+	}
+
+	response := dropResponse{Files: []string{}}
+	switch {
+	case r.Method == http.MethodPut && path.Dir(relativePath) == link.Path:
+		name, stored := h.dropUpload(w, r, link, owner, path.Base(relativePath), r.Body, r.ContentLength)
+		if !stored {
+			return
+		}
+		response.Files = append(response.Files, name)
+	case r.Method == http.MethodPost && relativePath == link.Path:
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "Expected A multipart/form-data Upload", 400)
+			return
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				http.Error(w, "Invalid Form", 400)
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			name, stored := h.dropUpload(w, r, link, owner, part.FileName(), part, -1)
+			if !stored {
+				return
+			}
+			response.Files = append(response.Files, name)
+		}
+		if len(response.Files) == 0 {
+			http.Error(w, "No Files Uploaded", 400)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, "Drop Links Only Take Uploads", 405)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(response)
+}
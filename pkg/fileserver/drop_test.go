@@ -0,0 +1,101 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDropLinks(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "sharekeys")
+	writeShareKeys(t, keyFile, "the first signing key")
+	handler, dataDir := makeTestHandler(t, Options{ShareKeyFile: keyFile, ShareFile: filepath.Join(t.TempDir(), "shares.json")})
+	writeTestFile(t, dataDir, "/inbox/log.txt", "already here")
+	writeTestFile(t, dataDir, "/inbox/sub/keep.txt", "kept")
+	writeTestFile(t, dataDir, "/limited/.keep", "")
+
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	create := func(target string, values string) shareView {
+		rec := doRequest(handler, http.MethodPost, target, "writer", values, form)
+		var view shareView
+		if rec.Code != 201 || json.Unmarshal(rec.Body.Bytes(), &view) != nil {
+			t.Fatalf("Creating a drop link to %s got %d %q", target, rec.Code, rec.Body.String())
+		}
+		return view
+	}
+	inbox := create("/inbox?drop", "")
+	limited := create("/limited?drop", "bytes=10&files=2")
+	revoked := create("/inbox?drop", "")
+	query := func(link shareView) string { return link.URL[strings.Index(link.URL, "?"):] }
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	parts.WriteField("note", "not a file")
+	first, _ := parts.CreateFormFile("upload", "C:\\Users\\me\\photo.jpg")
+	first.Write([]byte("jpeg"))
+	second, _ := parts.CreateFormFile("upload", "../../log.txt")
+	second.Write([]byte("from the form"))
+	parts.Close()
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		user        string
+		body        string
+		headers     map[string]string
+		status      int
+		response    string
+	}{
+		{"reader can't make one", http.MethodPost, "/inbox?drop", "reader", "", nil, 401, ""},
+		{"only for directories", http.MethodPost, "/inbox/log.txt?drop", "writer", "", nil, 409, ""},
+		{"invalid limit", http.MethodPost, "/inbox?drop&files=-1", "writer", "", nil, 400, ""},
+		{"upload", http.MethodPut, "/inbox/report.pdf" + query(inbox), "", "report", nil, 201, `"report.pdf"`},
+		{"existing name", http.MethodPut, "/inbox/log.txt" + query(inbox), "", "second", nil, 201, `"log (1).txt"`},
+		{"existing name again", http.MethodPut, "/inbox/log.txt" + query(inbox), "", "third", map[string]string{"If-Match": "*"}, 201, `"log (2).txt"`},
+		{"form upload", http.MethodPost, inbox.URL, "", body.String(), map[string]string{"Content-Type": parts.FormDataContentType()}, 201, `["photo.jpg","log (3).txt"]`},
+		{"form without files", http.MethodPost, inbox.URL, "", "", map[string]string{"Content-Type": "multipart/form-data; boundary=x"}, 400, ""},
+		{"no downloads", http.MethodGet, "/inbox/log.txt" + query(inbox), "", "", nil, 405, ""},
+		{"no listings", http.MethodGet, inbox.URL, "", "", nil, 405, ""},
+		{"no subdirectories", http.MethodPut, "/inbox/sub/keep.txt" + query(inbox), "", "replaced", nil, 405, ""},
+		{"no deletes", http.MethodDelete, "/inbox/log.txt" + query(inbox), "", "", nil, 405, ""},
+		{"other directory", http.MethodPut, "/limited/a.txt" + query(inbox), "", "x", nil, 403, ""},
+		{"within the limits", http.MethodPut, "/limited/a.txt" + query(limited), "", "123456", nil, 201, ""},
+		{"over the byte limit", http.MethodPut, "/limited/b.txt" + query(limited), "", "12345", nil, 507, ""},
+		{"filling the byte limit", http.MethodPut, "/limited/b.txt" + query(limited), "", "1234", nil, 201, ""},
+		{"over the file limit", http.MethodPut, "/limited/c.txt" + query(limited), "", "", nil, 410, ""},
+		{"revoke", http.MethodDelete, "/inbox?share=" + revoked.ID, "writer", "", nil, 204, ""},
+		{"revoked", http.MethodPut, "/inbox/late.txt" + query(revoked), "", "late", nil, 410, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			rec := doRequest(handler, tt.method, tt.target, tt.user, tt.body, tt.headers)
+			if rec.Code != tt.status {
+				t.Fatalf("Got %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.response != "" && !strings.Contains(rec.Body.String(), tt.response) {
+				t.Errorf("Got body %q, want %q", rec.Body.String(), tt.response)
+			}
+		})
+	}
+
+	storage := handler.(fileHandler).storage
+	for name, want := range map[string]string{
+		"/inbox/log.txt":      "already here",
+		"/inbox/log (1).txt":  "second",
+		"/inbox/log (3).txt":  "from the form",
+		"/inbox/photo.jpg":    "jpeg",
+		"/inbox/sub/keep.txt": "kept",
+	} {
+		if got := readStorageFile(storage, name); got != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+	if exists(dataDir, "/log.txt") || exists(dataDir, "/limited/c.txt") {
+		t.Error("Stored a file outside the drop link or over its limits")
+	}
+}
@@ -0,0 +1,549 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// encryptionMagic starts every encrypted file, and names the layout of what follows
+	encryptionMagic = "SFSENC01"
+	// encryptionChunkSize is how much plaintext is sealed at a time, so a range only needs the chunks it covers
+	encryptionChunkSize = 64 << 10
+	encryptionTagSize   = 16
+	// an encrypted file starts with the magic, the id of the key wrapping its data key, the nonce used to
+	// wrap it and the wrapped data key
+	encryptionKeyIDSize  = 8
+	encryptionHeaderSize = len(encryptionMagic) + encryptionKeyIDSize + 12 + 32 + encryptionTagSize
+)
+
+var errNotEncrypted = errors.New("File is not encrypted")
+var errUnknownKey = errors.New("File is encrypted with a key which is not in the keyring")
+var errChunkAuth = errors.New("Encrypted file failed authentication")
+
+// keyEncryptionKey wraps the data keys of files. Its id is the start of the SHA-256 of the key
+type keyEncryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// Keyring holds the keys which wrap the data key of each file. The first key wraps the data keys of new
+// files, the rest are kept so files written before a rotation can still be read
+type Keyring struct {
+	keys []keyEncryptionKey
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseKeyring reads base64 encoded 32 byte keys separated by newlines or commas, current key first.
+// Blank lines and lines starting with # are ignored
+func ParseKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{}
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("Encryption keys must be 32 bytes encoded as base64")
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		keyring.keys = append(keyring.keys, keyEncryptionKey{id: sum[:encryptionKeyIDSize], aead: aead})
+	}
+	if len(keyring.keys) == 0 {
+		return nil, errors.New("No encryption keys given")
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads a keyring written as ParseKeyring expects from filename
+func LoadKeyring(filename string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(data))
+}
+
+// header wraps dataKey with the current key into the header of a new file
+func (keyring *Keyring) header(dataKey []byte) ([]byte, error) {
+	kek := keyring.keys[0]
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, kek.id...)
+	nonce := make([]byte, kek.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	// the magic and key id are authenticated along with the data key
+	return kek.aead.Seal(header, nonce, dataKey, header[:len(encryptionMagic)+encryptionKeyIDSize]), nil
+}
+
+// unwrap returns the data key in header, and whether it was wrapped with the current key
+func (keyring *Keyring) unwrap(header []byte) ([]byte, bool, error) {
+	if len(header) != encryptionHeaderSize || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, false, errNotEncrypted
+	}
+	idEnd := len(encryptionMagic) + encryptionKeyIDSize
+	for i, kek := range keyring.keys {
+		if bytes.Equal(kek.id, header[len(encryptionMagic):idEnd]) {
+			nonceEnd := idEnd + kek.aead.NonceSize()
+			dataKey, err := kek.aead.Open(nil, header[idEnd:nonceEnd], header[nonceEnd:], header[:idEnd])
+			if err != nil {
+				return nil, false, errChunkAuth
+			}
+			return dataKey, i == 0, nil
+		}
+	}
+	return nil, false, errUnknownKey
+}
+
+// chunkNonce is unique within a file as every file has its own data key
+func chunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// chunkAAD marks the final chunk, so a file cut short at a chunk boundary fails authentication
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// plainSize returns the size of the plaintext of an encrypted file of stored bytes. Every file ends with a
+// final chunk shorter than encryptionChunkSize, which is empty if the plaintext fills its last chunk
+func plainSize(stored int64) (int64, bool) {
+	body := stored - int64(encryptionHeaderSize)
+	if body < encryptionTagSize {
+		return 0, false
+	}
+	chunks, rest := body/(encryptionChunkSize+encryptionTagSize), body%(encryptionChunkSize+encryptionTagSize)
+	if rest < encryptionTagSize {
+		return 0, false
+	}
+	return chunks*encryptionChunkSize + rest - encryptionTagSize, true
+}
+
+// encryptedFileInfo reports the size of the plaintext
+type encryptedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (info encryptedFileInfo) Size() int64 {
+	return info.size
+}
+
+func (info encryptedFileInfo) version() string {
+	return storageVersion(info.FileInfo)
+}
+
+func plainInfo(info os.FileInfo) os.FileInfo {
+	if info.IsDir() {
+		return info
+	}
+	size, _ := plainSize(info.Size())
+	return encryptedFileInfo{info, size}
+}
+
+// sealingStorage is a Storage which stores files transformed, such as encrypted. The trash and version
+// history keep copies of files as they are stored, so they are no less protected than the files themselves
+type sealingStorage interface {
+	Storage
+	// sealed is the storage holding the files as they are stored
+	sealed() Storage
+	// unseal reads a copy of a stored file
+	unseal(f *os.File) (StorageFile, error)
+}
+
+// storageKeyring returns the keyring storage encrypts files with, or nil if they aren't encrypted
+func storageKeyring(storage Storage) *Keyring {
+	switch s := storage.(type) {
+	case *EncryptedStorage:
+		return s.keyring
+	case *DedupStorage:
+		return storageKeyring(s.blobs)
+	}
+	return nil
+}
+
+// sealedStorage returns what holds the files of storage as they are stored
+func sealedStorage(storage Storage) Storage {
+	if s, ok := storage.(sealingStorage); ok {
+		return s.sealed()
+	}
+	return storage
+}
+
+// EncryptedStorage encrypts files at rest in another Storage with AES-256-GCM. Every file has its own data
+// key, wrapped by a key of the Keyring in the file's header, and is sealed in chunks so ranges can be read
+// without decrypting the whole file. Everything in the storage underneath must have been written through it
+type EncryptedStorage struct {
+	storage Storage
+	keyring *Keyring
+}
+
+// MakeEncryptedStorage creates an EncryptedStorage keeping its files in storage
+func MakeEncryptedStorage(storage Storage, keyring *Keyring) *EncryptedStorage {
+	return &EncryptedStorage{storage: storage, keyring: keyring}
+}
+
+func (s *EncryptedStorage) sealed() Storage {
+	return s.storage
+}
+
+// openFile reads the header of a stored file, leaving it positioned after it
+func (s *EncryptedStorage) openFile(f StorageFile, info os.FileInfo) (*encryptedFile, error) {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, errNotEncrypted
+	}
+	dataKey, _, err := s.keyring.unwrap(header)
+	if err != nil {
+		return nil, err
+	}
+	size, ok := plainSize(info.Size())
+	if !ok {
+		return nil, errNotEncrypted
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFile{file: f, aead: aead, info: encryptedFileInfo{info, size}, chunk: -1}, nil
+}
+
+func (s *EncryptedStorage) unseal(f *os.File) (StorageFile, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := s.openFile(f, info)
+	if err == errNotEncrypted {
+		// kept before encryption was turned on
+		_, err = f.Seek(0, io.SeekStart)
+		return f, err
+	}
+	return encrypted, err
+}
+
+// Open opens name for reading its plaintext
+func (s *EncryptedStorage) Open(name string) (StorageFile, error) {
+	f, err := s.storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return f, err
+	}
+	encrypted, err := s.openFile(f, info)
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return encrypted, nil
+}
+
+// Stat returns the FileInfo of name with the size of its plaintext
+func (s *EncryptedStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := s.storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo(info), nil
+}
+
+// ReadDir lists the directory name with the sizes of the plaintext
+func (s *EncryptedStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := s.storage.ReadDir(name)
+	for i, info := range infos {
+		infos[i] = plainInfo(info)
+	}
+	return infos, err
+}
+
+// Create stages a file encrypted with a new data key
+func (s *EncryptedStorage) Create(name string) (StagedFile, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	header, err := s.keyring.header(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	staged, err := s.storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := staged.Write(header); err != nil {
+		staged.Abort()
+		return nil, err
+	}
+	return &encryptedUpload{staged: staged, aead: aead, plain: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+// MkdirAll creates the directory name in the storage underneath
+func (s *EncryptedStorage) MkdirAll(name string) error {
+	return s.storage.MkdirAll(name)
+}
+
+// Rename renames in the storage underneath, as the files don't depend on their names
+func (s *EncryptedStorage) Rename(oldName string, newName string) error {
+	return s.storage.Rename(oldName, newName)
+}
+
+// Remove removes name from the storage underneath
+func (s *EncryptedStorage) Remove(name string) error {
+	return s.storage.Remove(name)
+}
+
+// RemoveAll removes name and everything under it from the storage underneath
+func (s *EncryptedStorage) RemoveAll(name string) error {
+	return s.storage.RemoveAll(name)
+}
+
+// Rewrap encrypts every file which isn't encrypted yet, and rewraps the data keys of files encrypted with an
+// older key with the current one, so the older keys can be taken out of the keyring. Only the header of a
+// rewrapped file changes. It returns how many files were encrypted and how many rewrapped
+func (s *EncryptedStorage) Rewrap() (int, int, error) {
+	return s.rewrap(func(name string) bool { return false })
+}
+
+// RewrapCopies is Rewrap for the copies of files kept by the trash or version history in the local directory
+// dir, as they are encrypted like the files they were kept from. Their records are left as they are
+func (s *EncryptedStorage) RewrapCopies(dir string) (int, int, error) {
+	copies := MakeEncryptedStorage(OpenLocalStorage(dir, ""), s.keyring)
+	return copies.rewrap(func(name string) bool {
+		// the records are directly inside the directory of each item or path
+		base := path.Base(name)
+		return strings.Count(name, "/") == 2 && (base == trashInfoFile || base == versionsFile)
+	})
+}
+
+// rewrap is Rewrap leaving out the files skip returns true for
+func (s *EncryptedStorage) rewrap(skip func(name string) bool) (int, int, error) {
+	encrypted, rewrapped := 0, 0
+	err := walkStorage(s.storage, "/", func(name string, info os.FileInfo) error {
+		if isStagingName(path.Base(name)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || skip(name) {
+			return nil
+		}
+
+		in, err := s.storage.Open(name)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		header := make([]byte, encryptionHeaderSize)
+		var out StagedFile
+		n, _ := io.ReadFull(in, header)
+		dataKey, current, err := s.keyring.unwrap(header[:n])
+		switch {
+		case err == errNotEncrypted:
+			if _, err := in.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if out, err = s.Create(name); err != nil {
+				return err
+			}
+			encrypted++
+		case err != nil:
+			return &os.PathError{Op: "rewrap", Path: name, Err: err}
+		case current:
+			return nil
+		default:
+			if header, err = s.keyring.header(dataKey); err != nil {
+				return err
+			}
+			if out, err = s.storage.Create(name); err != nil {
+				return err
+			}
+			if _, err := out.Write(header); err != nil {
+				out.Abort()
+				return err
+			}
+			rewrapped++
+		}
+
+		if _, err := io.Copy(out, in); err != nil {
+			out.Abort()
+			return err
+		}
+		_, err = out.Commit()
+		return err
+	})
+	return encrypted, rewrapped, err
+}
+
+// encryptedFile reads the plaintext of an encrypted file, decrypting a chunk at a time
+type encryptedFile struct {
+	file   StorageFile
+	aead   cipher.AEAD
+	info   os.FileInfo
+	offset int64
+	// chunk is the index of the chunk held decrypted in plain, or -1
+	chunk  int64
+	plain  []byte
+	sealed []byte
+}
+
+// load reads and decrypts chunk index into f.plain
+func (f *encryptedFile) load(index int64) error {
+	last := f.info.Size() / encryptionChunkSize
+	length := int64(encryptionChunkSize + encryptionTagSize)
+	if index == last {
+		length = f.info.Size() - index*encryptionChunkSize + encryptionTagSize
+	}
+	if _, err := f.file.Seek(int64(encryptionHeaderSize)+index*(encryptionChunkSize+encryptionTagSize), io.SeekStart); err != nil {
+		return err
+	}
+	if f.sealed == nil {
+		f.sealed = make([]byte, encryptionChunkSize+encryptionTagSize)
+	}
+	if _, err := io.ReadFull(f.file, f.sealed[:length]); err != nil {
+		return err
+	}
+	plain, err := f.aead.Open(f.plain[:0], chunkNonce(index), f.sealed[:length], chunkAAD(index == last))
+	if err != nil {
+		f.chunk = -1
+		return errChunkAuth
+	}
+	f.plain, f.chunk = plain, index
+	return nil
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	size := f.info.Size()
+	index := f.offset / encryptionChunkSize
+	if f.offset >= size {
+		// the final chunk is checked before reporting the end, so a reader of the whole file knows it is whole
+		if last := size / encryptionChunkSize; f.chunk != last {
+			if err := f.load(last); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	if index != f.chunk {
+		if err := f.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.plain[f.offset-index*encryptionChunkSize:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return f.offset, errors.New("Seek before the start of the file")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *encryptedFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// encryptedUpload seals what is written a chunk at a time into the staged file underneath
+type encryptedUpload struct {
+	staged StagedFile
+	aead   cipher.AEAD
+	index  int64
+	plain  []byte
+	sealed []byte
+}
+
+// seal writes the buffered plaintext as the next chunk
+func (f *encryptedUpload) seal(final bool) error {
+	f.sealed = f.aead.Seal(f.sealed[:0], chunkNonce(f.index), f.plain, chunkAAD(final))
+	f.index++
+	f.plain = f.plain[:0]
+	_, err := f.staged.Write(f.sealed)
+	return err
+}
+
+func (f *encryptedUpload) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(f.plain[len(f.plain):cap(f.plain)], p)
+		f.plain = f.plain[:len(f.plain)+n]
+		p = p[n:]
+		written += n
+		// a full chunk is never the final one, which is always shorter
+		if len(f.plain) == encryptionChunkSize {
+			if err := f.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Commit seals the final chunk and commits the staged file
+func (f *encryptedUpload) Commit() (os.FileInfo, error) {
+	if err := f.seal(true); err != nil {
+		f.staged.Abort()
+		return nil, err
+	}
+	info, err := f.staged.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo(info), nil
+}
+
+func (f *encryptedUpload) Abort() {
+	f.staged.Abort()
+}
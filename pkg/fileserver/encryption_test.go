@@ -0,0 +1,160 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func makeTestKeyring(t *testing.T, seeds ...string) *Keyring {
+	var keys []string
+	for _, seed := range seeds {
+		key := sha256.Sum256([]byte(seed))
+		keys = append(keys, base64.StdEncoding.EncodeToString(key[:]))
+	}
+	keyring, err := ParseKeyring(strings.Join(keys, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestPlainSize(t *testing.T) {
+	for _, size := range []int64{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+		stored := int64(encryptionHeaderSize) + size + encryptionTagSize*(size/encryptionChunkSize+1)
+		if got, ok := plainSize(stored); !ok || got != size {
+			t.Errorf("Got %d, %t for %d stored bytes, want %d", got, ok, stored, size)
+		}
+	}
+	if _, ok := plainSize(int64(encryptionHeaderSize) + encryptionChunkSize + encryptionTagSize); ok {
+		t.Error("Accepted a file without its final chunk")
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage := MakeEncryptedStorage(MakeLocalStorage(dir, ""), makeTestKeyring(t, "first"))
+	tusDir := t.TempDir()
+	handler, _ := makeTestHandler(t, Options{Storage: storage, VersionDir: t.TempDir(), TusDir: tusDir, MaxBodySize: 1 << 20})
+
+	original := bytes.Repeat([]byte("0123456789abcdef"), 2*encryptionChunkSize/16+1)
+	if rec := doRequest(handler, http.MethodPut, "/file.bin", "writer", string(original), nil); rec.Code != 201 {
+		t.Fatalf("PUT got %d", rec.Code)
+	}
+	raw, _ := ioutil.ReadFile(filepath.Join(dir, "file.bin"))
+	if bytes.Contains(raw, original[:64]) || int64(len(raw)) != int64(encryptionHeaderSize)+int64(len(original))+3*encryptionTagSize {
+		t.Errorf("Stored %d bytes which are not encrypted as expected", len(raw))
+	}
+
+	sum := sha256.Sum256(original)
+	var tests = []struct {
+		description string
+		target      string
+		headers     map[string]string
+		status      int
+		body        []byte
+	}{
+		{"whole file", "/file.bin", nil, 200, original},
+		{"range across chunks", "/file.bin", map[string]string{"Range": "bytes=65530-65545"}, 206, original[65530:65546]},
+		{"range in the final chunk", "/file.bin", map[string]string{"Range": "bytes=-3"}, 206, original[len(original)-3:]},
+		{"digest of the plaintext", "/file.bin", map[string]string{"Want-Repr-Digest": "sha-256=1"}, 200, original},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			rec := doRequest(handler, http.MethodGet, tt.target, "reader", "", tt.headers)
+			if rec.Code != tt.status || !bytes.Equal(rec.Body.Bytes(), tt.body) {
+				t.Errorf("Got %d with %d bytes, want %d with %d", rec.Code, rec.Body.Len(), tt.status, len(tt.body))
+			}
+			if want := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"; tt.headers["Want-Repr-Digest"] != "" && rec.Header().Get("Repr-Digest") != want {
+				t.Errorf("Got Repr-Digest %q, want %q", rec.Header().Get("Repr-Digest"), want)
+			}
+		})
+	}
+
+	// versions are kept encrypted, and still served as plaintext
+	doRequest(handler, http.MethodPut, "/file.bin", "writer", "replaced", nil)
+	kept, _ := filepath.Glob(filepath.Join(handler.(fileHandler).VersionDir, "*", "1"))
+	if len(kept) != 1 {
+		t.Fatalf("Found versions %v", kept)
+	}
+	if raw, _ := ioutil.ReadFile(kept[0]); bytes.Contains(raw, original[:64]) {
+		t.Error("Version was kept in plaintext")
+	}
+	if rec := doRequest(handler, http.MethodGet, "/file.bin?version=1", "reader", "", nil); !bytes.Equal(rec.Body.Bytes(), original) {
+		t.Errorf("Version got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// resumable uploads wait in TusDir encrypted, however their chunks arrive
+	rec := doRequest(handler, http.MethodPost, "/resumed.txt", "writer", "", map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "24"})
+	location := rec.Header().Get("Location")
+	for _, chunk := range []struct{ offset, body string }{{"0", "confidential"}, {"12", " upload text"}} {
+		headers := map[string]string{"Tus-Resumable": tusVersion, "Content-Type": "application/offset+octet-stream", "Upload-Offset": chunk.offset}
+		if chunk.offset == "12" {
+			staged, _ := filepath.Glob(filepath.Join(tusDir, "*.bin"))
+			if len(staged) != 1 {
+				t.Fatalf("Found staged uploads %v", staged)
+			}
+			if raw, _ := ioutil.ReadFile(staged[0]); bytes.Contains(raw, []byte("confidential")) {
+				t.Error("Upload was staged in plaintext")
+			}
+		}
+		if rec := doRequest(handler, http.MethodPatch, location, "writer", chunk.body, headers); rec.Code != 204 {
+			t.Fatalf("PATCH at %s got %d", chunk.offset, rec.Code)
+		}
+	}
+	if got := readStorageFile(storage, "/resumed.txt"); got != "confidential upload text" {
+		t.Errorf("Resumable upload stored %q", got)
+	}
+
+	// tampering with a chunk, or cutting the file short at a chunk boundary, fails authentication
+	writeStorageFile(t, storage, "/full.bin", string(original[:2*encryptionChunkSize]))
+	raw, _ = ioutil.ReadFile(filepath.Join(dir, "full.bin"))
+	tampered := append([]byte(nil), raw...)
+	tampered[encryptionHeaderSize+encryptionChunkSize+encryptionTagSize+1] ^= 1
+	second := encryptionHeaderSize + encryptionChunkSize + encryptionTagSize
+	truncated := append(append([]byte(nil), raw[:second]...), raw[len(raw)-encryptionTagSize:]...)
+	for description, contents := range map[string][]byte{"tampered": tampered, "truncated": truncated} {
+		ioutil.WriteFile(filepath.Join(dir, "full.bin"), contents, 0600)
+		f, err := storage.Open("/full.bin")
+		if err == nil {
+			_, err = ioutil.ReadAll(f)
+			f.Close()
+		}
+		if err == nil {
+			t.Errorf("Read a %s file without an error", description)
+		}
+	}
+	os.Remove(filepath.Join(dir, "full.bin"))
+
+	// rotating encrypts files written before encryption and rewraps the rest, after which the old key can go
+	ioutil.WriteFile(filepath.Join(dir, "plain.txt"), []byte("written before encryption"), 0600)
+	rotating := MakeEncryptedStorage(MakeLocalStorage(dir, ""), makeTestKeyring(t, "second", "first"))
+	if encrypted, rewrapped, err := rotating.Rewrap(); err != nil || encrypted != 1 || rewrapped != 2 {
+		t.Errorf("Rewrap encrypted %d and rewrapped %d, %v", encrypted, rewrapped, err)
+	}
+	rotated := MakeEncryptedStorage(MakeLocalStorage(dir, ""), makeTestKeyring(t, "second"))
+	if got := readStorageFile(rotated, "/file.bin"); got != "replaced" {
+		t.Errorf("Read %q after rotating", got)
+	}
+	if got := readStorageFile(rotated, "/plain.txt"); got != "written before encryption" {
+		t.Errorf("Read %q after encrypting", got)
+	}
+	if _, err := storage.Open("/file.bin"); err == nil {
+		t.Error("Opened a file with a key taken out of the keyring")
+	}
+
+	// so are the copies kept by the version history, leaving its records alone
+	if encrypted, rewrapped, err := rotating.RewrapCopies(handler.(fileHandler).VersionDir); err != nil || encrypted != 0 || rewrapped != 1 {
+		t.Errorf("RewrapCopies encrypted %d and rewrapped %d, %v", encrypted, rewrapped, err)
+	}
+	rotatedHandler, _ := makeTestHandler(t, Options{Storage: rotated, VersionDir: handler.(fileHandler).VersionDir})
+	if rec := doRequest(rotatedHandler, http.MethodGet, "/file.bin?version=1", "reader", "", nil); !bytes.Equal(rec.Body.Bytes(), original) {
+		t.Errorf("Version got %d with %d bytes after rotating", rec.Code, rec.Body.Len())
+	}
+}
@@ -0,0 +1,362 @@
+package fileserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// maxExtractEntries caps how many files and directories one archive may hold
+const maxExtractEntries = 100000
+
+var (
+	errExtractTooLarge = errors.New("Archive Too Large When Extracted")
+	errExtractEntries  = errors.New("Archive Has Too Many Entries")
+)
+
+// extractError is an archive entry we refuse to extract. status is the response to give
+type extractError struct {
+	status int
+	msg    string
+}
+
+func (e extractError) Error() string {
+	return e.msg
+}
+
+// wantsExtract returns true if a PUT or POST asked for its body to be unpacked with ?extract=1
+func wantsExtract(r *http.Request) bool {
+	extract, _ := strconv.ParseBool(r.URL.Query().Get("extract"))
+	return extract
+}
+
+// extractor writes the entries of an archive into a staging directory, checking each one
+type extractor struct {
+	storage      Storage
+	user         auth.Account
+	relativePath string
+	stagingDir   string
+	limit        int64
+	written      int64
+	entries      int
+	// files is the size of every file written, by its name in the staging directory
+	files map[string]int64
+}
+
+// target checks an entry's name and returns where it goes in the staging directory. Names which are
+// absolute, climb out with .., or name something the account can't write are refused
+func (e *extractor) target(name string) (string, error) {
+	name = strings.TrimSuffix(strings.Replace(name, "\\", "/", -1), "/")
+	// tar -C dir . names everything ./something
+	for strings.HasPrefix(name, "./") {
+		name = name[2:]
+	}
+	if name == "" || name == "." {
+		return "", nil
+	}
+	if strings.HasPrefix(name, "/") || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return "", extractError{400, "Invalid Archive Entry " + strconv.Quote(name)}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if isStagingName(part) {
+			return "", extractError{400, "Invalid Archive Entry " + strconv.Quote(name)}
+		}
+	}
+	if !e.user.CanWrite(path.Join(e.relativePath, name)) {
+		return "", extractError{403, "Forbidden Archive Entry " + strconv.Quote(name)}
+	}
+
+	e.entries++
+	if e.entries > maxExtractEntries {
+		return "", errExtractEntries
+	}
+	return path.Join(e.stagingDir, name), nil
+}
+
+func (e *extractor) dir(name string, modTime time.Time) error {
+	target, err := e.target(name)
+	if err != nil || target == "" {
+		return err
+	}
+	if err := e.storage.MkdirAll(target); err != nil {
+		return err
+	}
+	keepAttributes(e.storage, target, 0, modTime)
+	return nil
+}
+
+// file writes one regular file, counting its size against the uncompressed limit as it is written
+// rather than trusting the size the archive claims
+func (e *extractor) file(name string, mode os.FileMode, modTime time.Time, r io.Reader) error {
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		return extractError{400, "Invalid Archive Entry"}
+	}
+	if err := e.storage.MkdirAll(path.Dir(target)); err != nil {
+		return err
+	}
+
+	f, err := e.storage.Create(target)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, e.limit-e.written+1))
+	e.written += n
+	if err == nil && e.written > e.limit {
+		err = errExtractTooLarge
+	}
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	if _, err := f.Commit(); err != nil {
+		return err
+	}
+	e.files[target] = n
+	keepAttributes(e.storage, target, 0644|mode.Perm()&0111, modTime)
+	return nil
+}
+
+// keepAttributes gives an extracted entry the mode and modification time from the archive when the storage
+// is a local directory. A mode of 0 leaves the mode alone. Other storage has no way to keep them
+func keepAttributes(storage Storage, name string, mode os.FileMode, modTime time.Time) {
+	local, ok := storage.(*LocalStorage)
+	if !ok {
+		return
+	}
+	diskPath := local.diskPath(name)
+	if mode != 0 {
+		os.Chmod(diskPath, mode)
+	}
+	os.Chtimes(diskPath, modTime, modTime)
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return extractError{400, "Invalid Archive"}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.dir(header.Name, header.ModTime)
+		case tar.TypeReg, tar.TypeRegA:
+			err = e.file(header.Name, header.FileInfo().Mode(), header.ModTime, archive)
+		case tar.TypeXGlobalHeader:
+			// pax metadata for the whole archive, not a file
+		default:
+			// links, devices and fifos could point outside the directory or aren't files at all
+			return extractError{400, "Unsupported Archive Entry " + strconv.Quote(header.Name)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *extractor) extractZip(f io.ReaderAt, size int64) error {
+	archive, err := zip.NewReader(f, size)
+	if err != nil {
+		return extractError{400, "Invalid Archive"}
+	}
+	for _, entry := range archive.File {
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.dir(entry.Name, entry.Modified)
+		case mode.IsRegular():
+			rc, openerr := entry.Open()
+			if openerr != nil {
+				return extractError{400, "Invalid Archive"}
+			}
+			err = e.file(entry.Name, mode, entry.Modified, rc)
+			rc.Close()
+			if err == zip.ErrChecksum || err == zip.ErrFormat || err == zip.ErrAlgorithm {
+				err = extractError{400, "Invalid Archive"}
+			}
+		default:
+			return extractError{400, "Unsupported Archive Entry " + strconv.Quote(entry.Name)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapDirectory replaces the directory name with stagingDir. The old directory is moved aside
+// and removed once the new one is in place, so at no point is there a partly extracted directory
+func swapDirectory(storage Storage, stagingDir string, name string) error {
+	old := ""
+	if _, err := storage.Stat(name); err == nil {
+		old = path.Join(path.Dir(stagingDir), stagingPrefix+"old-"+path.Base(stagingDir))
+		if err := storage.Rename(name, old); err != nil {
+			return err
+		}
+	}
+	if err := storage.Rename(stagingDir, name); err != nil {
+		if old != "" {
+			storage.Rename(old, name)
+		}
+		return err
+	}
+	if old != "" {
+		storage.RemoveAll(old)
+	}
+	return nil
+}
+
+// extractHandler unpacks a tar, tar.gz or zip request body into the directory at relativePath, replacing
+// whatever it held. The archive is extracted into a staging directory and only swapped in if every entry
+// was accepted. It returns true if the directory was replaced, and whether it was created
+func (h fileHandler) extractHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) (bool, bool) {
+	if relativePath == "/" {
+		http.Error(w, "Cannot Replace Data Directory", 403)
+		return false, false
+	}
+	if info, err := h.storage.Stat(relativePath); err == nil && !info.IsDir() {
+		http.Error(w, "Not A Directory", 409)
+		return false, false
+	}
+	if err := h.makeParents(relativePath); err != nil {
+		http.Error(w, "Could not create required directories", 500)
+		return false, false
+	}
+
+	// zip needs to seek, so the body is kept in a temporary file whatever the format
+	body, createerr := ioutil.TempFile(h.StagingDir, stagingPrefix+"*")
+	if createerr != nil {
+		http.Error(w, "File Create Error", 500)
+		return false, false
+	}
+	defer discardStagingFile(body)
+	size, copyerr := io.Copy(body, r.Body)
+	if copyerr != nil && size >= h.MaxBodySize {
+		http.Error(w, "Request Body Too Large", 413)
+		return false, false
+	} else if copyerr != nil {
+		http.Error(w, "Write Error", 500)
+		return false, false
+	}
+	body.Seek(0, io.SeekStart)
+
+	stagingDir, direrr := stagingName(relativePath)
+	if direrr == nil {
+		direrr = h.storage.MkdirAll(stagingDir)
+	}
+	if direrr != nil {
+		http.Error(w, "File Create Error", 500)
+		return false, false
+	}
+	defer h.storage.RemoveAll(stagingDir)
+
+	e := &extractor{storage: h.storage, user: user, relativePath: relativePath, stagingDir: stagingDir, limit: h.maxExtractSize(), files: make(map[string]int64)}
+	buffered := bufio.NewReader(body)
+	magic, _ := buffered.Peek(4)
+	var err error
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		err = e.extractZip(body, size)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, gzerr := gzip.NewReader(buffered)
+		if gzerr != nil {
+			err = extractError{400, "Invalid Archive"}
+			break
+		}
+		err = e.extractTar(gz)
+		if err == nil {
+			// make sure the gzip checksum at the end is read and checked
+			if _, trailingerr := io.Copy(ioutil.Discard, gz); trailingerr != nil {
+				err = extractError{400, "Invalid Archive"}
+			}
+		}
+	default:
+		err = e.extractTar(buffered)
+	}
+
+	switch err := err.(type) {
+	case nil:
+	case extractError:
+		http.Error(w, err.msg, err.status)
+		return false, false
+	default:
+		if err == errExtractTooLarge || err == errExtractEntries {
+			fmt.Printf("Rejecting archive for %s from %s: %s\n", relativePath, r.RemoteAddr, err)
+			http.Error(w, err.Error(), 413)
+			return false, false
+		}
+		fmt.Print("The following error occured while extracting to " + relativePath + ": ")
+		fmt.Println(err)
+		http.Error(w, "Extract Error", 500)
+		return false, false
+	}
+
+	unlock := h.locks.lock(relativePath)
+	defer unlock()
+	_, staterr := h.storage.Stat(relativePath)
+	created := os.IsNotExist(staterr)
+	before := h.quotas.snapshot(relativePath)
+	reserved, quotaerr := h.quotas.reserve(user, before, movedFiles(e.files, stagingDir, relativePath))
+	if quotaerr != nil {
+		fmt.Printf("Rejecting archive for %s from %s: %s\n", relativePath, r.RemoteAddr, quotaerr)
+		http.Error(w, "Insufficient Storage", 507)
+		return false, false
+	}
+	defer h.quotas.release(reserved)
+	defer h.quotas.settle(relativePath, before)
+
+	// the directory being replaced goes to the trash if there is one, otherwise its files are kept as versions
+	if h.trash != nil && !created {
+		if trasherr := h.moveToTrash(relativePath, user); trasherr != nil {
+			fmt.Print("The following error occured while moving " + relativePath + " to the trash: ")
+			fmt.Println(trasherr)
+			http.Error(w, "Trash Error", 500)
+			return false, false
+		}
+	} else if versionerr := h.saveTreeVersions(relativePath); versionerr != nil && !os.IsNotExist(versionerr) {
+		fmt.Print("The following error occured while keeping versions of " + relativePath + ": ")
+		fmt.Println(versionerr)
+		http.Error(w, "Version Error", 500)
+		return false, false
+	}
+	if swaperr := swapDirectory(h.storage, stagingDir, relativePath); swaperr != nil {
+		fmt.Print("The following error occured while replacing " + relativePath + ": ")
+		fmt.Println(swaperr)
+		http.Error(w, "Write Error", 500)
+		return false, false
+	}
+	if h.DigestCache != nil {
+		h.DigestCache.Forget(relativePath)
+	}
+	h.davProps.forget(relativePath)
+	fmt.Printf("Extracted %d entries, %d bytes to %s\n", e.entries, e.written, relativePath)
+	return true, created
+}
+
+func (h fileHandler) maxExtractSize() int64 {
+	if h.MaxExtractSize > 0 {
+		return h.MaxExtractSize
+	}
+	return 10 * h.MaxBodySize
+}
@@ -0,0 +1,132 @@
+package fileserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	name     string
+	contents string
+	typeflag byte
+}
+
+func makeTar(t *testing.T, entries []testEntry, compress bool) string {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.contents)), Typeflag: e.typeflag}
+		if e.typeflag == tar.TypeSymlink {
+			header.Linkname, header.Size = e.contents, 0
+		}
+		if e.typeflag == tar.TypeDir {
+			header.Mode, header.Size = 0755, 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tw.Write([]byte(e.contents))
+		}
+	}
+	tw.Close()
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.String()
+}
+
+func makeZip(t *testing.T, entries []testEntry) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.contents))
+	}
+	zw.Close()
+	return buf.String()
+}
+
+func TestExtract(t *testing.T) {
+	release := []testEntry{
+		{"./", "", tar.TypeDir},
+		{"./index.html", "<p>v2</p>", tar.TypeReg},
+		{"./js/app.js", "app", tar.TypeReg},
+	}
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		user        string
+		body        string
+		status      int
+		files       map[string]string
+		gone        []string
+	}{
+		{"tar replaces the directory", http.MethodPut, "/site?extract=1", "writer", makeTar(t, release, false), 204,
+			map[string]string{"/site/index.html": "<p>v2</p>", "/site/js/app.js": "app"}, []string{"/site/old.html"}},
+		{"tar.gz creates a directory", http.MethodPost, "/new/site?extract=1", "writer", makeTar(t, release, true), 201,
+			map[string]string{"/new/site/index.html": "<p>v2</p>"}, nil},
+		{"zip", http.MethodPut, "/site?extract=true", "writer", makeZip(t, []testEntry{{"a/b.txt", "zipped", 0}}), 204,
+			map[string]string{"/site/a/b.txt": "zipped"}, []string{"/site/old.html"}},
+		{"traversal rejected", http.MethodPut, "/site?extract=1", "writer", makeTar(t, []testEntry{{"../escape.txt", "x", tar.TypeReg}}, false), 400,
+			map[string]string{"/site/old.html": "v1"}, []string{"/escape.txt"}},
+		{"zip traversal rejected", http.MethodPut, "/site?extract=1", "writer", makeZip(t, []testEntry{{"a/../../escape.txt", "x", 0}}), 400,
+			map[string]string{"/site/old.html": "v1"}, []string{"/escape.txt"}},
+		{"absolute path rejected", http.MethodPut, "/site?extract=1", "writer", makeTar(t, []testEntry{{"/etc/passwd", "x", tar.TypeReg}}, false), 400,
+			map[string]string{"/site/old.html": "v1"}, nil},
+		{"symlink rejected", http.MethodPut, "/site?extract=1", "writer", makeTar(t, []testEntry{{"link", "/etc", tar.TypeSymlink}}, false), 400,
+			map[string]string{"/site/old.html": "v1"}, []string{"/site/link"}},
+		{"reader cannot extract", http.MethodPut, "/site?extract=1", "reader", makeTar(t, release, false), 401,
+			map[string]string{"/site/old.html": "v1"}, nil},
+		{"uncompressed limit", http.MethodPut, "/site?extract=1", "writer", makeTar(t, []testEntry{{"big", strings.Repeat("0", 2000), tar.TypeReg}}, true), 413,
+			map[string]string{"/site/old.html": "v1"}, []string{"/site/big"}},
+		{"not a directory", http.MethodPut, "/file.txt?extract=1", "writer", makeTar(t, release, false), 409,
+			map[string]string{"/file.txt": "plain"}, nil},
+		{"post without extract", http.MethodPost, "/site", "writer", "", 405, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			handler, dataDir := makeTestHandler(t, Options{MaxExtractSize: 1000})
+			writeTestFile(t, dataDir, "/site/old.html", "v1")
+			writeTestFile(t, dataDir, "/file.txt", "plain")
+
+			rec := doRequest(handler, tt.method, tt.target, tt.user, tt.body, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("Got %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			for name, contents := range tt.files {
+				if got := readTestFile(t, dataDir, name); got != contents {
+					t.Errorf("%s is %q, want %q", name, got, contents)
+				}
+			}
+			for _, name := range tt.gone {
+				if exists(dataDir, name) {
+					t.Errorf("%s exists", name)
+				}
+			}
+			infos, _ := ioutil.ReadDir(dataDir)
+			for _, info := range infos {
+				if isStagingName(info.Name()) {
+					t.Errorf("Staging entry %s left behind", info.Name())
+				}
+			}
+		})
+	}
+}
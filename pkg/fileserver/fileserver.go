@@ -6,18 +6,84 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/zggz/securefileserver/pkg/auth"
+	"golang.org/x/net/webdav"
 )
 
+// Options holds the configurable behaviour of the request handler
+type Options struct {
+	// MaxBodySize is the largest request body accepted
+	MaxBodySize int64
+	// TruncateLongRequests cuts off bodies after MaxBodySize rather than rejecting on Content-Length
+	TruncateLongRequests bool
+	// PruneEmptyDirs removes parent directories made for an upload once a DELETE leaves them empty
+	PruneEmptyDirs bool
+	// StagingDir holds uploads until they are complete. Defaults to the directory of the target file.
+	// It must be on the same filesystem as the data directory
+	StagingDir string
+	// Storage holds the files served. Defaults to a LocalStorage of the data directory using StagingDir
+	Storage Storage
+	// LegacyDigest answers RFC 3230 Want-Digest requests alongside the RFC 9530 digest fields
+	LegacyDigest bool
+	// DigestCache remembers file digests so they are not recomputed on every request, such as for the ETag of
+	// every GET. Nil disables caching
+	DigestCache DigestCache
+	// TusDir enables tus resumable uploads, keeping unfinished uploads here across restarts.
+	// It must be on the same filesystem as the data directory
+	TusDir string
+	// TusExpiry is how long an unfinished tus upload is kept after its last chunk. Defaults to a day
+	TusExpiry time.Duration
+	// DavPropsFile keeps WebDAV dead properties across restarts. Make sure this isn't in the data directory.
+	// Default is to keep them in memory
+	DavPropsFile string
+	// SessionTTL is how long a login from the file browser's login page lasts. Defaults to 12 hours
+	SessionTTL time.Duration
+	// BasicSessions gives a client which authenticates with Basic auth a session cookie, with its CSRF token in
+	// an X-CSRF-Token response header. While the cookie is sent along, the password isn't checked again until it
+	// is changed
+	BasicSessions bool
+	// MaxExtractSize is the most an archive uploaded with ?extract=1 may unpack to. Defaults to ten times MaxBodySize
+	MaxExtractSize int64
+	// VersionDir enables version history, keeping the previous content of files replaced or deleted here.
+	// Make sure this isn't in the data directory. It is cheapest on the same filesystem as the data directory
+	VersionDir string
+	// VersionPolicies limit how many versions are kept under each path prefix. Default is to keep every version
+	VersionPolicies []VersionPolicy
+	// TrashDir enables the trash, where DELETE moves files and directories instead of removing them.
+	// It must be outside the data directory and on the same filesystem
+	TrashDir string
+	// TrashRetention is how long deleted items are kept in the trash. Defaults to 30 days
+	TrashRetention time.Duration
+	// PathQuotas limit how much may be stored under each path prefix, on top of the quotas of accounts
+	PathQuotas []PathQuota
+	// ShareKeyFile enables share links, holding the keys they are signed with. It is read again when it changes
+	ShareKeyFile string
+	// ShareFile keeps share links, their download counts and revocations across restarts. Make sure this isn't in
+	// the data directory. Default is to keep them in memory
+	ShareFile string
+	// JWT accepts JWTs from an identity provider as bearer tokens, alongside API tokens and the auth file
+	JWT *auth.JWTAuthenticator
+}
+
 type fileHandler struct {
-	accounts             *auth.Auth
-	dataDir              string
-	truncateLongRequests bool
-	maxBodySize          int64
+	accounts *auth.Auth
+	storage  Storage
+	locks    *pathLocks
+	davLocks webdav.LockSystem
+	davProps *davProps
+	sessions *sessionStore
+	versions *versionStore
+	trash    *trashStore
+	quotas   *quotaStore
+	shares   *shareStore
+	created  *createdDirs
+	Options
 }
 
 type weightedHashString struct {
@@ -37,7 +103,9 @@ func parseHashQVal(hashQVal string) weightedHashString {
 	return weightedHashString{s[0], 1.0}
 }
 
-func insertHash(w http.ResponseWriter, r *http.Request, diskPath string) {
+// insertLegacyHash answers an RFC 3230 Want-Digest with a Digest header. The digest is hex rather than base64
+// encoded, which existing clients depend on, so it is only sent when Options.LegacyDigest is set
+func (h fileHandler) insertLegacyHash(w http.ResponseWriter, r *http.Request, name string) {
 	if header := r.Header.Get("Want-Digest"); header != "" {
 		// split by the comma leaving a set of (hash[;q=###])
 		hashList := strings.Split(header, ",")
@@ -54,36 +122,177 @@ func insertHash(w http.ResponseWriter, r *http.Request, diskPath string) {
 		}
 
 		// getting hashes and setting
-		hash, err := getHashes(diskPath, hashList)
+		hash, err := h.getHashes(name, hashList)
 		if err == nil {
 			w.Header().Set("Digest", hash)
 		}
 	}
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request, diskPath string) {
-	if patherr := os.MkdirAll(path.Dir(diskPath), os.ModePerm); patherr != nil {
-		fmt.Print("The following error occured while trying to make the path for " + diskPath + ": ")
+// serveFile serves the file name with http.ServeContent, which handles ranges and conditional requests.
+// A directory is served by its index.html once it has a trailing slash, like http.ServeFile does
+func (h fileHandler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.storage.Open(name)
+	var info os.FileInfo
+	if err == nil {
+		info, err = f.Stat()
+		if err == nil && info.IsDir() {
+			f.Close()
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				http.Redirect(w, r, path.Base(r.URL.Path)+"/", 301)
+				return
+			}
+			name = path.Join(name, "index.html")
+			if f, err = h.storage.Open(name); err == nil {
+				info, err = f.Stat()
+			}
+		}
+	}
+	if os.IsNotExist(err) {
+		http.Error(w, "404 page not found", 404)
+		return
+	} else if err != nil {
+		fmt.Print("The following error occured while opening " + name + ": ")
+		fmt.Println(err)
+		http.Error(w, "500 Internal Server Error", 500)
+		return
+	}
+	defer f.Close()
+
+	h.insertETag(w, name)
+	h.insertHash(w, r, name)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// uploadHandler streams the request body into a staged file which only replaces name
+// once the whole body has been received. It returns true if the upload was committed, and
+// whether it created the file rather than replacing it
+func (h fileHandler) uploadHandler(w http.ResponseWriter, r *http.Request, name string, user auth.Account) (bool, bool) {
+	// fail early rather than receive a body we would throw away
+	if !h.checkPreconditions(w, r, name) {
+		return false, false
+	}
+
+	if patherr := h.makeParents(name); patherr != nil {
+		fmt.Print("The following error occured while trying to make the path for " + name + ": ")
 		fmt.Println(patherr)
 		http.Error(w, "Could not create required directories", 500)
-		return
+		return false, false
+	}
+
+	expected, digesterr := parseExpectedDigests(r.Header)
+	if digesterr != nil {
+		http.Error(w, digesterr.Error(), 400)
+		return false, false
 	}
 
-	f, createerr := os.Create(diskPath)
+	// refuse before reading the body if its Content-Length won't fit, otherwise cut it off where it stops fitting
+	left, quotaerr := h.quotas.headroom(user, name, h.quotas.fileUsage(name))
+	if quotaerr != nil || (left >= 0 && r.ContentLength > left) {
+		fmt.Printf("Rejecting upload to %s for %s as it is over quota\n", name, user.GetName())
+		http.Error(w, "Insufficient Storage", 507)
+		return false, false
+	}
+	body := io.Reader(r.Body)
+	if left >= 0 {
+		body = io.LimitReader(r.Body, left+1)
+	}
+
+	f, createerr := h.storage.Create(name)
 	if createerr != nil {
-		fmt.Print("The following error occured while trying to create the file " + diskPath + ": ")
+		fmt.Print("The following error occured while trying to create the file " + name + ": ")
 		fmt.Println(createerr)
 		http.Error(w, "File Create Error", 500)
-		return
+		return false, false
 	}
-	defer f.Close()
 
-	if _, writeerr := io.Copy(f, r.Body); writeerr != nil {
-		fmt.Print("The following error occured while writing to the file " + diskPath + ": ")
+	// hash while streaming so both the expected digests and the digest index come for free
+	algorithms := append(expectedAlgorithms(expected), "sha-256")
+	if h.DigestCache != nil {
+		algorithms = append(algorithms, indexedAlgorithms...)
+	}
+	digests := newDigestSet(algorithms)
+
+	written, writeerr := io.Copy(digests.writer(f), body)
+	if writeerr == errQuotaExceeded {
+		f.Abort()
+		fmt.Printf("Upload to %s went over its limit after %d bytes\n", name, written)
+		http.Error(w, "Insufficient Storage", 507)
+		return false, false
+	} else if writeerr != nil {
+		f.Abort()
+		fmt.Print("The following error occured while writing to the file " + name + ": ")
 		fmt.Println(writeerr)
 		http.Error(w, "Write Error", 500)
-		return
+		return false, false
+	}
+
+	if left >= 0 && written > left {
+		f.Abort()
+		fmt.Printf("Upload to %s for %s went over quota after %d bytes\n", name, user.GetName(), written)
+		http.Error(w, "Insufficient Storage", 507)
+		return false, false
 	}
+
+	if r.ContentLength >= 0 && written != r.ContentLength {
+		f.Abort()
+		fmt.Printf("Upload to %s ended after %d of %d bytes\n", name, written, r.ContentLength)
+		http.Error(w, "Incomplete Body", 400)
+		return false, false
+	}
+
+	sums := digests.sums()
+	if mismatch := firstMismatch(expected, sums); mismatch != nil {
+		f.Abort()
+		fmt.Printf("Rejecting upload to %s as the %s %s digest did not match\n", name, mismatch.header, mismatch.algorithm)
+		http.Error(w, mismatch.header+" "+mismatch.algorithm+" Mismatch", 422)
+		return false, false
+	}
+
+	unlock := h.locks.lock(name)
+	defer unlock()
+
+	// check again as another request may have changed the file while the body was streaming in
+	if !h.checkPreconditions(w, r, name) {
+		f.Abort()
+		return false, false
+	}
+
+	_, staterr := h.storage.Stat(name)
+	created := os.IsNotExist(staterr)
+
+	// charge under the lock so uploads arriving together can't both take the last of a quota
+	before, after := h.quotas.fileUsage(name), quotaUsage{Bytes: written, Files: 1}
+	if quotaerr := h.quotas.charge(user, name, before, after); quotaerr != nil {
+		f.Abort()
+		fmt.Printf("Rejecting upload to %s for %s as it is over quota\n", name, user.GetName())
+		http.Error(w, "Insufficient Storage", 507)
+		return false, false
+	}
+
+	if versionerr := h.saveVersion(name); versionerr != nil {
+		h.quotas.refund(name, before, after)
+		f.Abort()
+		fmt.Print("The following error occured while keeping a version of " + name + ": ")
+		fmt.Println(versionerr)
+		http.Error(w, "Version Error", 500)
+		return false, false
+	}
+
+	info, commiterr := f.Commit()
+	if commiterr != nil {
+		h.quotas.refund(name, before, after)
+		fmt.Print("The following error occured while committing the file " + name + ": ")
+		fmt.Println(commiterr)
+		http.Error(w, "Write Error", 500)
+		return false, false
+	}
+
+	if h.DigestCache != nil {
+		h.DigestCache.Set(name, info, sums)
+	}
+	w.Header().Set("ETag", formatETag(sums["sha-256"]))
+	return true, created
 }
 
 func requestAuth(w http.ResponseWriter) {
@@ -94,54 +303,176 @@ func requestAuth(w http.ResponseWriter) {
 
 func (h fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Request %s to %s with %d bytes of data from %s\n", r.Method, r.URL.Path, r.ContentLength, r.RemoteAddr)
-	relativePath := r.URL.Path
-	diskPath := path.Clean(h.dataDir + relativePath)
+	relativePath := path.Clean("/" + r.URL.Path)
 
-	if h.truncateLongRequests {
-		r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
-	} else if r.ContentLength > h.maxBodySize {
+	if h.TruncateLongRequests {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxBodySize)
+	} else if r.ContentLength > h.MaxBodySize {
 		http.Error(w, "Request Body Too Large", 413)
 		fmt.Printf("Rejecting Oversized body of size %d from %s\n", r.ContentLength, r.RemoteAddr)
 		return
 	}
 
-	username, password, ok := r.BasicAuth()
-	var user auth.Account
-	var err error
-	if ok {
-		user, err = h.accounts.GetAccount(username, []byte(password))
+	query := r.URL.Query()
+	// the browser's stylesheet and script are needed on the login page, before anyone has logged in
+	if name := query.Get("asset"); name != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		assetHandler(w, r, name)
+		return
+	}
+	if _, login := query["login"]; login {
+		h.loginHandler(w, r)
+		return
+	}
+	if _, logout := query["logout"]; logout {
+		h.logoutHandler(w, r)
+		return
+	}
+
+	// a share link stands in for an account, whatever else the request carries
+	if h.shares != nil && query.Get("sig") != "" {
+		h.shareHandler(w, r, relativePath)
+		return
+	}
+
+	user, s := h.authenticate(w, r)
+
+	if _, basic := query["basic"]; basic && r.Header.Get("Authorization") == "" {
+		requestAuth(w)
+		return
 	}
 
-	if err != nil {
-		user = h.accounts.GetDefault()
+	if !checkCSRF(r, s) {
+		http.Error(w, "Missing CSRF Token", 403)
+		return
 	}
 
 	if !user.CanRead(relativePath) {
+		// browsers get the login page rather than the Basic auth prompt
+		if r.Method == http.MethodGet && wantsHTML(r) && r.Header.Get("Authorization") == "" {
+			render(w, 401, "login.html", loginPage{Next: r.URL.RequestURI()})
+			return
+		}
 		requestAuth(w)
 		return
 	}
 
+	// uploads in progress are never served or overwritten directly
+	if isStagingName(path.Base(relativePath)) {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	if h.shares != nil && wantsShareManagement(r) {
+		h.sharesHandler(w, r, relativePath, user)
+		return
+	}
+
+	if h.TusDir != "" && r.Header.Get("Tus-Resumable") != "" && r.Method != http.MethodOptions {
+		h.tusHandler(w, r, relativePath, user)
+		return
+	}
+
 	switch r.Method {
 	case "":
 		fallthrough
 	case http.MethodGet:
 		fallthrough
 	case http.MethodHead:
-		insertHash(w, r, diskPath)
-		http.ServeFile(w, r, diskPath)
-	case http.MethodPut:
+		if _, usage := query["quota"]; usage {
+			h.quotaHandler(w, r, relativePath, user)
+			return
+		}
+		if _, list := query["trash"]; list && h.trash != nil {
+			h.trashHandler(w, r, relativePath, user)
+			return
+		}
+		if _, list := query["versions"]; h.versions != nil && (list || query.Get("version") != "") {
+			h.versionsHandler(w, r, relativePath)
+			return
+		}
+		if info, err := h.storage.Stat(relativePath); err == nil && info.IsDir() {
+			if query.Get("archive") != "" {
+				h.archiveHandler(w, r, relativePath, user)
+				return
+			}
+			if wantsJSONListing(r) {
+				h.listHandler(w, r, relativePath, user)
+				return
+			}
+			if h.wantsBrowser(r, relativePath) {
+				h.browserHandler(w, r, relativePath, user, s)
+				return
+			}
+		}
+		h.serveFile(w, r, relativePath)
+	case http.MethodPut, http.MethodPost:
+		if r.Method == http.MethodPost && h.trash != nil && query.Get("untrash") != "" {
+			h.trashHandler(w, r, relativePath, user)
+			return
+		}
+		restore := r.Method == http.MethodPost && h.versions != nil && query.Get("restore") != ""
+		if r.Method == http.MethodPost && !wantsExtract(r) && !restore {
+			http.Error(w, "Method Not Supported", 405)
+			return
+		}
 		if user.CanWrite(relativePath) {
-			uploadHandler(w, r, diskPath)
-			insertHash(w, r, diskPath)
+			release, ok := h.confirmDavLocks(w, r, relativePath)
+			if !ok {
+				return
+			}
+			defer release()
+
+			if restore {
+				h.restoreHandler(w, r, relativePath, user)
+			} else if wantsExtract(r) {
+				if extracted, created := h.extractHandler(w, r, relativePath, user); extracted {
+					if created {
+						w.WriteHeader(201)
+					} else {
+						w.WriteHeader(204)
+					}
+				}
+			} else if committed, created := h.uploadHandler(w, r, relativePath, user); committed {
+				h.insertHash(w, r, relativePath)
+				if created {
+					w.WriteHeader(201)
+				} else {
+					w.WriteHeader(204)
+				}
+			}
 		} else {
 			requestAuth(w)
 		}
-		// w.WriteHeader(204) // TODO: return 204 (200?) or 201
 	case http.MethodOptions:
-		w.Header().Set("Accept", strings.Join([]string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions}, ", "))
+		methods := append([]string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodOptions}, davMethods...)
+		if h.TusDir != "" {
+			methods = append(methods, http.MethodPatch)
+			h.insertTusOptions(w)
+		}
+		w.Header().Set("Accept", strings.Join(methods, ", "))
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Want-Repr-Digest", digestAdvertisement)
+		w.Header().Set("Want-Content-Digest", digestAdvertisement)
+		if h.LegacyDigest {
+			w.Header().Set("Want-Digest", "SHA-512;q=1, SHA-256;q=1, SHA-1;q=0.5, SHA;q=0.5, MD5;q=0.1")
+		}
 		w.WriteHeader(204)
 	case http.MethodDelete:
-		fallthrough
+		if user.CanWrite(relativePath) {
+			release, ok := h.confirmDavLocks(w, r, relativePath)
+			if !ok {
+				return
+			}
+			defer release()
+
+			h.deleteHandler(w, r, relativePath, user)
+		} else {
+			requestAuth(w)
+		}
+	case "PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK":
+		h.davHandler(w, r, relativePath, user)
 	default:
 		http.Error(w, "Method Not Supported", 405)
 	}
@@ -150,5 +481,84 @@ func (h fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // MakeRequestHandler creates a request handler with all the configured options on how to respond to requests
 // The handler should handle everything including checking authentication internally
 func MakeRequestHandler(accounts *auth.Auth, dataDir string, maxBodySize int64, truncateLongRequests bool) http.Handler {
-	return fileHandler{accounts: accounts, dataDir: dataDir, truncateLongRequests: truncateLongRequests, maxBodySize: maxBodySize}
+	return MakeRequestHandlerWithOptions(accounts, dataDir, Options{MaxBodySize: maxBodySize, TruncateLongRequests: truncateLongRequests, LegacyDigest: true})
+}
+
+// MakeRequestHandlerWithOptions creates a request handler like MakeRequestHandler, taking the full set of Options
+func MakeRequestHandlerWithOptions(accounts *auth.Auth, dataDir string, options Options) http.Handler {
+	h := fileHandler{
+		accounts: accounts,
+		storage:  options.Storage,
+		locks:    makePathLocks(),
+		davLocks: webdav.NewMemLS(),
+		sessions: makeSessionStore(),
+		created:  makeCreatedDirs(),
+		Options:  options,
+	}
+
+	props, propserr := makeDavProps(options.DavPropsFile)
+	if propserr != nil {
+		fmt.Print("The following error occured while loading WebDAV properties from " + options.DavPropsFile + ": ")
+		fmt.Println(propserr)
+		props, _ = makeDavProps("")
+	}
+	h.davProps = props
+
+	if h.storage == nil {
+		h.storage = MakeLocalStorage(dataDir, options.StagingDir)
+	}
+
+	var existing map[string]auth.Account
+	if accounts != nil {
+		existing = accounts.GetAll()
+	}
+	h.quotas = makeQuotaStore(h.storage, options.PathQuotas, existing)
+
+	if h.ShareKeyFile != "" {
+		shares, shareerr := makeShareStore(h.ShareKeyFile, h.ShareFile)
+		if shareerr != nil {
+			fmt.Print("The following error occured while loading share links, disabling them: ")
+			fmt.Println(shareerr)
+		} else {
+			h.shares = shares
+		}
+	}
+
+	if h.TusDir != "" {
+		if err := os.MkdirAll(h.TusDir, 0700); err != nil {
+			fmt.Print("The following error occured while trying to make the tus directory " + h.TusDir + ": ")
+			fmt.Println(err)
+		}
+		go h.expireTusUploads()
+	}
+	if h.VersionDir != "" {
+		if err := os.MkdirAll(h.VersionDir, 0700); err != nil {
+			fmt.Print("The following error occured while trying to make the version directory " + h.VersionDir + ": ")
+			fmt.Println(err)
+		}
+		h.versions = makeVersionStore(h.VersionDir, h.VersionPolicies)
+		go h.expireVersions()
+	}
+	if h.TrashDir != "" {
+		trashDir, _ := filepath.Abs(h.TrashDir)
+		local, isLocal := sealedStorage(h.storage).(*LocalStorage)
+		root := ""
+		if isLocal {
+			root, _ = filepath.Abs(local.root)
+		}
+		if isLocal && (trashDir == root || strings.HasPrefix(trashDir, root+string(filepath.Separator))) {
+			// anything in the data directory can be fetched, which would bypass restoring only your own items
+			fmt.Println("The trash directory " + h.TrashDir + " is inside the data directory, disabling the trash")
+		} else if err := os.MkdirAll(h.TrashDir, 0700); err != nil {
+			fmt.Print("The following error occured while trying to make the trash directory " + h.TrashDir + ": ")
+			fmt.Println(err)
+		} else {
+			h.trash = &trashStore{dir: h.TrashDir, retention: h.TrashRetention}
+			if h.trash.retention <= 0 {
+				h.trash.retention = defaultTrashRetention
+			}
+			go h.purgeTrash()
+		}
+	}
+	return h
 }
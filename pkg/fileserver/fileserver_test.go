@@ -0,0 +1,924 @@
+package fileserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// writer can read and write everything, reader can only read. Empty hashes accept any password
+var writer auth.Account = auth.Account{
+	User:      "writer",
+	Readable:  []string{"/"},
+	Writeable: []string{"/"},
+}
+
+var reader auth.Account = auth.Account{
+	User:      "reader",
+	Readable:  []string{"/"},
+	Writeable: []string{},
+}
+
+func makeTestHandler(t *testing.T, options Options) (http.Handler, string) {
+	dataDir, err := ioutil.TempDir("", "fileserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dataDir) })
+
+	store := auth.MakeEmptyGoCacheStore(filepath.Join(t.TempDir(), "auth.json"))
+	store.Set(writer.User, writer)
+	store.Set(reader.User, reader)
+
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = 1 << 20
+	}
+	return MakeRequestHandlerWithOptions(auth.MakeAuthFromStore(store), dataDir, options), dataDir
+}
+
+func writeTestFile(t *testing.T, dataDir string, name string, contents string) {
+	diskPath := filepath.Join(dataDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(diskPath), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(diskPath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func doRequest(handler http.Handler, method string, target string, user string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if user != "" {
+		req.SetBasicAuth(user, "password")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func exists(dataDir string, name string) bool {
+	_, err := os.Lstat(filepath.Join(dataDir, filepath.FromSlash(name)))
+	return err == nil
+}
+
+func TestDelete(t *testing.T) {
+	var tests = []struct {
+		description string
+		target      string
+		user        string
+		headers     map[string]string
+		status      int
+		removed     string
+	}{
+		{"deletes file", "/a/file.txt", "writer", nil, 204, "/a/file.txt"},
+		{"missing file is not found", "/a/missing.txt", "writer", nil, 404, ""},
+		{"reader cannot delete", "/a/file.txt", "reader", nil, 401, ""},
+		{"anonymous cannot delete", "/a/file.txt", "", nil, 401, ""},
+		{"non-empty directory conflicts", "/a", "writer", nil, 409, ""},
+		{"empty directory deletes", "/empty", "writer", nil, 204, "/empty"},
+		{"recursive query deletes tree", "/a?recursive=true", "writer", nil, 204, "/a"},
+		{"recursive header deletes tree", "/a", "writer", map[string]string{"X-Recursive": "true"}, 204, "/a"},
+		{"recursive false conflicts", "/a?recursive=false", "writer", nil, 409, ""},
+		{"data directory is protected", "/", "writer", map[string]string{"X-Recursive": "true"}, 403, ""},
+		{"traversal is contained", "/../a/file.txt", "writer", nil, 204, "/a/file.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			handler, dataDir := makeTestHandler(t, Options{})
+			writeTestFile(t, dataDir, "/a/file.txt", "hello")
+			writeTestFile(t, dataDir, "/a/b/other.txt", "world")
+			os.Mkdir(filepath.Join(dataDir, "empty"), os.ModePerm)
+
+			rec := doRequest(handler, http.MethodDelete, tt.target, tt.user, "", tt.headers)
+			if rec.Code != tt.status {
+				t.Errorf("got status %d; want %d", rec.Code, tt.status)
+			}
+			if tt.removed != "" && exists(dataDir, tt.removed) {
+				t.Errorf("%s still exists", tt.removed)
+			}
+		})
+	}
+}
+
+func TestDeletePrunesEmptyParents(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{PruneEmptyDirs: true})
+	writeTestFile(t, dataDir, "/keep.txt", "root")
+	writeTestFile(t, dataDir, "/x/sibling.txt", "sibling")
+	os.MkdirAll(filepath.Join(dataDir, "existing", "empty"), os.ModePerm)
+
+	// only the directories the upload made are pruned, not those which were already there
+	if rec := doRequest(handler, http.MethodPut, "/x/y/z/file.txt", "writer", "nested", nil); rec.Code != 201 {
+		t.Fatalf("got PUT status %d; want 201", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPut, "/existing/empty/file.txt", "writer", "nested", nil); rec.Code != 201 {
+		t.Fatalf("got PUT status %d; want 201", rec.Code)
+	}
+	for _, target := range []string{"/x/y/z/file.txt", "/existing/empty/file.txt"} {
+		if rec := doRequest(handler, http.MethodDelete, target, "writer", "", nil); rec.Code != 204 {
+			t.Fatalf("got status %d; want 204", rec.Code)
+		}
+	}
+	if exists(dataDir, "/x/y") {
+		t.Errorf("empty parents were not pruned")
+	}
+	if !exists(dataDir, "/x/sibling.txt") {
+		t.Errorf("non-empty parent was pruned")
+	}
+	if !exists(dataDir, "/existing/empty") {
+		t.Errorf("directory from before the upload was pruned")
+	}
+
+	// nor is a collection made on purpose
+	if rec := doRequest(handler, "MKCOL", "/made", "writer", "", nil); rec.Code != 201 {
+		t.Fatalf("got MKCOL status %d; want 201", rec.Code)
+	}
+	doRequest(handler, http.MethodPut, "/made/file.txt", "writer", "x", nil)
+	if rec := doRequest(handler, http.MethodDelete, "/made/file.txt", "writer", "", nil); rec.Code != 204 || !exists(dataDir, "/made") {
+		t.Errorf("got status %d and pruned the collection", rec.Code)
+	}
+}
+
+func readTestFile(t *testing.T, dataDir string, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPut(t *testing.T) {
+	var tests = []struct {
+		description   string
+		target        string
+		user          string
+		body          string
+		contentLength int64
+		status        int
+		contents      string
+	}{
+		{"writes new file", "/new/file.txt", "writer", "fresh", 5, 201, "fresh"},
+		{"replaces existing file", "/old.txt", "writer", "replaced", 8, 204, "replaced"},
+		{"reader cannot write", "/old.txt", "reader", "replaced", 8, 401, "original"},
+		{"oversized body keeps old file", "/old.txt", "writer", "this body is too long", 21, 500, "original"},
+		{"short body keeps old file", "/old.txt", "writer", "short", 100, 400, "original"},
+		{"staging names are hidden", "/" + stagingPrefix + "x", "writer", "sneaky", 6, 404, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			handler, dataDir := makeTestHandler(t, Options{MaxBodySize: 10, TruncateLongRequests: true})
+			writeTestFile(t, dataDir, "/old.txt", "original")
+
+			req := httptest.NewRequest(http.MethodPut, tt.target, strings.NewReader(tt.body))
+			req.ContentLength = tt.contentLength
+			req.SetBasicAuth(tt.user, "password")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("got status %d; want %d", rec.Code, tt.status)
+			}
+			if tt.contents != "" {
+				if got := readTestFile(t, dataDir, tt.target); got != tt.contents {
+					t.Errorf("got contents %q; want %q", got, tt.contents)
+				}
+			}
+
+			matches, _ := filepath.Glob(filepath.Join(dataDir, "*", stagingPrefix+"*"))
+			rootMatches, _ := filepath.Glob(filepath.Join(dataDir, stagingPrefix+"*"))
+			if len(matches)+len(rootMatches) != 0 {
+				t.Errorf("staging files left behind: %v", append(matches, rootMatches...))
+			}
+		})
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{})
+	writeTestFile(t, dataDir, "/builds/log.txt", "log")
+	writeTestFile(t, dataDir, "/private.txt", "private")
+
+	accounts := handler.(fileHandler).accounts
+	ci := writer
+	token, secret, err := auth.NewToken(ci, "ci", time.Time{}, []string{"/builds"}, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci.Tokens = append(ci.Tokens, token)
+	accounts.AddUser(ci)
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		header      string
+		status      int
+	}{
+		{"reads with the token", http.MethodGet, "/builds/log.txt", "Bearer " + secret, 200},
+		{"scheme is case insensitive", http.MethodGet, "/builds/log.txt", "bearer " + secret, 200},
+		{"limited to the token's paths", http.MethodGet, "/private.txt", "Bearer " + secret, 401},
+		{"read only", http.MethodPut, "/builds/new.txt", "Bearer " + secret, 401},
+		{"wrong token", http.MethodGet, "/builds/log.txt", "Bearer " + secret + "x", 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			rec := doRequest(handler, tt.method, tt.target, "", "new", map[string]string{"Authorization": tt.header})
+			if rec.Code != tt.status {
+				t.Errorf("Got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{})
+	writeTestFile(t, dataDir, "/report.txt", "report")
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "backup-agent"}, NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	cert, _ := x509.ParseCertificate(der)
+
+	agent := reader
+	agent.User, agent.Certificates = "agent", []string{"cn:backup-agent"}
+	handler.(fileHandler).accounts.AddUser(agent)
+
+	var tests = []struct {
+		description string
+		verified    bool
+		user        string
+		status      int
+	}{
+		{"verified certificate", true, "", 200},
+		{"unverified certificate", false, "", 401},
+		{"falls back to a password", false, "reader", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/report.txt", nil)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+			if tt.verified {
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+			}
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, "password")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("Got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestBasicSessions(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{BasicSessions: true})
+	writeTestFile(t, dataDir, "/report.txt", "report")
+	hash, _ := auth.HashPassword([]byte("secret"))
+	handler.(fileHandler).accounts.AddUser(auth.Account{User: "alice", Readable: []string{"/"}, Hash: hash})
+
+	req := httptest.NewRequest(http.MethodGet, "/report.txt", nil)
+	req.SetBasicAuth("alice", "secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	cookies := rec.Result().Cookies()
+	if rec.Code != 200 || len(cookies) != 1 || rec.Header().Get("X-CSRF-Token") == "" {
+		t.Fatalf("Got %d with cookies %v", rec.Code, cookies)
+	}
+
+	// the session stands in for the password, and no new one is started while it is sent
+	req = httptest.NewRequest(http.MethodGet, "/report.txt", nil)
+	req.SetBasicAuth("alice", "")
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 200 || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Got %d with cookies %v using the session", rec.Code, rec.Result().Cookies())
+	}
+
+	// but only for the account it was started for, so another account gets its own
+	rec = doRequest(handler, http.MethodGet, "/report.txt", "reader", "", map[string]string{"Cookie": cookies[0].Name + "=" + cookies[0].Value})
+	if rec.Code != 200 || len(rec.Result().Cookies()) != 1 {
+		t.Errorf("Got %d with cookies %v for another account", rec.Code, rec.Result().Cookies())
+	}
+
+	// a wrong password gets no session
+	req = httptest.NewRequest(http.MethodGet, "/report.txt", nil)
+	req.SetBasicAuth("alice", "wrong")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Got cookies %v for a wrong password", rec.Result().Cookies())
+	}
+
+	// changing the password ends the session
+	hash, _ = auth.HashPassword([]byte("changed"))
+	handler.(fileHandler).accounts.AddUser(auth.Account{User: "alice", Readable: []string{"/"}, Hash: hash})
+	req = httptest.NewRequest(http.MethodGet, "/report.txt", nil)
+	req.SetBasicAuth("alice", "secret")
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 401 || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Got %d with cookies %v using the session after a password change", rec.Code, rec.Result().Cookies())
+	}
+}
+
+func TestSessionStoreSize(t *testing.T) {
+	store := makeSessionStore()
+	store.size = 2
+	first, _, _ := store.create(auth.Account{User: "a"}, time.Minute)
+	second, _, _ := store.create(auth.Account{User: "b"}, time.Hour)
+	third, _, _ := store.create(auth.Account{User: "c"}, time.Hour)
+	if _, found := store.get(first); found || len(store.sessions) != 2 {
+		t.Errorf("Kept %d sessions, including the one closest to expiring", len(store.sessions))
+	}
+	if _, found := store.get(second); !found {
+		t.Error("Ended a newer session")
+	}
+	if _, found := store.get(third); !found {
+		t.Error("Didn't keep the new session")
+	}
+}
+
+func TestJWTAccountsAreSeparate(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "x": b64.EncodeToString(public)}}})
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, jwks, 0644); err != nil {
+		t.Fatal(err)
+	}
+	jwt, err := auth.MakeJWTAuthenticator(auth.JWTConfig{JWKS: jwksFile, Issuer: "https://id.example.com", Audience: "files", ReadClaim: "paths", WriteClaim: "paths"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA"})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": "https://id.example.com", "aud": "files", "sub": "reader", "paths": "/", "exp": time.Now().Add(time.Minute).Unix()})
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(claims)
+	bearer := map[string]string{"Authorization": "Bearer " + signed + "." + b64.EncodeToString(ed25519.Sign(private, []byte(signed)))}
+
+	keyFile := filepath.Join(t.TempDir(), "sharekeys")
+	writeShareKeys(t, keyFile, "the share signing key")
+	handler, dataDir := makeTestHandler(t, Options{JWT: jwt, TrashDir: t.TempDir(), ShareKeyFile: keyFile})
+	handler.(fileHandler).accounts.AddUser(auth.Account{User: "reader", Readable: []string{"/"}, Writeable: []string{"/"}})
+	writeTestFile(t, dataDir, "/docs/a.txt", "a")
+	writeTestFile(t, dataDir, "/docs/b.txt", "b")
+	link := makeShare(t, handler, "/docs/a.txt?share", "")
+	if rec := doRequest(handler, http.MethodDelete, "/docs/b.txt", "reader", "", nil); rec.Code != 204 {
+		t.Fatalf("DELETE got %d", rec.Code)
+	}
+	items := listTrash(t, handler, "/", "reader")
+	if len(items) != 1 {
+		t.Fatalf("Got %d trashed items", len(items))
+	}
+
+	// a token whose subject is the name of an account in the auth file is still another account
+	if rec := doRequest(handler, http.MethodPut, "/docs/c.txt", "", "c", bearer); rec.Code != 201 {
+		t.Fatalf("Writing with the token got %d", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodGet, "/?trash", "", "", bearer); strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("Token sees trash %s", rec.Body.String())
+	}
+	if rec := doRequest(handler, http.MethodPost, "/?untrash="+items[0].ID, "", "", bearer); rec.Code != 404 {
+		t.Errorf("Token restoring from the trash got %d", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodGet, "/docs?shares", "", "", bearer); strings.Contains(rec.Body.String(), link.ID) {
+		t.Errorf("Token sees share links %s", rec.Body.String())
+	}
+	if rec := doRequest(handler, http.MethodDelete, "/docs?share="+link.ID, "", "", bearer); rec.Code != 404 {
+		t.Errorf("Token revoking a share link got %d", rec.Code)
+	}
+}
+
+// BenchmarkBasicAuth measures small GETs authenticated with Basic auth against a bcrypt hash at the default
+// cost, checking the password every time, remembering it, and trading it for a session cookie
+func BenchmarkBasicAuth(b *testing.B) {
+	dataDir := b.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "small.txt"), []byte("small"), 0644); err != nil {
+		b.Fatal(err)
+	}
+	hash, _ := auth.HashPassword([]byte("secret"))
+
+	for _, bench := range []struct {
+		name     string
+		cacheTTL time.Duration
+		sessions bool
+	}{
+		{"bcrypt every request", 0, false},
+		{"credential cache", auth.DefaultCredentialCacheTTL, false},
+		{"session cookie", 0, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			store := auth.MakeEmptyGoCacheStore(filepath.Join(b.TempDir(), "auth.json"))
+			store.Set("alice", auth.Account{User: "alice", Readable: []string{"/"}, Hash: hash})
+			accounts := auth.MakeAuthFromStore(store)
+			accounts.SetCredentialCache(bench.cacheTTL, auth.DefaultCredentialCacheSize)
+			handler := MakeRequestHandlerWithOptions(accounts, dataDir, Options{MaxBodySize: 1 << 20, BasicSessions: bench.sessions})
+
+			var cookies []*http.Cookie
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/small.txt", nil)
+				req.SetBasicAuth("alice", "secret")
+				for _, cookie := range cookies {
+					req.AddCookie(cookie)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != 200 {
+					b.Fatalf("Got %d", rec.Code)
+				}
+				if c := rec.Result().Cookies(); len(c) > 0 {
+					cookies = c
+				}
+			}
+		})
+	}
+}
+
+func TestStaleStagingFilesRemoved(t *testing.T) {
+	_, dataDir := makeTestHandler(t, Options{})
+	writeTestFile(t, dataDir, "/a/"+stagingPrefix+"123", "partial")
+	writeTestFile(t, dataDir, "/a/keep.txt", "keep")
+
+	MakeRequestHandlerWithOptions(nil, dataDir, Options{})
+
+	if exists(dataDir, "/a/"+stagingPrefix+"123") {
+		t.Errorf("stale staging file was not removed")
+	}
+	if !exists(dataDir, "/a/keep.txt") {
+		t.Errorf("regular file was removed")
+	}
+}
+
+func TestPutVerifiesDigest(t *testing.T) {
+	// digests of "hello"
+	const md5b64 = "XUFAKrxLKna5cZ2REBfFkg=="
+	const sha256b64 = "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="
+	const sha256hex = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	var tests = []struct {
+		description string
+		headers     map[string]string
+		status      int
+	}{
+		{"no digest accepted", nil, 204},
+		{"matching Digest base64", map[string]string{"Digest": "sha-256=" + sha256b64}, 204},
+		{"matching Digest hex", map[string]string{"Digest": "SHA-256=" + sha256hex}, 204},
+		{"matching Content-Digest", map[string]string{"Content-Digest": "sha-256=:" + sha256b64 + ":"}, 204},
+		{"matching Content-MD5", map[string]string{"Content-MD5": md5b64}, 204},
+		{"unsupported algorithm ignored", map[string]string{"Content-Digest": "crc32c=:AAAAAA==:"}, 204},
+		{"mismatched Digest", map[string]string{"Digest": "md5=" + sha256b64}, 422},
+		{"mismatched Content-Digest", map[string]string{"Content-Digest": "sha-256=:" + md5b64 + ":, md5=:" + md5b64 + ":"}, 422},
+		{"mismatched Content-MD5", map[string]string{"Content-MD5": sha256b64}, 422},
+		{"malformed Content-Digest", map[string]string{"Content-Digest": "sha-256=" + sha256b64}, 400},
+		{"undecodable Digest", map[string]string{"Digest": "sha-256=not base64!"}, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			handler, dataDir := makeTestHandler(t, Options{})
+			writeTestFile(t, dataDir, "/file.txt", "original")
+
+			rec := doRequest(handler, http.MethodPut, "/file.txt", "writer", "hello", tt.headers)
+			if rec.Code != tt.status {
+				t.Errorf("got status %d; want %d", rec.Code, tt.status)
+			}
+
+			want := "original"
+			if tt.status == 204 {
+				want = "hello"
+			}
+			if got := readTestFile(t, dataDir, "/file.txt"); got != want {
+				t.Errorf("got contents %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDigestHeaders(t *testing.T) {
+	// digests of "hello"
+	const md5Field = "md5=:XUFAKrxLKna5cZ2REBfFkg==:"
+	const sha256Field = "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:"
+
+	var tests = []struct {
+		description string
+		legacy      bool
+		headers     map[string]string
+		want        map[string]string
+	}{
+		{"no digest requested", false, nil, map[string]string{"Repr-Digest": "", "Content-Digest": "", "Digest": ""}},
+		{"repr digest", false, map[string]string{"Want-Repr-Digest": "sha-256=1"}, map[string]string{"Repr-Digest": sha256Field, "Content-Digest": ""}},
+		{"content digest", false, map[string]string{"Want-Content-Digest": "sha-256=1"}, map[string]string{"Content-Digest": sha256Field, "Repr-Digest": ""}},
+		{"multiple by weight", false, map[string]string{"Want-Repr-Digest": "md5=2, sha-256=9"}, map[string]string{"Repr-Digest": sha256Field + ", " + md5Field}},
+		{"zero weight excluded", false, map[string]string{"Want-Repr-Digest": "md5=0, sha-256=9"}, map[string]string{"Repr-Digest": sha256Field}},
+		{"unsupported ignored", false, map[string]string{"Want-Repr-Digest": "crc32c=10"}, map[string]string{"Repr-Digest": ""}},
+		{"range has no content digest", false, map[string]string{"Want-Content-Digest": "sha-256=1", "Want-Repr-Digest": "md5=1", "Range": "bytes=0-1"}, map[string]string{"Content-Digest": "", "Repr-Digest": md5Field}},
+		{"legacy disabled", false, map[string]string{"Want-Digest": "sha-256"}, map[string]string{"Digest": ""}},
+		{"legacy enabled", true, map[string]string{"Want-Digest": "sha-256"}, map[string]string{"Digest": "sha-256=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			handler, dataDir := makeTestHandler(t, Options{LegacyDigest: tt.legacy})
+			writeTestFile(t, dataDir, "/file.txt", "hello")
+
+			rec := doRequest(handler, http.MethodGet, "/file.txt", "reader", "", tt.headers)
+			for k, v := range tt.want {
+				if got := rec.Header().Get(k); got != v {
+					t.Errorf("got %s %q; want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestIndex(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "digests.json")
+	index, err := MakeDigestIndex(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, dataDir := makeTestHandler(t, Options{DigestCache: index})
+
+	if rec := doRequest(handler, http.MethodPut, "/file.txt", "writer", "hello", nil); rec.Code != 201 {
+		t.Fatalf("got status %d; want 201", rec.Code)
+	}
+
+	info, _ := os.Stat(filepath.Join(dataDir, "file.txt"))
+	if got := index.Get("/file.txt", info); len(got) != len(indexedAlgorithms) {
+		t.Errorf("upload indexed %d digests; want %d", len(got), len(indexedAlgorithms))
+	}
+
+	// changes are saved together later on, or when asked to
+	if _, err := os.Stat(indexFile); !os.IsNotExist(err) {
+		t.Errorf("index saved straight away")
+	}
+	index.Save()
+	reloaded, err := MakeDigestIndex(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Get("/file.txt", info); len(got) != len(indexedAlgorithms) {
+		t.Errorf("reloaded index has %d digests; want %d", len(got), len(indexedAlgorithms))
+	}
+
+	// change the file behind the server's back, the stale digest must not be served
+	writeTestFile(t, dataDir, "/file.txt", "changed!")
+	rec := doRequest(handler, http.MethodHead, "/file.txt", "reader", "", map[string]string{"Want-Repr-Digest": "md5=1"})
+	if got := rec.Header().Get("Repr-Digest"); got != "md5=:9bvn2GDNmWB4RLmrBb4Ttw==:" {
+		t.Errorf("got Repr-Digest %q for changed file", got)
+	}
+
+	if rec := doRequest(handler, http.MethodDelete, "/file.txt", "writer", "", nil); rec.Code != 204 {
+		t.Fatalf("got status %d; want 204", rec.Code)
+	}
+	if len(index.entries) != 0 {
+		t.Errorf("deleted file is still indexed")
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	// sha-256 of "hello"
+	const etag = "\"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\""
+	const past = "Mon, 02 Jan 2006 15:04:05 GMT"
+	const future = "Fri, 01 Jan 2100 00:00:00 GMT"
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		headers     map[string]string
+		status      int
+	}{
+		{"put if-match current", http.MethodPut, "/file.txt", map[string]string{"If-Match": etag}, 204},
+		{"put if-match in list", http.MethodPut, "/file.txt", map[string]string{"If-Match": "\"other\", " + etag}, 204},
+		{"put if-match stale", http.MethodPut, "/file.txt", map[string]string{"If-Match": "\"other\""}, 412},
+		{"put if-match weak never matches", http.MethodPut, "/file.txt", map[string]string{"If-Match": "W/" + etag}, 412},
+		{"put if-match any on missing", http.MethodPut, "/missing.txt", map[string]string{"If-Match": "*"}, 412},
+		{"put create only on existing", http.MethodPut, "/file.txt", map[string]string{"If-None-Match": "*"}, 412},
+		{"put create only on missing", http.MethodPut, "/missing.txt", map[string]string{"If-None-Match": "*"}, 201},
+		{"put unmodified since future", http.MethodPut, "/file.txt", map[string]string{"If-Unmodified-Since": future}, 204},
+		{"put unmodified since past", http.MethodPut, "/file.txt", map[string]string{"If-Unmodified-Since": past}, 412},
+		{"delete if-match current", http.MethodDelete, "/file.txt", map[string]string{"If-Match": etag}, 204},
+		{"delete if-match stale", http.MethodDelete, "/file.txt", map[string]string{"If-Match": "\"other\""}, 412},
+		{"delete unmodified since past", http.MethodDelete, "/file.txt", map[string]string{"If-Unmodified-Since": past}, 412},
+		{"get if-none-match current", http.MethodGet, "/file.txt", map[string]string{"If-None-Match": etag}, 304},
+		{"get if-match stale", http.MethodGet, "/file.txt", map[string]string{"If-Match": "\"other\""}, 412},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			handler, dataDir := makeTestHandler(t, Options{DigestCache: MakeEmptyDigestIndex()})
+			writeTestFile(t, dataDir, "/file.txt", "hello")
+
+			rec := doRequest(handler, tt.method, tt.target, "writer", "new contents", tt.headers)
+			if rec.Code != tt.status {
+				t.Errorf("got status %d; want %d", rec.Code, tt.status)
+			}
+			if tt.method != http.MethodDelete && rec.Code < 300 && rec.Header().Get("ETag") == "" {
+				t.Errorf("no ETag in response")
+			}
+		})
+	}
+
+	// the default handler has no DigestCache, and hashes the file instead
+	dataDir := t.TempDir()
+	writeTestFile(t, dataDir, "/file.txt", "hello")
+	store := auth.MakeEmptyGoCacheStore(filepath.Join(t.TempDir(), "auth.json"))
+	store.Set(reader.User, reader)
+	handler := MakeRequestHandler(auth.MakeAuthFromStore(store), dataDir, 1<<20, true)
+	if rec := doRequest(handler, http.MethodGet, "/file.txt", "reader", "", nil); rec.Header().Get("ETag") != etag {
+		t.Errorf("Got ETag %q without a DigestCache", rec.Header().Get("ETag"))
+	}
+	if rec := doRequest(handler, http.MethodGet, "/file.txt", "reader", "", map[string]string{"If-None-Match": etag}); rec.Code != 304 {
+		t.Errorf("Got %d for If-None-Match without a DigestCache", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodHead, "/file.txt", "reader", "", map[string]string{"If-Match": "\"other\""}); rec.Code != 412 {
+		t.Errorf("Got %d for a stale If-Match without a DigestCache", rec.Code)
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	tusDir := t.TempDir()
+	handler, dataDir := makeTestHandler(t, Options{TusDir: tusDir})
+	tus := map[string]string{"Tus-Resumable": tusVersion}
+	patch := func(offset string, checksum string) map[string]string {
+		headers := map[string]string{"Tus-Resumable": tusVersion, "Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}
+		if checksum != "" {
+			headers["Upload-Checksum"] = checksum
+		}
+		return headers
+	}
+
+	if rec := doRequest(handler, http.MethodOptions, "/", "writer", "", nil); !strings.Contains(rec.Header().Get("Tus-Extension"), "checksum") {
+		t.Errorf("OPTIONS did not advertise tus extensions")
+	}
+
+	create := map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "11", "Upload-Metadata": "filename aGVsbG8udHh0"}
+	if rec := doRequest(handler, http.MethodPost, "/up", "reader", "", create); rec.Code != 401 {
+		t.Errorf("reader created an upload with status %d", rec.Code)
+	}
+	os.Mkdir(filepath.Join(dataDir, "up"), os.ModePerm)
+	rec := doRequest(handler, http.MethodPost, "/up", "writer", "", create)
+	if rec.Code != 201 {
+		t.Fatalf("got create status %d; want 201", rec.Code)
+	}
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, "/up/hello.txt?tus=") {
+		t.Fatalf("got Location %q", location)
+	}
+
+	if rec := doRequest(handler, http.MethodPatch, location, "writer", "hello", patch("0", "")); rec.Code != 204 || rec.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("got first chunk status %d offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := doRequest(handler, http.MethodPatch, location, "writer", "hello", patch("0", "")); rec.Code != 409 {
+		t.Errorf("got status %d for wrong offset; want 409", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPatch, location, "reader", " world", patch("5", "")); rec.Code != 401 {
+		t.Errorf("got status %d for another account; want 401", rec.Code)
+	}
+	// the sha1 of "hello" rather than " world"
+	if rec := doRequest(handler, http.MethodPatch, location, "writer", " world", patch("5", "sha1 qvTGHdzF6KLavt4PO0gs2a6pQ00=")); rec.Code != 460 {
+		t.Errorf("got status %d for bad checksum; want 460", rec.Code)
+	}
+
+	// a restarted server picks the upload up where it left off
+	handler = MakeRequestHandlerWithOptions(handler.(fileHandler).accounts, dataDir, Options{MaxBodySize: 1 << 20, TusDir: tusDir})
+	if rec := doRequest(handler, http.MethodHead, location, "writer", "", tus); rec.Code != 200 || rec.Header().Get("Upload-Offset") != "5" || rec.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("got HEAD status %d offset %q length %q", rec.Code, rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+
+	if rec := doRequest(handler, http.MethodPatch, location, "writer", " world!", patch("5", "")); rec.Code != 413 {
+		t.Errorf("got status %d for overlong chunk; want 413", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPatch, location, "writer", " world", patch("5", "sha1 P4InJqDJ+1VmGOnLl/tkL372LW8=")); rec.Code != 204 || rec.Header().Get("ETag") == "" {
+		t.Fatalf("got final chunk status %d", rec.Code)
+	}
+	if got := readTestFile(t, dataDir, "/up/hello.txt"); got != "hello world" {
+		t.Errorf("got contents %q", got)
+	}
+	if rec := doRequest(handler, http.MethodHead, location, "writer", "", tus); rec.Code != 404 {
+		t.Errorf("got HEAD status %d for finished upload; want 404", rec.Code)
+	}
+}
+
+func TestTusChecksLikePut(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{TusDir: t.TempDir()})
+	handler.(fileHandler).accounts.AddUser(auth.Account{User: "quota", Readable: []string{"/"}, Writeable: []string{"/home"}, QuotaBytes: 10})
+	patch := func(offset string, extra map[string]string) map[string]string {
+		headers := map[string]string{"Tus-Resumable": tusVersion, "Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}
+		for k, v := range extra {
+			headers[k] = v
+		}
+		return headers
+	}
+	create := func(target string, user string, length string, extra map[string]string) *httptest.ResponseRecorder {
+		headers := map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": length}
+		for k, v := range extra {
+			headers[k] = v
+		}
+		return doRequest(handler, http.MethodPost, target, user, "", headers)
+	}
+
+	// the preconditions of the creation still have to hold when the upload completes
+	writeTestFile(t, dataDir, "/exists.txt", "old")
+	if rec := create("/exists.txt", "writer", "5", map[string]string{"If-None-Match": "*"}); rec.Code != 412 {
+		t.Errorf("got create status %d over an existing file; want 412", rec.Code)
+	}
+	rec := create("/new.txt", "writer", "5", map[string]string{"If-None-Match": "*"})
+	if rec.Code != 201 {
+		t.Fatalf("got create status %d; want 201", rec.Code)
+	}
+	location := rec.Header().Get("Location")
+	if rec := doRequest(handler, http.MethodPut, "/new.txt", "writer", "first", nil); rec.Code != 201 {
+		t.Fatalf("got PUT status %d", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPatch, location, "writer", "later", patch("0", nil)); rec.Code != 412 {
+		t.Errorf("got final chunk status %d after the file was created; want 412", rec.Code)
+	}
+	if got := readTestFile(t, dataDir, "/new.txt"); got != "first" {
+		t.Errorf("upload replaced the file with %q", got)
+	}
+
+	// a WebDAV lock held by someone else stops the upload until its token is given
+	lock := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>test</D:owner></D:lockinfo>`
+	location = create("/locked.txt", "writer", "5", nil).Header().Get("Location")
+	rec = doRequest(handler, "LOCK", "/locked.txt", "writer", lock, nil)
+	if rec.Code != 200 && rec.Code != 201 {
+		t.Fatalf("got LOCK status %d", rec.Code)
+	}
+	token := rec.Header().Get("Lock-Token")
+	if rec := create("/locked.txt", "writer", "5", nil); rec.Code != 423 {
+		t.Errorf("got create status %d for a locked file; want 423", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPatch, location, "writer", "hello", patch("0", nil)); rec.Code != 423 {
+		t.Errorf("got chunk status %d for a locked file; want 423", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPatch, location, "writer", "hello", patch("0", map[string]string{"If": "(" + token + ")"})); rec.Code != 204 {
+		t.Errorf("got chunk status %d with the lock token; want 204", rec.Code)
+	}
+
+	// the quota is checked before every chunk, not only once the upload is complete
+	location = create("/home/big.txt", "quota", "8", nil).Header().Get("Location")
+	if rec := doRequest(handler, http.MethodPatch, location, "quota", "1234", patch("0", nil)); rec.Code != 204 {
+		t.Fatalf("got first chunk status %d; want 204", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPut, "/home/small.txt", "quota", "12345", nil); rec.Code != 201 {
+		t.Fatalf("got PUT status %d", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPatch, location, "quota", "5678", patch("4", nil)); rec.Code != 507 {
+		t.Errorf("got chunk status %d over quota; want 507", rec.Code)
+	}
+	if exists(dataDir, "/home/big.txt") {
+		t.Errorf("upload over quota was stored")
+	}
+}
+
+func TestTusTermination(t *testing.T) {
+	handler, _ := makeTestHandler(t, Options{TusDir: t.TempDir(), TusExpiry: time.Nanosecond})
+	create := map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "5"}
+	tus := map[string]string{"Tus-Resumable": tusVersion}
+
+	rec := doRequest(handler, http.MethodPost, "/expiring.txt", "writer", "", create)
+	if rec.Code != 201 {
+		t.Fatalf("got create status %d; want 201", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodHead, rec.Header().Get("Location"), "writer", "", tus); rec.Code != 410 {
+		t.Errorf("got status %d for expired upload; want 410", rec.Code)
+	}
+
+	handler, _ = makeTestHandler(t, Options{TusDir: t.TempDir()})
+	rec = doRequest(handler, http.MethodPost, "/deleted.txt", "writer", "", create)
+	location := rec.Header().Get("Location")
+	if rec := doRequest(handler, http.MethodDelete, location, "writer", "", tus); rec.Code != 204 {
+		t.Errorf("got terminate status %d; want 204", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodHead, location, "writer", "", tus); rec.Code != 404 {
+		t.Errorf("got status %d for terminated upload; want 404", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPost, "/deleted.txt", "writer", "", map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "5"}); rec.Code != 412 {
+		t.Errorf("got status %d for unsupported version; want 412", rec.Code)
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		user        string
+		body        string
+		headers     map[string]string
+		status      int
+		contains    string
+	}{
+		{"propfind lists children", "PROPFIND", "/a", "reader", "", map[string]string{"Depth": "1"}, 207, "/a/file.txt"},
+		{"propfind hides staging files", "PROPFIND", "/a", "reader", "", map[string]string{"Depth": "1"}, 207, ""},
+		{"propfind needs read", "PROPFIND", "/a", "", "", map[string]string{"Depth": "0"}, 401, ""},
+		{"mkcol creates", "MKCOL", "/a/new", "writer", "", nil, 201, ""},
+		{"mkcol needs write", "MKCOL", "/a/new", "reader", "", nil, 401, ""},
+		{"copy to writeable", "COPY", "/a/file.txt", "writer", "", map[string]string{"Destination": "http://example.com/b/copy.txt"}, 201, ""},
+		{"copy needs write on destination", "COPY", "/a/file.txt", "reader", "", map[string]string{"Destination": "http://example.com/b/copy.txt"}, 401, ""},
+		{"copy into read only path", "COPY", "/a/file.txt", "limited", "", map[string]string{"Destination": "http://example.com/a/copy.txt"}, 401, ""},
+		{"move needs write on source", "MOVE", "/a/file.txt", "limited", "", map[string]string{"Destination": "http://example.com/b/moved.txt"}, 401, ""},
+		{"move to writeable", "MOVE", "/a/file.txt", "writer", "", map[string]string{"Destination": "http://example.com/b/moved.txt"}, 201, ""},
+		{"delete collection with depth", http.MethodDelete, "/a", "writer", "", map[string]string{"Depth": "infinity"}, 204, ""},
+	}
+
+	limited := auth.Account{User: "limited", Readable: []string{"/"}, Writeable: []string{"/b"}}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			handler, dataDir := makeTestHandler(t, Options{})
+			handler.(fileHandler).accounts.AddUser(limited)
+			writeTestFile(t, dataDir, "/a/file.txt", "hello")
+			writeTestFile(t, dataDir, "/a/"+stagingPrefix+"1", "partial")
+			os.Mkdir(filepath.Join(dataDir, "b"), os.ModePerm)
+
+			rec := doRequest(handler, tt.method, tt.target, tt.user, tt.body, tt.headers)
+			if rec.Code != tt.status {
+				t.Errorf("got status %d; want %d", rec.Code, tt.status)
+			}
+			if tt.contains != "" && !strings.Contains(rec.Body.String(), tt.contains) {
+				t.Errorf("response does not contain %q: %s", tt.contains, rec.Body.String())
+			}
+			if strings.Contains(rec.Body.String(), stagingPrefix) {
+				t.Errorf("response shows a staging file: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebDAVPropsAndLocks(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{DavPropsFile: filepath.Join(t.TempDir(), "props.json")})
+	writeTestFile(t, dataDir, "/doc.txt", "hello")
+
+	proppatch := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:example"><D:set><D:prop><Z:colour>blue</Z:colour></D:prop></D:set></D:propertyupdate>`
+	if rec := doRequest(handler, "PROPPATCH", "/doc.txt", "reader", proppatch, nil); rec.Code != 401 {
+		t.Errorf("got PROPPATCH status %d for reader; want 401", rec.Code)
+	}
+	if rec := doRequest(handler, "PROPPATCH", "/doc.txt", "writer", proppatch, nil); rec.Code != 207 {
+		t.Fatalf("got PROPPATCH status %d; want 207", rec.Code)
+	}
+
+	// properties survive a restart and follow a move
+	handler = MakeRequestHandlerWithOptions(handler.(fileHandler).accounts, dataDir, Options{MaxBodySize: 1 << 20, DavPropsFile: handler.(fileHandler).DavPropsFile})
+	if rec := doRequest(handler, "MOVE", "/doc.txt", "writer", "", map[string]string{"Destination": "/moved.txt"}); rec.Code != 201 {
+		t.Fatalf("got MOVE status %d; want 201", rec.Code)
+	}
+	propfind := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`
+	if rec := doRequest(handler, "PROPFIND", "/moved.txt", "reader", propfind, map[string]string{"Depth": "0"}); !strings.Contains(rec.Body.String(), "blue") {
+		t.Errorf("dead property missing from PROPFIND: %s", rec.Body.String())
+	}
+
+	lock := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>test</D:owner></D:lockinfo>`
+	rec := doRequest(handler, "LOCK", "/moved.txt", "writer", lock, nil)
+	if rec.Code != 200 {
+		t.Fatalf("got LOCK status %d; want 200", rec.Code)
+	}
+	token := rec.Header().Get("Lock-Token")
+
+	if rec := doRequest(handler, http.MethodPut, "/moved.txt", "writer", "clobber", nil); rec.Code != 423 {
+		t.Errorf("got PUT status %d without lock token; want 423", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodDelete, "/moved.txt", "writer", "", nil); rec.Code != 423 {
+		t.Errorf("got DELETE status %d without lock token; want 423", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPut, "/moved.txt", "writer", "updated", map[string]string{"If": "(" + token + ")"}); rec.Code != 204 {
+		t.Errorf("got PUT status %d with lock token; want 204", rec.Code)
+	}
+	if rec := doRequest(handler, "UNLOCK", "/moved.txt", "writer", "", map[string]string{"Lock-Token": token}); rec.Code != 204 {
+		t.Errorf("got UNLOCK status %d; want 204", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodPut, "/moved.txt", "writer", "final", nil); rec.Code != 204 {
+		t.Errorf("got PUT status %d after unlock; want 204", rec.Code)
+	}
+
+	if rec := doRequest(handler, http.MethodOptions, "/", "reader", "", nil); rec.Header().Get("DAV") != "1, 2" {
+		t.Errorf("OPTIONS did not advertise DAV: got %q", rec.Header().Get("DAV"))
+	}
+}
@@ -1,5 +1,8 @@
 module github.com/zggz/securefileserver/pkg/fileserver
 
-go 1.15
+go 1.16
 
-require github.com/zggz/securefileserver/auth v0.0.0-20201017040310-f6934374b054
+require (
+	github.com/zggz/securefileserver/auth v0.0.0-20201017040310-f6934374b054
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+)
@@ -8,48 +8,141 @@ import (
 	"encoding/hex"
 	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 )
 
-// Source: https://mrwaggel.be/post/generate-md5-hash-of-a-file-in-golang/
-func hashFile(f *os.File, h hash.Hash, name string) (string, error) {
-	var returnString string
+// hashAlgorithms maps the lowercase digest algorithm names we support to their implementation
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-1":   sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// indexedAlgorithms are computed while every upload streams in when a DigestCache is configured
+var indexedAlgorithms = []string{"md5", "sha-1", "sha-256", "sha-512"}
 
-	if _, err := io.Copy(h, f); err != nil {
-		return returnString, err
+// canonicalAlgorithm maps the aliases in hashAlgorithms onto the one name digests are stored under
+func canonicalAlgorithm(name string) string {
+	name = strings.ToLower(name)
+	if name == "sha" {
+		return "sha-1"
 	}
+	return name
+}
 
-	hashInBytes := h.Sum(nil)
+// digestSet hashes a stream with several algorithms at once, keyed by canonical name
+type digestSet map[string]hash.Hash
 
-	returnString = hex.EncodeToString(hashInBytes)
+func newDigestSet(algorithms []string) digestSet {
+	set := make(digestSet, len(algorithms))
+	for _, a := range algorithms {
+		a = canonicalAlgorithm(a)
+		if newHash, ok := hashAlgorithms[a]; ok {
+			set[a] = newHash()
+		}
+	}
+	return set
+}
 
-	return name + "=" + returnString, nil
+// writer returns a writer which writes to w as well as every hash in the set
+func (set digestSet) writer(w io.Writer) io.Writer {
+	writers := []io.Writer{w}
+	for _, h := range set {
+		writers = append(writers, h)
+	}
+	return io.MultiWriter(writers...)
 }
 
-// GetHashes gets the hash of a file given an array of in order prefered hash types
-// will return the hash as [hashtype]=[hash] where hashtype is the first supported
-// type in the wantDigest array. If no types are supported, an md5 hash is returned
-func getHashes(filePath string, wantDigest []string) (string, error) {
-	file, err := os.Open(filePath)
+func (set digestSet) sums() map[string][]byte {
+	sums := make(map[string][]byte, len(set))
+	for a, h := range set {
+		sums[a] = h.Sum(nil)
+	}
+	return sums
+}
+
+// digestStorage is a Storage which records the digests of files as they are written
+type digestStorage interface {
+	// storedDigests returns the digests recorded with the file info describes, keyed by canonical algorithm name
+	storedDigests(info os.FileInfo) map[string][]byte
+}
+
+// fileDigests returns the digest of the file name for each algorithm keyed by canonical name. Digests are taken
+// from the storage or the DigestCache when they have them for this version of the file, and anything missing
+// is computed with a single read of the file and stored back
+func (h fileHandler) fileDigests(name string, algorithms []string) (map[string][]byte, error) {
+	file, err := h.storage.Open(name)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
 
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[string][]byte, len(algorithms))
+	var stored, cached map[string][]byte
+	if ds, ok := h.storage.(digestStorage); ok {
+		stored = ds.storedDigests(info)
+	}
+	if h.DigestCache != nil {
+		cached = h.DigestCache.Get(name, info)
+	}
+	for _, a := range algorithms {
+		a = canonicalAlgorithm(a)
+		if sum, ok := stored[a]; ok {
+			digests[a] = sum
+		} else if sum, ok := cached[a]; ok {
+			digests[a] = sum
+		}
+	}
+
+	var missing []string
+	for _, a := range algorithms {
+		if _, ok := digests[canonicalAlgorithm(a)]; !ok {
+			missing = append(missing, a)
+		}
+	}
+	if len(missing) == 0 {
+		return digests, nil
+	}
+
+	set := newDigestSet(missing)
+	if _, err := io.Copy(set.writer(ioutil.Discard), file); err != nil {
+		return nil, err
+	}
+	computed := set.sums()
+	for a, sum := range computed {
+		digests[a] = sum
+	}
+
+	if h.DigestCache != nil {
+		h.DigestCache.Set(name, info, computed)
+	}
+	return digests, nil
+}
+
+// GetHashes gets the hash of a file given an array of in order prefered hash types
+// will return the hash as [hashtype]=[hash] where hashtype is the first supported
+// type in the wantDigest array. If no types are supported, an md5 hash is returned
+func (h fileHandler) getHashes(fileName string, wantDigest []string) (string, error) {
+	name := "MD5"
 	for _, d := range wantDigest {
-		switch strings.ToLower(d) {
-		case "md5":
-			return hashFile(file, md5.New(), d)
-		case "sha":
-			fallthrough
-		case "sha-1":
-			return hashFile(file, sha1.New(), d)
-		case "sha-256":
-			return hashFile(file, sha256.New(), d)
-		case "sha-512":
-			return hashFile(file, sha512.New(), d)
+		if _, ok := hashAlgorithms[strings.ToLower(d)]; ok {
+			name = d
+			break
 		}
 	}
-	return hashFile(file, md5.New(), "MD5")
+
+	digests, err := h.fileDigests(fileName, []string{name})
+	if err != nil {
+		return "", err
+	}
+	return name + "=" + hex.EncodeToString(digests[canonicalAlgorithm(name)]), nil
 }
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package fileserver
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode returns the inode number of the file, so a file replaced behind our back is noticed
+// even if it has the same size and modification time
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
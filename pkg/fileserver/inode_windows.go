@@ -0,0 +1,8 @@
+package fileserver
+
+import "os"
+
+// inode is not available from os.FileInfo on windows, so changes are detected by size and modification time only
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,224 @@
+package fileserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+const (
+	// defaultListLimit is the page size when the client doesn't ask for one
+	defaultListLimit = 1000
+	// maxListLimit caps how many entries a single page can hold
+	maxListLimit = 10000
+	// maxListDepth caps how far a recursive listing descends
+	maxListDepth = 32
+)
+
+// listEntry is one file or directory in a JSON listing
+type listEntry struct {
+	Name     string            `json:"name"`
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`
+	Size     int64             `json:"size"`
+	ModTime  time.Time         `json:"mtime"`
+	Mode     string            `json:"mode"`
+	Digests  map[string]string `json:"digests,omitempty"`
+	CanRead  bool              `json:"canRead"`
+	CanWrite bool              `json:"canWrite"`
+}
+
+type listResponse struct {
+	Path       string      `json:"path"`
+	Entries    []listEntry `json:"entries"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// listCursor marks the last entry of a page, so the next page starts after it even if entries were added or removed
+type listCursor struct {
+	Path    string    `json:"p"`
+	Size    int64     `json:"s"`
+	ModTime time.Time `json:"m"`
+}
+
+// wantsJSONListing returns true if the client asked for a directory as JSON rather than HTML
+func wantsJSONListing(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+func entryType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
+// listCompare returns the order function for a sort field, ties broken by path so the order is total
+func listCompare(field string) func(a, b listEntry) bool {
+	switch field {
+	case "size":
+		return func(a, b listEntry) bool {
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+			return a.Path < b.Path
+		}
+	case "mtime":
+		return func(a, b listEntry) bool {
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+			return a.Path < b.Path
+		}
+	default:
+		return func(a, b listEntry) bool { return a.Path < b.Path }
+	}
+}
+
+// collectEntries reads the directory at relativePath and, while depth allows, the directories under it.
+// Symlinked directories are listed but never followed
+func (h fileHandler) collectEntries(relativePath string, depth int, user auth.Account, entries []listEntry) ([]listEntry, error) {
+	infos, err := h.storage.ReadDir(relativePath)
+	if err != nil {
+		return entries, err
+	}
+
+	for _, info := range infos {
+		childPath := path.Join(relativePath, info.Name())
+		if isStagingName(info.Name()) || !user.CanRead(childPath) {
+			continue
+		}
+
+		entry := listEntry{
+			Name:     info.Name(),
+			Path:     childPath,
+			Type:     entryType(info.Mode()),
+			Size:     info.Size(),
+			ModTime:  info.ModTime().UTC(),
+			Mode:     info.Mode().String(),
+			CanRead:  true,
+			CanWrite: user.CanWrite(childPath),
+		}
+		if h.DigestCache != nil && info.Mode().IsRegular() {
+			if cached := h.DigestCache.Get(childPath, info); len(cached) > 0 {
+				entry.Digests = make(map[string]string, len(cached))
+				for a, sum := range cached {
+					entry.Digests[a] = base64.StdEncoding.EncodeToString(sum)
+				}
+			}
+		}
+		entries = append(entries, entry)
+
+		if info.IsDir() && depth > 1 {
+			// an unreadable subdirectory shouldn't fail the whole listing
+			entries, _ = h.collectEntries(childPath, depth-1, user, entries)
+		}
+	}
+	return entries, nil
+}
+
+// listHandler answers a GET of a directory with its entries as JSON. Query parameters:
+// sort=name|size|mtime, order=asc|desc, limit=N, cursor=<nextCursor of the previous page>,
+// recursive=true and depth=N to descend into subdirectories
+func (h fileHandler) listHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	query := r.URL.Query()
+
+	limit := defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	depth := 1
+	if recursive, _ := strconv.ParseBool(query.Get("recursive")); recursive {
+		depth = maxListDepth
+		if value := query.Get("depth"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid depth", 400)
+				return
+			}
+			if n < depth {
+				depth = n
+			}
+		}
+	}
+
+	field := query.Get("sort")
+	if field != "" && field != "name" && field != "size" && field != "mtime" {
+		http.Error(w, "Invalid sort", 400)
+		return
+	}
+	less := listCompare(field)
+	if order := query.Get("order"); order == "desc" {
+		ascending := less
+		less = func(a, b listEntry) bool { return ascending(b, a) }
+	} else if order != "" && order != "asc" {
+		http.Error(w, "Invalid order", 400)
+		return
+	}
+
+	entries, err := h.collectEntries(relativePath, depth, user, nil)
+	if err != nil {
+		http.Error(w, "Could not read directory", 500)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+
+	start := 0
+	if value := query.Get("cursor"); value != "" {
+		var cursor listCursor
+		data, decodeerr := base64.RawURLEncoding.DecodeString(value)
+		if decodeerr == nil {
+			decodeerr = json.Unmarshal(data, &cursor)
+		}
+		if decodeerr != nil {
+			http.Error(w, "Invalid cursor", 400)
+			return
+		}
+		last := listEntry{Path: cursor.Path, Size: cursor.Size, ModTime: cursor.ModTime}
+		start = sort.Search(len(entries), func(i int) bool { return less(last, entries[i]) })
+	}
+
+	response := listResponse{Path: relativePath, Entries: entries[start:]}
+	if len(response.Entries) > limit {
+		response.Entries = response.Entries[:limit]
+		last := response.Entries[limit-1]
+		data, _ := json.Marshal(listCursor{Path: last.Path, Size: last.Size, ModTime: last.ModTime})
+		response.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	if response.Entries == nil {
+		response.Entries = []listEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,137 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+func decodeListing(t *testing.T, handler http.Handler, target string, user string, headers map[string]string) listResponse {
+	rec := doRequest(handler, http.MethodGet, target, user, "", headers)
+	if rec.Code != 200 {
+		t.Fatalf("got status %d; want 200", rec.Code)
+	}
+	var response listResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	return response
+}
+
+func listedPaths(response listResponse) []string {
+	paths := make([]string, len(response.Entries))
+	for i, e := range response.Entries {
+		paths[i] = e.Path
+	}
+	return paths
+}
+
+func TestJSONListing(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{DigestCache: MakeEmptyDigestIndex()})
+	writeTestFile(t, dataDir, "/d/b.txt", "bb")
+	writeTestFile(t, dataDir, "/d/a.txt", "aaa")
+	writeTestFile(t, dataDir, "/d/c/deep.txt", "d")
+	writeTestFile(t, dataDir, "/d/c/e/deeper.txt", "e")
+	writeTestFile(t, dataDir, "/d/"+stagingPrefix+"1", "partial")
+	writeTestFile(t, dataDir, "/s/small", "1")
+	writeTestFile(t, dataDir, "/s/large", "333")
+	writeTestFile(t, dataDir, "/s/medium", "22")
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dataDir, "d", "b.txt"), old, old)
+	doRequest(handler, http.MethodHead, "/d/a.txt", "reader", "", map[string]string{"Want-Repr-Digest": "sha-256=1"})
+
+	var tests = []struct {
+		description string
+		target      string
+		want        []string
+	}{
+		{"sorted by name", "/d?format=json", []string{"/d/a.txt", "/d/b.txt", "/d/c"}},
+		{"sorted by size descending", "/s?format=json&sort=size&order=desc", []string{"/s/large", "/s/medium", "/s/small"}},
+		{"sorted by mtime", "/d?format=json&sort=mtime&limit=1", []string{"/d/b.txt"}},
+		{"recursive with depth", "/d?format=json&recursive=true&depth=2", []string{"/d/a.txt", "/d/b.txt", "/d/c", "/d/c/deep.txt", "/d/c/e"}},
+		{"recursive unlimited", "/d/c?format=json&recursive=true", []string{"/d/c/deep.txt", "/d/c/e", "/d/c/e/deeper.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			got := listedPaths(decodeListing(t, handler, tt.target, "reader", nil))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v; want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v; want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+
+	response := decodeListing(t, handler, "/d", "reader", map[string]string{"Accept": "text/html;q=0.5, application/json"})
+	if response.Entries[0].Digests["sha-256"] == "" {
+		t.Errorf("cached digest missing from listing")
+	}
+	if response.Entries[0].CanWrite || !response.Entries[0].CanRead {
+		t.Errorf("got permissions read %v write %v for reader", response.Entries[0].CanRead, response.Entries[0].CanWrite)
+	}
+	if response.Entries[2].Type != "dir" {
+		t.Errorf("got type %q for directory", response.Entries[2].Type)
+	}
+}
+
+func TestJSONListingPagination(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{})
+	names := []string{"/p/1", "/p/2", "/p/3", "/p/4", "/p/5"}
+	for _, name := range names {
+		writeTestFile(t, dataDir, name, name)
+	}
+
+	var got []string
+	target := "/p?format=json&limit=2"
+	for pages := 0; pages < 5; pages++ {
+		response := decodeListing(t, handler, target, "reader", nil)
+		got = append(got, listedPaths(response)...)
+		if response.NextCursor == "" {
+			break
+		}
+		// a file removed between pages doesn't shift the next page
+		os.Remove(filepath.Join(dataDir, "p", "1"))
+		target = "/p?format=json&limit=2&cursor=" + response.NextCursor
+	}
+
+	if len(got) != len(names) {
+		t.Fatalf("got %v; want %v", got, names)
+	}
+	for i := range got {
+		if got[i] != names[i] {
+			t.Fatalf("got %v; want %v", got, names)
+		}
+	}
+
+	if rec := doRequest(handler, http.MethodGet, "/p?format=json&cursor=!!", "reader", "", nil); rec.Code != 400 {
+		t.Errorf("got status %d for invalid cursor; want 400", rec.Code)
+	}
+}
+
+func TestJSONListingPermissions(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{})
+	handler.(fileHandler).accounts.AddUser(auth.Account{User: "mixed", Readable: []string{"/m"}, Writeable: []string{"/m/w"}})
+	writeTestFile(t, dataDir, "/m/r.txt", "r")
+	writeTestFile(t, dataDir, "/m/w/f.txt", "w")
+
+	response := decodeListing(t, handler, "/m?format=json&recursive=true", "mixed", nil)
+	for _, e := range response.Entries {
+		if want := e.Path != "/m/r.txt"; e.CanWrite != want {
+			t.Errorf("got canWrite %v for %s; want %v", e.CanWrite, e.Path, want)
+		}
+	}
+
+	if rec := doRequest(handler, http.MethodGet, "/?format=json", "mixed", "", nil); rec.Code != 401 {
+		t.Errorf("got status %d listing unreadable directory; want 401", rec.Code)
+	}
+}
@@ -0,0 +1,270 @@
+package fileserver
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memNode is a file or directory held by MemStorage
+type memNode struct {
+	data    []byte
+	dir     bool
+	modTime time.Time
+}
+
+// memFileInfo describes a memNode
+type memFileInfo struct {
+	name string
+	node *memNode
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return int64(len(info.node.data)) }
+func (info memFileInfo) ModTime() time.Time { return info.node.modTime }
+func (info memFileInfo) IsDir() bool        { return info.node.dir }
+func (info memFileInfo) Sys() interface{}   { return nil }
+
+func (info memFileInfo) Mode() os.FileMode {
+	if info.node.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// MemStorage implements Storage in memory, for tests and for embedding the handler without a disk
+type MemStorage struct {
+	lock  sync.RWMutex
+	nodes map[string]*memNode
+}
+
+// MakeMemStorage creates an empty MemStorage
+func MakeMemStorage() *MemStorage {
+	return &MemStorage{nodes: map[string]*memNode{"/": {dir: true, modTime: time.Now()}}}
+}
+
+func memName(name string) string {
+	return path.Clean("/" + name)
+}
+
+func memInfo(name string, node *memNode) memFileInfo {
+	return memFileInfo{name: path.Base(name), node: node}
+}
+
+// isUnder returns true if name is inside the directory dir
+func isUnder(name string, dir string) bool {
+	return (dir == "/" && name != "/") || strings.HasPrefix(name, dir+"/")
+}
+
+// Open returns a reader of a snapshot of the file, so writes committed meanwhile don't affect it
+func (storage *MemStorage) Open(name string) (StorageFile, error) {
+	name = memName(name)
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	node, found := storage.nodes[name]
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{Reader: bytes.NewReader(node.data), info: memInfo(name, node)}, nil
+}
+
+// Stat describes the file or directory
+func (storage *MemStorage) Stat(name string) (os.FileInfo, error) {
+	name = memName(name)
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	node, found := storage.nodes[name]
+	if !found {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memInfo(name, node), nil
+}
+
+// ReadDir lists the directory sorted by name
+func (storage *MemStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	name = memName(name)
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	if node, found := storage.nodes[name]; !found || !node.dir {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for child, node := range storage.nodes {
+		if path.Dir(child) == name && child != "/" {
+			infos = append(infos, memInfo(child, node))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Create buffers the file in memory until it is committed
+func (storage *MemStorage) Create(name string) (StagedFile, error) {
+	name = memName(name)
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	if parent, found := storage.nodes[path.Dir(name)]; !found || !parent.dir {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrNotExist}
+	}
+	return &memStagedFile{storage: storage, name: name}, nil
+}
+
+// MkdirAll creates the directory and any parents it needs
+func (storage *MemStorage) MkdirAll(name string) error {
+	name = memName(name)
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	for dir := name; ; dir = path.Dir(dir) {
+		if node, found := storage.nodes[dir]; found {
+			if !node.dir {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+			}
+			break
+		}
+	}
+	for dir := name; storage.nodes[dir] == nil; dir = path.Dir(dir) {
+		storage.nodes[dir] = &memNode{dir: true, modTime: time.Now()}
+	}
+	return nil
+}
+
+// Rename moves a file or a directory with everything in it
+func (storage *MemStorage) Rename(oldName string, newName string) error {
+	oldName, newName = memName(oldName), memName(newName)
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	node, found := storage.nodes[oldName]
+	if !found {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if parent, found := storage.nodes[path.Dir(newName)]; !found || !parent.dir {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if oldName == "/" || isUnder(newName, oldName) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrInvalid}
+	}
+	if existing, found := storage.nodes[newName]; found && existing.dir {
+		// like rename(2), only an empty directory can be replaced, and only by a directory
+		if !node.dir || storage.hasChildren(newName) {
+			return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrExist}
+		}
+	}
+
+	moved := map[string]*memNode{newName: node}
+	for name, child := range storage.nodes {
+		if isUnder(name, oldName) {
+			moved[newName+strings.TrimPrefix(name, oldName)] = child
+		}
+	}
+	for name := range storage.nodes {
+		if name == oldName || isUnder(name, oldName) {
+			delete(storage.nodes, name)
+		}
+	}
+	for name, child := range moved {
+		storage.nodes[name] = child
+	}
+	return nil
+}
+
+// hasChildren returns true if the directory has anything in it. Must be called with the lock held
+func (storage *MemStorage) hasChildren(dir string) bool {
+	for name := range storage.nodes {
+		if isUnder(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes a file or an empty directory
+func (storage *MemStorage) Remove(name string) error {
+	name = memName(name)
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	node, found := storage.nodes[name]
+	if !found {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if name == "/" || (node.dir && storage.hasChildren(name)) {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(storage.nodes, name)
+	return nil
+}
+
+// RemoveAll removes a file or a directory and everything in it
+func (storage *MemStorage) RemoveAll(name string) error {
+	name = memName(name)
+	if name == "/" {
+		return &os.PathError{Op: "removeall", Path: name, Err: os.ErrInvalid}
+	}
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	for child := range storage.nodes {
+		if child == name || isUnder(child, name) {
+			delete(storage.nodes, child)
+		}
+	}
+	return nil
+}
+
+// memFile reads a snapshot of a MemStorage file
+type memFile struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: f.info.name, Err: errors.New("is a directory")}
+	}
+	return f.Reader.Read(p)
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+// memStagedFile buffers a file until it is committed to MemStorage
+type memStagedFile struct {
+	bytes.Buffer
+	storage *MemStorage
+	name    string
+}
+
+func (f *memStagedFile) Commit() (os.FileInfo, error) {
+	f.storage.lock.Lock()
+	defer f.storage.lock.Unlock()
+
+	if parent, found := f.storage.nodes[path.Dir(f.name)]; !found || !parent.dir {
+		return nil, &os.PathError{Op: "commit", Path: f.name, Err: os.ErrNotExist}
+	}
+	if existing, found := f.storage.nodes[f.name]; found && existing.dir {
+		return nil, &os.PathError{Op: "commit", Path: f.name, Err: errors.New("is a directory")}
+	}
+	node := &memNode{data: f.Bytes(), modTime: time.Now()}
+	f.storage.nodes[f.name] = node
+	return memInfo(f.name, node), nil
+}
+
+func (f *memStagedFile) Abort() {
+	f.Reset()
+}
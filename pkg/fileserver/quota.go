@@ -0,0 +1,447 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// PathQuota limits how much may be stored under Prefix, counting every file whoever wrote it. Zero means no limit
+type PathQuota struct {
+	Prefix string
+	Bytes  int64
+	Files  int64
+}
+
+// ParsePathQuotas reads quotas written as comma separated prefix=bytes:files, such as
+// "/=100000000000:0,/scratch=1000000000:10000"
+func ParsePathQuotas(spec string) ([]PathQuota, error) {
+	var quotas []PathQuota
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") {
+			return nil, fmt.Errorf("Invalid quota %q", item)
+		}
+		limits := strings.SplitN(kv[1], ":", 2)
+		if len(limits) != 2 {
+			return nil, fmt.Errorf("Invalid quota %q", item)
+		}
+		bytes, byteserr := strconv.ParseInt(limits[0], 10, 64)
+		files, fileserr := strconv.ParseInt(limits[1], 10, 64)
+		if byteserr != nil || fileserr != nil || bytes < 0 || files < 0 {
+			return nil, fmt.Errorf("Invalid quota %q", item)
+		}
+		quotas = append(quotas, PathQuota{Prefix: path.Clean(kv[0]), Bytes: bytes, Files: files})
+	}
+	return quotas, nil
+}
+
+var errQuotaExceeded = errors.New("Insufficient Storage")
+
+// quotaCountAttempts is how many times an account is counted with q.lock let go before it is counted holding
+// it, when files keep changing while the storage is walked
+const quotaCountAttempts = 3
+
+// quotaUsage is an amount stored, or a limit on it where zero means no limit
+type quotaUsage struct {
+	Bytes int64
+	Files int64
+}
+
+func (usage *quotaUsage) add(change quotaUsage) {
+	usage.Bytes += change.Bytes
+	usage.Files += change.Files
+}
+
+// exceeds returns true if change grows used past limit in either bytes or files
+func (limit quotaUsage) exceeds(used quotaUsage, change quotaUsage) bool {
+	return (limit.Bytes > 0 && change.Bytes > 0 && used.Bytes+change.Bytes > limit.Bytes) ||
+		(limit.Files > 0 && change.Files > 0 && used.Files+change.Files > limit.Files)
+}
+
+func accountLimit(account auth.Account) quotaUsage {
+	return quotaUsage{Bytes: account.QuotaBytes, Files: account.QuotaFiles}
+}
+
+func prefixCovers(prefix string, name string) bool {
+	return prefix == "/" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// accountUsage is what is stored in the paths an account can write, counted for the Writeable it had then
+type accountUsage struct {
+	writeable []string
+	quotaUsage
+}
+
+func (usage *accountUsage) covers(name string) bool {
+	return auth.Account{Writeable: usage.writeable}.CanWrite(name)
+}
+
+func sameWriteable(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// quotaStore tracks usage under each PathQuota and of each account with a quota. Usage is counted by walking
+// the storage once, then kept up to date as files are written and deleted. An account given a quota or new
+// write access later on is counted again the first time it is needed
+type quotaStore struct {
+	lock     sync.Mutex
+	storage  Storage
+	paths    []PathQuota
+	pathUsed []quotaUsage
+	accounts map[string]*accountUsage
+	// changes counts calls to add, so a count made without the lock can tell if it missed any
+	changes uint64
+}
+
+func makeQuotaStore(storage Storage, paths []PathQuota, accounts map[string]auth.Account) *quotaStore {
+	q := &quotaStore{
+		storage:  storage,
+		paths:    paths,
+		pathUsed: make([]quotaUsage, len(paths)),
+		accounts: make(map[string]*accountUsage),
+	}
+	for _, account := range accounts {
+		if accountLimit(account) != (quotaUsage{}) {
+			q.accounts[account.User] = &accountUsage{writeable: append([]string(nil), account.Writeable...)}
+		}
+	}
+	if !q.tracking() {
+		return q
+	}
+
+	err := walkStoredFiles(storage, "/", func(name string, size int64) {
+		q.add(name, quotaUsage{Bytes: size, Files: 1})
+	})
+	if err != nil {
+		fmt.Print("The following error occured while counting usage for quotas: ")
+		fmt.Println(err)
+	}
+	return q
+}
+
+// tracking returns true if there is any quota to keep usage for. The caller must hold q.lock or be the constructor
+func (q *quotaStore) tracking() bool {
+	return len(q.paths) > 0 || len(q.accounts) > 0
+}
+
+// walkStoredFiles calls fn for every file under name with its size, leaving out uploads in progress
+func walkStoredFiles(storage Storage, name string, fn func(name string, size int64)) error {
+	err := walkStorage(storage, name, func(name string, info os.FileInfo) error {
+		if isStagingName(path.Base(name)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			fn(name, info.Size())
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// add applies change to every quota covering name. The caller must hold q.lock
+func (q *quotaStore) add(name string, change quotaUsage) {
+	q.changes++
+	for i, quota := range q.paths {
+		if prefixCovers(quota.Prefix, name) {
+			q.pathUsed[i].add(change)
+		}
+	}
+	for _, usage := range q.accounts {
+		if usage.covers(name) {
+			usage.add(change)
+		}
+	}
+}
+
+// account returns the usage of account, counting it if it has not been yet, or nil if it has no quota.
+// The caller must hold q.lock. It is let go while the storage is walked so other writes aren't held up,
+// so call this before reading anything else guarded by it
+func (q *quotaStore) account(account auth.Account) *accountUsage {
+	if accountLimit(account) == (quotaUsage{}) {
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		if usage, ok := q.accounts[account.User]; ok && sameWriteable(usage.writeable, account.Writeable) {
+			return usage
+		}
+
+		// the count is only kept if nothing was added while it was made, or a file written meanwhile
+		// could be counted twice or not at all
+		locked := attempt >= quotaCountAttempts
+		changes := q.changes
+		if !locked {
+			q.lock.Unlock()
+		}
+		usage := q.count(account)
+		if !locked {
+			q.lock.Lock()
+		}
+		if locked || q.changes == changes {
+			q.accounts[account.User] = usage
+			return usage
+		}
+	}
+}
+
+// count walks the storage adding up what is stored in the paths account can write
+func (q *quotaStore) count(account auth.Account) *accountUsage {
+	usage := &accountUsage{writeable: append([]string(nil), account.Writeable...)}
+	err := walkStoredFiles(q.storage, "/", func(name string, size int64) {
+		if usage.covers(name) {
+			usage.add(quotaUsage{Bytes: size, Files: 1})
+		}
+	})
+	if err != nil {
+		fmt.Print("The following error occured while counting usage for " + account.User + ": ")
+		fmt.Println(err)
+	}
+	return usage
+}
+
+// fileUsage returns what the file at name uses now, which is nothing if it doesn't exist
+func (q *quotaStore) fileUsage(name string) quotaUsage {
+	if info, err := q.storage.Stat(name); err == nil && !info.IsDir() {
+		return quotaUsage{Bytes: info.Size(), Files: 1}
+	}
+	return quotaUsage{}
+}
+
+// headroom returns how many bytes account may write to name, replacing before, or -1 if there is no limit.
+// errQuotaExceeded means nothing can be written there at all
+func (q *quotaStore) headroom(account auth.Account, name string, before quotaUsage) (int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	left := int64(-1)
+	check := func(limit quotaUsage, used quotaUsage) error {
+		if limit.exceeds(used, quotaUsage{Files: 1 - before.Files}) {
+			return errQuotaExceeded
+		}
+		if limit.Bytes > 0 {
+			room := limit.Bytes - used.Bytes + before.Bytes
+			if room < 0 {
+				return errQuotaExceeded
+			}
+			if left < 0 || room < left {
+				left = room
+			}
+		}
+		return nil
+	}
+
+	if usage := q.account(account); usage != nil {
+		if err := check(accountLimit(account), usage.quotaUsage); err != nil {
+			return 0, err
+		}
+	}
+	for i, quota := range q.paths {
+		if prefixCovers(quota.Prefix, name) {
+			if err := check(quotaUsage{Bytes: quota.Bytes, Files: quota.Files}, q.pathUsed[i]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return left, nil
+}
+
+// charge records the file at name going from before to after if it fits in account's quota and every
+// quota on name, and returns errQuotaExceeded otherwise. Changes that shrink usage always fit
+func (q *quotaStore) charge(account auth.Account, name string, before quotaUsage, after quotaUsage) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	change := quotaUsage{Bytes: after.Bytes - before.Bytes, Files: after.Files - before.Files}
+	if usage := q.account(account); usage != nil && accountLimit(account).exceeds(usage.quotaUsage, change) {
+		return errQuotaExceeded
+	}
+	for i, quota := range q.paths {
+		if prefixCovers(quota.Prefix, name) && (quotaUsage{Bytes: quota.Bytes, Files: quota.Files}).exceeds(q.pathUsed[i], change) {
+			return errQuotaExceeded
+		}
+	}
+	q.add(name, change)
+	return nil
+}
+
+// refund takes back a charge for a write which then failed
+func (q *quotaStore) refund(name string, before quotaUsage, after quotaUsage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.add(name, quotaUsage{Bytes: before.Bytes - after.Bytes, Files: before.Files - after.Files})
+}
+
+// movedFiles returns the files of a snapshot of from named as they would be under to
+func movedFiles(files map[string]int64, from string, to string) map[string]int64 {
+	moved := make(map[string]int64, len(files))
+	for name, size := range files {
+		moved[path.Join(to, strings.TrimPrefix(name, from))] = size
+	}
+	return moved
+}
+
+// reserve charges account up front for replacing the files in before with those in after, such as for a copy
+// or an extracted archive, if the change fits in account's quota and every quota on the files. It returns the
+// changes to release once the tree has been settled, and errQuotaExceeded if they don't fit. Nothing is
+// reserved when before is a nil snapshot, as there are no quotas then
+func (q *quotaStore) reserve(account auth.Account, before map[string]int64, after map[string]int64) (map[string]quotaUsage, error) {
+	if before == nil {
+		return nil, nil
+	}
+	changes := make(map[string]quotaUsage)
+	for name, size := range before {
+		changes[name] = quotaUsage{Bytes: -size, Files: -1}
+	}
+	for name, size := range after {
+		change := changes[name]
+		change.add(quotaUsage{Bytes: size, Files: 1})
+		changes[name] = change
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	usage := q.account(account)
+	var accountChange quotaUsage
+	pathChange := make([]quotaUsage, len(q.paths))
+	for name, change := range changes {
+		if usage != nil && usage.covers(name) {
+			accountChange.add(change)
+		}
+		for i, quota := range q.paths {
+			if prefixCovers(quota.Prefix, name) {
+				pathChange[i].add(change)
+			}
+		}
+	}
+	if usage != nil && accountLimit(account).exceeds(usage.quotaUsage, accountChange) {
+		return nil, errQuotaExceeded
+	}
+	for i, quota := range q.paths {
+		if (quotaUsage{Bytes: quota.Bytes, Files: quota.Files}).exceeds(q.pathUsed[i], pathChange[i]) {
+			return nil, errQuotaExceeded
+		}
+	}
+	for name, change := range changes {
+		q.add(name, change)
+	}
+	return changes, nil
+}
+
+// release takes back what reserve charged, once the change has been counted with settle
+func (q *quotaStore) release(changes map[string]quotaUsage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for name, change := range changes {
+		q.add(name, quotaUsage{Bytes: -change.Bytes, Files: -change.Files})
+	}
+}
+
+// snapshot returns the size of every file under name, to settle against once it has been changed.
+// It is nil if there are no quotas to keep usage for
+func (q *quotaStore) snapshot(name string) map[string]int64 {
+	q.lock.Lock()
+	tracking := q.tracking()
+	q.lock.Unlock()
+	if !tracking {
+		return nil
+	}
+
+	files := make(map[string]int64)
+	walkStoredFiles(q.storage, name, func(name string, size int64) {
+		files[name] = size
+	})
+	return files
+}
+
+// settle records the difference between a snapshot of name and what is under it now, for changes to a
+// whole tree such as a copy, which are checked against the quotas beforehand with reserve
+func (q *quotaStore) settle(name string, before map[string]int64) {
+	if before == nil {
+		return
+	}
+	after := make(map[string]int64)
+	walkStoredFiles(q.storage, name, func(name string, size int64) {
+		after[name] = size
+	})
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for name, size := range before {
+		if _, kept := after[name]; !kept {
+			q.add(name, quotaUsage{Bytes: -size, Files: -1})
+		}
+	}
+	for name, size := range after {
+		old, existed := before[name]
+		change := quotaUsage{Bytes: size - old}
+		if !existed {
+			change.Files = 1
+		}
+		if change != (quotaUsage{}) {
+			q.add(name, change)
+		}
+	}
+}
+
+// quotaEntry is the usage and limits of an account or path prefix. A limit of zero means no limit
+type quotaEntry struct {
+	Name     string `json:"name"`
+	Bytes    int64  `json:"bytes"`
+	Files    int64  `json:"files"`
+	MaxBytes int64  `json:"maxBytes"`
+	MaxFiles int64  `json:"maxFiles"`
+}
+
+type quotaResponse struct {
+	Path    string       `json:"path"`
+	Account *quotaEntry  `json:"account,omitempty"`
+	Paths   []quotaEntry `json:"paths"`
+}
+
+// quotaHandler answers ?quota with the usage and limits that apply to uploads by user to relativePath
+func (h fileHandler) quotaHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	response := quotaResponse{Path: relativePath, Paths: []quotaEntry{}}
+
+	h.quotas.lock.Lock()
+	if usage := h.quotas.account(user); usage != nil {
+		response.Account = &quotaEntry{Name: user.GetName(), Bytes: usage.Bytes, Files: usage.Files, MaxBytes: user.QuotaBytes, MaxFiles: user.QuotaFiles}
+	}
+	for i, quota := range h.quotas.paths {
+		if prefixCovers(quota.Prefix, relativePath) {
+			used := h.quotas.pathUsed[i]
+			response.Paths = append(response.Paths, quotaEntry{Name: quota.Prefix, Bytes: used.Bytes, Files: used.Files, MaxBytes: quota.Bytes, MaxFiles: quota.Files})
+		}
+	}
+	h.quotas.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
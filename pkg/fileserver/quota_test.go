@@ -0,0 +1,213 @@
+package fileserver
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+func getQuota(t *testing.T, handler http.Handler, target string, user string) quotaResponse {
+	rec := doRequest(handler, http.MethodGet, target, user, "", nil)
+	var response quotaResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Got %d %q: %v", rec.Code, rec.Body.String(), err)
+	}
+	return response
+}
+
+func TestQuotas(t *testing.T) {
+	options := Options{PathQuotas: []PathQuota{{Prefix: "/shared", Bytes: 20}}}
+	handler, dataDir := makeTestHandler(t, options)
+	accounts := handler.(fileHandler).accounts
+	accounts.AddUser(auth.Account{User: "quota", Readable: []string{"/"}, Writeable: []string{"/home"}, QuotaBytes: 10, QuotaFiles: 2})
+	writer := auth.Account{User: "writer", Readable: []string{"/"}, Writeable: []string{"/"}}
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		user        string
+		body        string
+		status      int
+	}{
+		{"within quota", http.MethodPut, "/home/a.txt", "quota", "12345", 201},
+		{"over the byte quota", http.MethodPut, "/home/b.txt", "quota", "123456", 507},
+		{"exactly fills the quota", http.MethodPut, "/home/b.txt", "quota", "12345", 201},
+		{"shrinking a file", http.MethodPut, "/home/a.txt", "quota", "1234", 204},
+		{"over the file quota", http.MethodPut, "/home/c.txt", "quota", "", 507},
+		{"delete frees space", http.MethodDelete, "/home/b.txt", "quota", "", 204},
+		{"within the path quota", http.MethodPut, "/shared/x", "writer", "123456789012345", 201},
+		{"over the path quota", http.MethodPut, "/shared/y", "writer", "1234567890", 507},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			if rec := doRequest(handler, tt.method, tt.target, tt.user, tt.body, nil); rec.Code != tt.status {
+				t.Errorf("Got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	// without a Content-Length the upload is cut off once it goes over
+	req := httptest.NewRequest(http.MethodPut, "/home/c.txt", strings.NewReader("1234567"))
+	req.ContentLength = -1
+	req.SetBasicAuth("quota", "password")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 507 || exists(dataDir, "/home/c.txt") {
+		t.Errorf("Streaming over quota got %d", rec.Code)
+	}
+
+	account := getQuota(t, handler, "/home?quota", "quota")
+	if want := (&quotaEntry{Name: "quota", Bytes: 4, Files: 1, MaxBytes: 10, MaxFiles: 2}); !reflect.DeepEqual(account.Account, want) || len(account.Paths) != 0 {
+		t.Errorf("Got account usage %+v, want %+v", account, want)
+	}
+	shared := []quotaEntry{{Name: "/shared", Bytes: 15, Files: 1, MaxBytes: 20}}
+	if got := getQuota(t, handler, "/shared/x?quota", "writer"); got.Account != nil || !reflect.DeepEqual(got.Paths, shared) {
+		t.Errorf("Got path usage %+v, want %+v", got, shared)
+	}
+
+	// usage is counted again from the files on a restart
+	accounts.AddUser(writer)
+	options.MaxBodySize = 1 << 20
+	restarted := MakeRequestHandlerWithOptions(accounts, dataDir, options)
+	if got := getQuota(t, restarted, "/shared?quota", "writer"); !reflect.DeepEqual(got.Paths, shared) {
+		t.Errorf("Got path usage %+v after a restart, want %+v", got.Paths, shared)
+	}
+	if got := getQuota(t, restarted, "/home?quota", "quota"); got.Account == nil || got.Account.Bytes != 4 || got.Account.Files != 1 {
+		t.Errorf("Got account usage %+v after a restart", got.Account)
+	}
+}
+
+func TestTreeQuotas(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{TrashDir: t.TempDir(), PathQuotas: []PathQuota{{Prefix: "/shared", Bytes: 20}}})
+	writeTestFile(t, dataDir, "/big.txt", "123456789012345")
+	copyTo := func(destination string) map[string]string {
+		return map[string]string{"Destination": "http://example.com" + destination}
+	}
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		body        string
+		headers     map[string]string
+		status      int
+	}{
+		{"upload", http.MethodPut, "/shared/a.txt", "123456789012345", nil, 201},
+		{"copy over the quota", "COPY", "/shared/a.txt", "", copyTo("/shared/b.txt"), 507},
+		{"copy in over the quota", "COPY", "/big.txt", "", copyTo("/shared/c.txt"), 507},
+		{"move within the quota", "MOVE", "/shared/a.txt", "", copyTo("/shared/b.txt"), 201},
+		{"extract over the quota", http.MethodPut, "/shared/site?extract=1", makeTar(t, []testEntry{{"index.html", "1234567890", tar.TypeReg}}, false), nil, 507},
+		{"extract within the quota", http.MethodPut, "/shared/site?extract=1", makeTar(t, []testEntry{{"index.html", "12345", tar.TypeReg}}, false), nil, 201},
+		{"delete to the trash", http.MethodDelete, "/shared/site?recursive", "", nil, 204},
+		{"fill the quota again", http.MethodPut, "/shared/d.txt", "12345", nil, 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			if rec := doRequest(handler, tt.method, tt.target, "writer", tt.body, tt.headers); rec.Code != tt.status {
+				t.Errorf("Got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+	if exists(dataDir, "/shared/c.txt") || exists(dataDir, "/shared/site") {
+		t.Error("Wrote past the quota")
+	}
+
+	items := listTrash(t, handler, "/shared", "writer")
+	if len(items) != 1 {
+		t.Fatalf("Got %d trashed items", len(items))
+	}
+	if rec := doRequest(handler, http.MethodPost, "/?untrash="+items[0].ID, "writer", "", nil); rec.Code != 507 {
+		t.Errorf("Restoring over the quota got %d", rec.Code)
+	}
+	shared := []quotaEntry{{Name: "/shared", Bytes: 20, Files: 2, MaxBytes: 20}}
+	if got := getQuota(t, handler, "/shared?quota", "writer"); !reflect.DeepEqual(got.Paths, shared) {
+		t.Errorf("Got path usage %+v, want %+v", got.Paths, shared)
+	}
+}
+
+func TestParsePathQuotas(t *testing.T) {
+	quotas, err := ParsePathQuotas("/=1000:0, /scratch/=10:5")
+	want := []PathQuota{{Prefix: "/", Bytes: 1000}, {Prefix: "/scratch", Bytes: 10, Files: 5}}
+	if err != nil || !reflect.DeepEqual(quotas, want) {
+		t.Errorf("Got %+v, %v", quotas, err)
+	}
+	for _, spec := range []string{"scratch=1:1", "/=1", "/=-1:0", "/=a:0"} {
+		if _, err := ParsePathQuotas(spec); err == nil {
+			t.Errorf("Parsed invalid quota %q", spec)
+		}
+	}
+}
+
+// pausedStorage pauses the first listing of dir, after it has been read, until resume is closed
+type pausedStorage struct {
+	*MemStorage
+	dir     string
+	paused  chan struct{}
+	resume  chan struct{}
+	pausing sync.Once
+}
+
+func (storage *pausedStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := storage.MemStorage.ReadDir(name)
+	if name == storage.dir {
+		storage.pausing.Do(func() {
+			close(storage.paused)
+			<-storage.resume
+		})
+	}
+	return infos, err
+}
+
+func TestQuotaCountedWithoutLock(t *testing.T) {
+	mem := MakeMemStorage()
+	mem.MkdirAll("/home")
+	f, _ := mem.Create("/home/a.txt")
+	f.Write([]byte("12345"))
+	f.Commit()
+	q := makeQuotaStore(mem, []PathQuota{{Prefix: "/", Bytes: 100}}, nil)
+	storage := &pausedStorage{MemStorage: mem, dir: "/home", paused: make(chan struct{}), resume: make(chan struct{})}
+	q.storage = storage
+
+	account := auth.Account{User: "quota", Writeable: []string{"/home"}, QuotaBytes: 10}
+	counted := make(chan error)
+	go func() {
+		_, err := q.headroom(account, "/home/c.txt", quotaUsage{})
+		counted <- err
+	}()
+	<-storage.paused
+
+	// another upload goes ahead while the account is being counted, after the walk has passed it by
+	charged := make(chan error)
+	go func() {
+		charged <- q.charge(auth.Account{User: "writer"}, "/home/b.txt", quotaUsage{}, quotaUsage{Bytes: 3, Files: 1})
+	}()
+	select {
+	case err := <-charged:
+		if err != nil {
+			t.Errorf("Charge failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Charge waited for the account to be counted")
+	}
+	f, _ = mem.Create("/home/b.txt")
+	f.Write([]byte("123"))
+	f.Commit()
+	close(storage.resume)
+
+	if err := <-counted; err != nil {
+		t.Errorf("Headroom failed: %v", err)
+	}
+	if usage := q.accounts["quota"].quotaUsage; usage != (quotaUsage{Bytes: 8, Files: 2}) {
+		t.Errorf("Counted %+v", usage)
+	}
+}
@@ -0,0 +1,772 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultS3PartSize is how much of an upload is buffered before it is sent as a part when S3Config.PartSize is not set
+	defaultS3PartSize = 16 << 20
+	// maxS3CopySize is the largest object a single CopyObject request can copy
+	maxS3CopySize = 5 << 30
+	// minS3ReadWindow and maxS3ReadWindow bound how much one ranged GET asks for
+	minS3ReadWindow = 64 << 10
+	maxS3ReadWindow = 64 << 20
+)
+
+// s3DigestHeader prefixes the user metadata the digests of an object are kept in, one per indexed algorithm
+const s3DigestHeader = "X-Amz-Meta-Digest-"
+
+// S3Config describes the bucket an S3Storage keeps files in
+type S3Config struct {
+	// Endpoint is the URL of the service, e.g. http://localhost:9000. Defaults to AWS in Region
+	Endpoint string
+	// Region is what requests are signed for. Defaults to us-east-1
+	Region string
+	Bucket string
+	// Prefix is put in front of every key so the bucket can be shared
+	Prefix string
+	// VirtualHosted addresses the bucket as a subdomain of the endpoint rather than as the first part of the path
+	VirtualHosted bool
+	AccessKey     string
+	SecretKey     string
+	SessionToken  string
+	// PartSize is how much of an upload is buffered in memory before it is sent as one part of a multipart upload.
+	// Uploads smaller than this are sent with a single PUT. Defaults to 16 MiB, and AWS needs at least 5 MiB
+	PartSize int64
+	// Client sends the requests. Defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// S3Storage implements Storage with a bucket of an S3 compatible object store. Objects are keyed by their path,
+// and directories are empty objects with a trailing slash, though any prefix with objects under it is listed too.
+// The digests of every upload are computed while it is sent and kept in the object's metadata
+type S3Storage struct {
+	config   S3Config
+	creds    s3Credentials
+	endpoint *url.URL
+	prefix   string
+}
+
+// MakeS3Storage creates a Storage of the bucket described by config. Nothing is sent until it is used
+func MakeS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("An S3 bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, errors.New("Invalid S3 endpoint " + strconv.Quote(config.Endpoint))
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = defaultS3PartSize
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Storage{
+		config:   config,
+		creds:    s3Credentials{config.AccessKey, config.SecretKey, config.SessionToken, config.Region},
+		endpoint: endpoint,
+		prefix:   prefix,
+	}, nil
+}
+
+// key returns the object key of name
+func (storage *S3Storage) key(name string) string {
+	return storage.prefix + strings.TrimPrefix(memName(name), "/")
+}
+
+// dirKey returns the key of the marker object of the directory name, which is also the prefix of everything in it
+func (storage *S3Storage) dirKey(name string) string {
+	key := storage.key(name)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+// request sends a signed request for key, returning an error for any status other than 2xx.
+// A missing object gives an error os.IsNotExist recognises
+func (storage *S3Storage) request(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *storage.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	if storage.config.VirtualHosted {
+		u.Host = storage.config.Bucket + "." + u.Host
+		u.Path = base + "/" + key
+	} else {
+		u.Path = base + "/" + storage.config.Bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	}
+	// the path is sent exactly as it is signed
+	u.RawPath = uriEncode(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := sha256.Sum256(body)
+	signV4(req, storage.creds, hex.EncodeToString(payloadHash[:]), time.Now())
+
+	resp, err := storage.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, s3ResponseError(method, key, resp)
+	}
+	return resp, nil
+}
+
+// s3ResponseError turns a failed response into an error, using os.ErrNotExist and os.ErrPermission where they fit
+func s3ResponseError(method string, key string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case 404:
+		return &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	case 403:
+		return &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrPermission}
+	}
+	var s3err struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(data, &s3err)
+	return fmt.Errorf("S3 %s %s failed with %d %s %s", method, key, resp.StatusCode, s3err.Code, s3err.Message)
+}
+
+// checkResponseBody reads the body of a response S3 may report a failure in after it has sent a 200
+func checkResponseBody(method string, key string, resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var s3err struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &s3err) == nil && s3err.XMLName.Local == "Error" {
+		return nil, fmt.Errorf("S3 %s %s failed with %s %s", method, key, s3err.Code, s3err.Message)
+	}
+	return data, nil
+}
+
+// s3FileInfo describes an object or a directory
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	etag    string
+	digests map[string][]byte
+}
+
+func (info s3FileInfo) Name() string       { return info.name }
+func (info s3FileInfo) Size() int64        { return info.size }
+func (info s3FileInfo) ModTime() time.Time { return info.modTime }
+func (info s3FileInfo) IsDir() bool        { return info.dir }
+func (info s3FileInfo) Sys() interface{}   { return nil }
+func (info s3FileInfo) version() string    { return info.etag }
+
+func (info s3FileInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// storedDigests returns the digests kept in the object's metadata
+func (storage *S3Storage) storedDigests(info os.FileInfo) map[string][]byte {
+	if s3info, ok := info.(s3FileInfo); ok {
+		return s3info.digests
+	}
+	return nil
+}
+
+// head returns the info of the object at key
+func (storage *S3Storage) head(key string, name string) (s3FileInfo, error) {
+	resp, err := storage.request(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return s3FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	info := s3FileInfo{name: name, size: resp.ContentLength, etag: resp.Header.Get("ETag")}
+	info.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for _, a := range indexedAlgorithms {
+		if sum, err := hex.DecodeString(resp.Header.Get(s3DigestHeader + a)); err == nil && len(sum) > 0 {
+			if info.digests == nil {
+				info.digests = make(map[string][]byte)
+			}
+			info.digests[a] = sum
+		}
+	}
+	return info, nil
+}
+
+// s3ListResult is one page of a ListObjectsV2 response
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+		ETag         string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns one page of the keys starting with prefix. With a delimiter, keys further down are rolled up into CommonPrefixes
+func (storage *S3Storage) list(prefix string, delimiter string, token string, maxKeys int) (s3ListResult, error) {
+	var result s3ListResult
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	resp, err := storage.request(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+// listAll calls fn with every page of the keys starting with prefix
+func (storage *S3Storage) listAll(prefix string, delimiter string, fn func(result s3ListResult)) error {
+	token := ""
+	for {
+		result, err := storage.list(prefix, delimiter, token, 0)
+		if err != nil {
+			return err
+		}
+		fn(result)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// hasChildren returns true if anything but its marker is in the directory name
+func (storage *S3Storage) hasChildren(name string) (bool, error) {
+	prefix := storage.dirKey(name)
+	result, err := storage.list(prefix, "", "", 2)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range result.Contents {
+		if c.Key != prefix {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Open returns a reader which fetches the object with ranged GETs as it is read, so seeking to serve a Range
+// request only fetches the part asked for
+func (storage *S3Storage) Open(name string) (StorageFile, error) {
+	info, err := storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{storage: storage, key: storage.key(name), info: info.(s3FileInfo)}, nil
+}
+
+// Stat heads the object, or lists the prefix if there is no object so a directory without a marker is found
+func (storage *S3Storage) Stat(name string) (os.FileInfo, error) {
+	name = memName(name)
+	if name != "/" {
+		info, err := storage.head(storage.key(name), path.Base(name))
+		if err == nil {
+			return info, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	prefix := storage.dirKey(name)
+	result, err := storage.list(prefix, "/", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if name != "/" && len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	info := s3FileInfo{name: path.Base(name), dir: true}
+	if len(result.Contents) > 0 && result.Contents[0].Key == prefix {
+		info.modTime = result.Contents[0].LastModified
+	}
+	return info, nil
+}
+
+// ReadDir lists the directory sorted by name
+func (storage *S3Storage) ReadDir(name string) ([]os.FileInfo, error) {
+	name = memName(name)
+	prefix := storage.dirKey(name)
+	found := name == "/"
+	var infos []os.FileInfo
+	err := storage.listAll(prefix, "/", func(result s3ListResult) {
+		for _, c := range result.Contents {
+			found = true
+			if child := strings.TrimPrefix(c.Key, prefix); child != "" {
+				infos = append(infos, s3FileInfo{name: child, size: c.Size, modTime: c.LastModified, etag: c.ETag})
+			}
+		}
+		for _, p := range result.CommonPrefixes {
+			found = true
+			if child := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); child != "" {
+				infos = append(infos, s3FileInfo{name: child, dir: true})
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Create buffers the file in memory, switching to a multipart upload once it is larger than the part size
+func (storage *S3Storage) Create(name string) (StagedFile, error) {
+	name = memName(name)
+	if name == "/" {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrInvalid}
+	}
+	if info, err := storage.Stat(path.Dir(name)); err != nil || !info.IsDir() {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrNotExist}
+	}
+	return &s3Upload{storage: storage, name: name, key: storage.key(name), digests: newDigestSet(indexedAlgorithms)}, nil
+}
+
+// MkdirAll puts marker objects for the directory and any parents which don't have one
+func (storage *S3Storage) MkdirAll(name string) error {
+	for dir := memName(name); dir != "/"; dir = path.Dir(dir) {
+		if _, err := storage.head(storage.dirKey(dir), ""); err == nil {
+			return nil
+		}
+		if _, err := storage.head(storage.key(dir), ""); err == nil {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		resp, err := storage.request(http.MethodPut, storage.dirKey(dir), nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// copyObject copies src to dst within the bucket. The metadata is copied too unless header replaces it
+func (storage *S3Storage) copyObject(src string, dst string, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	} else {
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	}
+	header.Set("X-Amz-Copy-Source", "/"+storage.config.Bucket+"/"+uriEncode(src, true))
+	resp, err := storage.request(http.MethodPut, dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	_, err = checkResponseBody(http.MethodPut, dst, resp)
+	return err
+}
+
+func (storage *S3Storage) deleteObject(key string) error {
+	resp, err := storage.request(http.MethodDelete, key, nil, nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename copies and then deletes, object by object for a directory, so it is neither atomic nor cheap.
+// Objects larger than 5 GiB can't be renamed
+func (storage *S3Storage) Rename(oldName string, newName string) error {
+	oldName, newName = memName(oldName), memName(newName)
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	if oldName == "/" || newName == "/" || isUnder(newName, oldName) {
+		return linkError(os.ErrInvalid)
+	}
+	if oldName == newName {
+		return nil
+	}
+
+	info, err := storage.Stat(oldName)
+	if err != nil {
+		return linkError(os.ErrNotExist)
+	}
+	if parent, err := storage.Stat(path.Dir(newName)); err != nil || !parent.IsDir() {
+		return linkError(os.ErrNotExist)
+	}
+	existing, existserr := storage.Stat(newName)
+
+	if !info.IsDir() {
+		if existserr == nil && existing.IsDir() {
+			return linkError(os.ErrExist)
+		}
+		if info.Size() > maxS3CopySize {
+			return linkError(errors.New("too large to copy"))
+		}
+		if err := storage.copyObject(storage.key(oldName), storage.key(newName), nil); err != nil {
+			return err
+		}
+		return storage.deleteObject(storage.key(oldName))
+	}
+
+	// like rename(2), only an empty directory can be replaced, and only by a directory
+	if existserr == nil {
+		if !existing.IsDir() {
+			return linkError(os.ErrExist)
+		}
+		if children, err := storage.hasChildren(newName); err != nil {
+			return err
+		} else if children {
+			return linkError(os.ErrExist)
+		}
+	}
+
+	oldPrefix, newPrefix := storage.dirKey(oldName), storage.dirKey(newName)
+	var keys []string
+	err = storage.listAll(oldPrefix, "", func(result s3ListResult) {
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := storage.MkdirAll(newName); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key == oldPrefix {
+			continue
+		}
+		if err := storage.copyObject(key, newPrefix+strings.TrimPrefix(key, oldPrefix), nil); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := storage.deleteObject(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes an object, or the marker of an empty directory
+func (storage *S3Storage) Remove(name string) error {
+	name = memName(name)
+	info, err := storage.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return storage.deleteObject(storage.key(name))
+	}
+	if name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrInvalid}
+	}
+	if children, err := storage.hasChildren(name); err != nil {
+		return err
+	} else if children {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	return storage.deleteObject(storage.dirKey(name))
+}
+
+// RemoveAll deletes the object name and every object under it
+func (storage *S3Storage) RemoveAll(name string) error {
+	name = memName(name)
+	if name == "/" {
+		return &os.PathError{Op: "removeall", Path: name, Err: os.ErrInvalid}
+	}
+	var keys []string
+	err := storage.listAll(storage.dirKey(name), "", func(result s3ListResult) {
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range append(keys, storage.key(name)) {
+		if err := storage.deleteObject(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectHeader is the content type and digest metadata stored with the object name
+func objectHeader(name string, digests map[string][]byte) http.Header {
+	header := http.Header{}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	for a, sum := range digests {
+		header.Set(s3DigestHeader+a, hex.EncodeToString(sum))
+	}
+	return header
+}
+
+// s3Object reads an object with ranged GETs. Each GET asks for a window which starts small, so a short Range
+// request doesn't fetch the whole object, and doubles while the object is read sequentially
+type s3Object struct {
+	storage *S3Storage
+	key     string
+	info    s3FileInfo
+	offset  int64
+	body    io.ReadCloser
+	end     int64
+	window  int64
+}
+
+func (f *s3Object) Read(p []byte) (int, error) {
+	if f.info.dir {
+		return 0, &os.PathError{Op: "read", Path: f.key, Err: errors.New("is a directory")}
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		if f.window < minS3ReadWindow {
+			f.window = minS3ReadWindow
+		} else if f.window < maxS3ReadWindow {
+			f.window *= 2
+		}
+		f.end = f.offset + f.window
+		if f.end > f.info.size {
+			f.end = f.info.size
+		}
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", f.offset, f.end-1)}}
+		// fail rather than mix two versions of the object if it is replaced while being read
+		if f.info.etag != "" {
+			header.Set("If-Match", f.info.etag)
+		}
+		resp, err := f.storage.request(http.MethodGet, f.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF {
+		f.body.Close()
+		f.body = nil
+		if f.offset < f.end {
+			err = io.ErrUnexpectedEOF
+		} else if f.offset < f.info.size {
+			// on to the next window
+			err = nil
+		}
+	}
+	return n, err
+}
+
+func (f *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return f.offset, &os.PathError{Op: "seek", Path: f.key, Err: os.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3Object) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3Object) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
+
+// s3Part is a part of a multipart upload as CompleteMultipartUpload lists it
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Upload buffers a file being written to S3, hashing it as it goes
+type s3Upload struct {
+	storage  *S3Storage
+	name     string
+	key      string
+	digests  digestSet
+	buf      bytes.Buffer
+	size     int64
+	uploadID string
+	parts    []s3Part
+}
+
+func (f *s3Upload) Write(p []byte) (int, error) {
+	n, _ := f.digests.writer(&f.buf).Write(p)
+	f.size += int64(n)
+	if int64(f.buf.Len()) >= f.storage.config.PartSize {
+		if err := f.flushPart(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// flushPart sends what is buffered as the next part, starting the multipart upload if this is the first
+func (f *s3Upload) flushPart() error {
+	if f.uploadID == "" {
+		resp, err := f.storage.request(http.MethodPost, f.key, url.Values{"uploads": {""}}, objectHeader(f.name, nil), nil)
+		if err != nil {
+			return err
+		}
+		data, err := checkResponseBody(http.MethodPost, f.key, resp)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadId string
+		}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return err
+		}
+		f.uploadID = result.UploadId
+	}
+
+	number := len(f.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {f.uploadID}}
+	resp, err := f.storage.request(http.MethodPut, f.key, query, nil, f.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	f.parts = append(f.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	f.buf.Reset()
+	return nil
+}
+
+// Commit sends a small file with one PUT, or sends the last part and completes a multipart upload.
+// The digests of a multipart upload are only known at the end, so they are added by copying the object
+// onto itself with new metadata, which happens within S3 without sending the file again
+func (f *s3Upload) Commit() (os.FileInfo, error) {
+	if info, err := f.storage.Stat(f.name); err == nil && info.IsDir() {
+		f.Abort()
+		return nil, &os.PathError{Op: "commit", Path: f.name, Err: errors.New("is a directory")}
+	}
+	sums := f.digests.sums()
+
+	if f.uploadID == "" {
+		resp, err := f.storage.request(http.MethodPut, f.key, nil, objectHeader(f.name, sums), f.buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+	} else {
+		if f.buf.Len() > 0 {
+			if err := f.flushPart(); err != nil {
+				f.Abort()
+				return nil, err
+			}
+		}
+		body, _ := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []s3Part `xml:"Part"`
+		}{Parts: f.parts})
+		resp, err := f.storage.request(http.MethodPost, f.key, url.Values{"uploadId": {f.uploadID}}, nil, body)
+		if err == nil {
+			_, err = checkResponseBody(http.MethodPost, f.key, resp)
+		}
+		if err != nil {
+			f.Abort()
+			return nil, err
+		}
+		f.uploadID = ""
+
+		if f.size <= maxS3CopySize {
+			if err := f.storage.copyObject(f.key, f.key, objectHeader(f.name, sums)); err != nil {
+				fmt.Print("The following error occured while storing the digests of " + f.name + ": ")
+				fmt.Println(err)
+			}
+		}
+	}
+	f.buf.Reset()
+	return f.storage.Stat(f.name)
+}
+
+// Abort throws away the buffer and any parts already sent
+func (f *s3Upload) Abort() {
+	f.buf.Reset()
+	if f.uploadID != "" {
+		if resp, err := f.storage.request(http.MethodDelete, f.key, url.Values{"uploadId": {f.uploadID}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+		f.uploadID = ""
+	}
+}
@@ -0,0 +1,219 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// sessionCookie is the name of the cookie holding a login session token
+const sessionCookie = "session"
+
+// bearerScheme starts an Authorization header carrying an API token
+const bearerScheme = "Bearer "
+
+// defaultSessionTTL is how long a login lasts when Options.SessionTTL is not set
+const defaultSessionTTL = 12 * time.Hour
+
+// maxSessions is how many sessions are kept at once. Past it the session closest to expiring is ended
+const maxSessions = 100000
+
+// session is a login from the login page. CSRF must be echoed in an X-CSRF-Token header
+// on anything but GET and HEAD, as the cookie is sent by the browser no matter who made the request.
+// Hash is the account's password hash at login, so changing the password ends its sessions
+type session struct {
+	User    string
+	Hash    string
+	CSRF    string
+	Expires time.Time
+}
+
+type sessionStore struct {
+	lock     sync.Mutex
+	size     int
+	sessions map[string]session
+}
+
+func makeSessionStore() *sessionStore {
+	return &sessionStore{size: maxSessions, sessions: make(map[string]session)}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// create starts a session for user, returning its token
+func (store *sessionStore) create(user auth.Account, ttl time.Duration) (string, session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", session{}, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", session{}, err
+	}
+
+	s := session{User: user.GetName(), Hash: user.Hash, CSRF: csrf, Expires: time.Now().Add(ttl)}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if len(store.sessions) >= store.size {
+		now := time.Now()
+		oldest := ""
+		for k, v := range store.sessions {
+			if now.After(v.Expires) {
+				delete(store.sessions, k)
+			} else if oldest == "" || v.Expires.Before(store.sessions[oldest].Expires) {
+				oldest = k
+			}
+		}
+		if len(store.sessions) >= store.size {
+			delete(store.sessions, oldest)
+		}
+	}
+	store.sessions[token] = s
+	return token, s, nil
+}
+
+func (store *sessionStore) get(token string) (session, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	s, found := store.sessions[token]
+	if found && time.Now().After(s.Expires) {
+		delete(store.sessions, token)
+		return session{}, false
+	}
+	return s, found
+}
+
+func (store *sessionStore) remove(token string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.sessions, token)
+}
+
+func (h fileHandler) sessionTTL() time.Duration {
+	if h.SessionTTL > 0 {
+		return h.SessionTTL
+	}
+	return defaultSessionTTL
+}
+
+// sessionAccount looks up the account of the session with token, ending the session if the account is gone or its
+// password has changed since. The account is looked up every time so permission changes apply straight away
+func (h fileHandler) sessionAccount(token string) (auth.Account, *session) {
+	s, found := h.sessions.get(token)
+	if !found {
+		return auth.Account{}, nil
+	}
+	user, found := h.accounts.GetUser(s.User)
+	if !found || user.Hash != s.Hash {
+		h.sessions.remove(token)
+		return auth.Account{}, nil
+	}
+	return user, &s
+}
+
+// authenticate works out the account a request is made as: an API token, JWT, client certificate or Basic auth
+// first, then a login session cookie, falling back to the default account. The session is returned when that is
+// how the request authenticated. With BasicSessions a Basic auth password which checks out also gets a cookie on w
+func (h fileHandler) authenticate(w http.ResponseWriter, r *http.Request) (auth.Account, *session) {
+	if header := r.Header.Get("Authorization"); len(header) > len(bearerScheme) && strings.EqualFold(header[:len(bearerScheme)], bearerScheme) {
+		bearer := strings.TrimSpace(header[len(bearerScheme):])
+		// API tokens never contain dots, while a JWT is always three dot separated parts
+		if h.JWT != nil && strings.Count(bearer, ".") == 2 {
+			if user, err := h.JWT.Authenticate(bearer); err == nil {
+				return user, nil
+			}
+		} else if user, err := h.accounts.GetTokenAccount(bearer); err == nil {
+			return user, nil
+		}
+		return h.accounts.GetDefault(), nil
+	}
+	// the TLS server only verifies certificates from trusted CAs, and clients without one can use a password
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if user, err := h.accounts.GetCertificateAccount(r.TLS.VerifiedChains[0][0]); err == nil {
+			return user, nil
+		}
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		if user, found := h.basicSession(r, username); found {
+			return user, nil
+		}
+		if user, err := h.accounts.GetAccount(username, []byte(password)); err == nil {
+			if h.BasicSessions {
+				h.startBasicSession(w, r, user)
+			}
+			return user, nil
+		}
+		return h.accounts.GetDefault(), nil
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if user, s := h.sessionAccount(cookie.Value); s != nil {
+			return user, s
+		}
+	}
+	return h.accounts.GetDefault(), nil
+}
+
+// basicSession finds the account of a session started by startBasicSession for username, which the client
+// still sends Basic auth along with
+func (h fileHandler) basicSession(r *http.Request, username string) (auth.Account, bool) {
+	if !h.BasicSessions || username == "" {
+		return auth.Account{}, false
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return auth.Account{}, false
+	}
+	user, s := h.sessionAccount(cookie.Value)
+	if s == nil || s.User != username {
+		return auth.Account{}, false
+	}
+	return user, true
+}
+
+// startBasicSession gives a request whose Basic auth password was just checked a session cookie
+func (h fileHandler) startBasicSession(w http.ResponseWriter, r *http.Request, user auth.Account) {
+	if user.GetName() == "" {
+		return
+	}
+	token, s, err := h.sessions.create(user, h.sessionTTL())
+	if err != nil {
+		return
+	}
+	setSessionCookie(w, r, token, s.Expires)
+	w.Header().Set("X-CSRF-Token", s.CSRF)
+}
+
+// checkCSRF makes sure a request authenticated by session cookie that changes something came from our own pages
+func checkCSRF(r *http.Request, s *session) bool {
+	if s == nil || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-CSRF-Token")), []byte(s.CSRF)) == 1
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,546 @@
+package fileserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+const (
+	// defaultShareExpiry is how long a share link lasts when its creator doesn't say
+	defaultShareExpiry = 24 * time.Hour
+	// maxShareExpiry is the longest a share link can last
+	maxShareExpiry = 90 * 24 * time.Hour
+)
+
+var errShareInvalid = errors.New("Invalid Share Link")
+var errShareExpired = errors.New("Share Link Expired")
+var errShareUsed = errors.New("Share Link Download Limit Reached")
+
+// shareLink lets anyone holding its URL download Path, or anything under it if Subtree, without an account.
+// A drop link instead lets them upload into the directory Path
+type shareLink struct {
+	ID           string    `json:"id"`
+	Owner        string    `json:"owner"`
+	Path         string    `json:"path"`
+	Subtree      bool      `json:"subtree"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	// PasswordHash is a bcrypt hash of the password needed to use the link, if it has one
+	PasswordHash string `json:"passwordHash,omitempty"`
+	Revoked      bool   `json:"revoked,omitempty"`
+	// Drop links take at most MaxBytes and MaxFiles in total, where zero means no limit
+	Drop     bool  `json:"drop,omitempty"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	MaxFiles int   `json:"maxFiles,omitempty"`
+	Bytes    int64 `json:"bytes,omitempty"`
+	Files    int   `json:"files,omitempty"`
+}
+
+// shareView is a share link as shown to its owner
+type shareView struct {
+	ID           string    `json:"id"`
+	URL          string    `json:"url"`
+	Path         string    `json:"path"`
+	Subtree      bool      `json:"subtree"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Password     bool      `json:"password"`
+	Revoked      bool      `json:"revoked"`
+	Drop         bool      `json:"drop,omitempty"`
+	MaxBytes     int64     `json:"maxBytes,omitempty"`
+	MaxFiles     int       `json:"maxFiles,omitempty"`
+	Bytes        int64     `json:"bytes,omitempty"`
+	Files        int       `json:"files,omitempty"`
+}
+
+func viewShare(link shareLink, linkURL string) shareView {
+	return shareView{ID: link.ID, URL: linkURL, Path: link.Path, Subtree: link.Subtree, Expires: link.Expires,
+		MaxDownloads: link.MaxDownloads, Downloads: link.Downloads, Password: link.PasswordHash != "", Revoked: link.Revoked,
+		Drop: link.Drop, MaxBytes: link.MaxBytes, MaxFiles: link.MaxFiles, Bytes: link.Bytes, Files: link.Files}
+}
+
+// shareKeys are the secrets share links are signed with, one base64 encoded secret per line with the one
+// signing new links first. The file is read again whenever it changes, so keys rotate without a restart.
+// Taking a key out of the file invalidates every link it signed
+type shareKeys struct {
+	filename string
+	lock     sync.Mutex
+	modTime  time.Time
+	size     int64
+	keys     [][]byte
+}
+
+func (k *shareKeys) current() ([][]byte, error) {
+	info, err := os.Stat(k.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.keys != nil && info.ModTime().Equal(k.modTime) && info.Size() == k.size {
+		return k.keys, nil
+	}
+
+	data, err := ioutil.ReadFile(k.filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) < 16 {
+			return nil, errors.New("Share keys must be at least 16 bytes encoded as base64")
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No share keys in " + k.filename)
+	}
+	k.keys, k.modTime, k.size = keys, info.ModTime(), info.Size()
+	return keys, nil
+}
+
+// shareSignature signs what a link grants, so none of it can be changed in its URL
+func shareSignature(key []byte, link *shareLink) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(link.ID + "\n" + link.Path + "\n" + strconv.FormatInt(link.Expires.Unix(), 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareStore keeps the share links, which are checked against their signature and then against the stored
+// link, so they can be revoked and their downloads counted. It is optionally written to a file
+type shareStore struct {
+	filename string
+	keys     *shareKeys
+	lock     sync.Mutex
+	links    map[string]*shareLink
+	// pending is what uploads in progress through each drop link have set aside
+	pending map[string]quotaUsage
+	// claimed are the names uploads in progress through drop links will be stored as
+	claimed map[string]bool
+}
+
+func makeShareStore(keyFile string, filename string) (*shareStore, error) {
+	store := &shareStore{
+		filename: filename,
+		keys:     &shareKeys{filename: keyFile},
+		links:    make(map[string]*shareLink),
+		pending:  make(map[string]quotaUsage),
+		claimed:  make(map[string]bool),
+	}
+	if _, err := store.keys.current(); err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.links); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// save drops expired links and writes the rest to the file. The caller must hold store.lock
+func (store *shareStore) save() error {
+	now := time.Now()
+	for id, link := range store.links {
+		if now.After(link.Expires) {
+			delete(store.links, id)
+		}
+	}
+	if store.filename == "" {
+		return nil
+	}
+	data, err := json.Marshal(store.links)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.filename, data)
+}
+
+// url returns the address of link signed with the current key
+func (store *shareStore) url(link *shareLink) (string, error) {
+	keys, err := store.keys.current()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set("share", link.ID)
+	query.Set("exp", strconv.FormatInt(link.Expires.Unix(), 10))
+	query.Set("sig", shareSignature(keys[0], link))
+	return (&url.URL{Path: link.Path, RawQuery: query.Encode()}).String(), nil
+}
+
+func (store *shareStore) add(link shareLink) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.links[link.ID] = &link
+	return store.save()
+}
+
+// check returns the link the query of r names if its signature is good for a key in the file, and it grants
+// relativePath. It doesn't count a download
+func (store *shareStore) check(r *http.Request, relativePath string) (shareLink, error) {
+	query := r.URL.Query()
+	keys, err := store.keys.current()
+	if err != nil {
+		return shareLink{}, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	link, ok := store.links[query.Get("share")]
+	if !ok || query.Get("exp") != strconv.FormatInt(link.Expires.Unix(), 10) {
+		return shareLink{}, errShareInvalid
+	}
+	signed := false
+	for _, key := range keys {
+		if hmac.Equal([]byte(query.Get("sig")), []byte(shareSignature(key, link))) {
+			signed = true
+		}
+	}
+	if !signed || !(relativePath == link.Path || (link.Subtree && isUnder(relativePath, link.Path))) {
+		return shareLink{}, errShareInvalid
+	}
+	if link.Revoked || time.Now().After(link.Expires) {
+		return shareLink{}, errShareExpired
+	}
+	return *link, nil
+}
+
+// download counts a download with the link id, unless it has reached its limit
+func (store *shareStore) download(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	link, ok := store.links[id]
+	if !ok || link.Revoked {
+		return errShareExpired
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		return errShareUsed
+	}
+	link.Downloads++
+	return store.save()
+}
+
+// revoke stops the link id from working. Only its owner can revoke it
+func (store *shareStore) revoke(id string, owner string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	link, ok := store.links[id]
+	if !ok || link.Owner != owner {
+		return os.ErrNotExist
+	}
+	link.Revoked = true
+	return store.save()
+}
+
+// list returns the links owner has made to relativePath or anything under it, soonest to expire first
+func (store *shareStore) list(owner string, relativePath string) []shareLink {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	links := []shareLink{}
+	for _, link := range store.links {
+		if link.Owner == owner && (link.Path == relativePath || isUnder(link.Path, relativePath)) {
+			links = append(links, *link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Expires.Before(links[j].Expires) })
+	return links
+}
+
+// wantsShareManagement returns true for requests making (POST ?share or ?drop), revoking (DELETE ?share=<id>)
+// or listing (GET ?shares) share links
+func wantsShareManagement(r *http.Request) bool {
+	query := r.URL.Query()
+	if _, share := query["share"]; share && (r.Method == http.MethodPost || r.Method == http.MethodDelete) {
+		return true
+	}
+	if _, drop := query["drop"]; drop && r.Method == http.MethodPost {
+		return true
+	}
+	_, list := query["shares"]
+	return list && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// sharesHandler lets an account make share links to what it can read, and list and revoke its links
+func (h fileHandler) sharesHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	if user.GetName() == "" {
+		requestAuth(w)
+		return
+	}
+	// links are checked against their owner's account when used, which only accounts in the auth file have
+	if _, found := h.accounts.GetUser(user.GetName()); !found && r.Method == http.MethodPost {
+		http.Error(w, "Share Links Need An Account In The Auth File", 403)
+		return
+	}
+
+	_, drop := r.URL.Query()["drop"]
+	switch {
+	case r.Method == http.MethodPost && drop:
+		h.dropCreate(w, r, relativePath, user)
+	case r.Method == http.MethodPost:
+		h.shareCreate(w, r, relativePath, user)
+	case r.Method == http.MethodDelete:
+		id := r.URL.Query().Get("share")
+		if err := h.shares.revoke(id, user.GetName()); os.IsNotExist(err) {
+			http.Error(w, "Share Link Not Found", 404)
+			return
+		} else if err != nil {
+			fmt.Print("The following error occured while revoking share link " + id + ": ")
+			fmt.Println(err)
+			http.Error(w, "Could not revoke share link", 500)
+			return
+		}
+		fmt.Printf("Revoked share link %s for %s\n", id, user.GetName())
+		w.WriteHeader(204)
+	default:
+		views := []shareView{}
+		for _, link := range h.shares.list(user.GetName(), relativePath) {
+			link := link
+			linkURL, _ := h.shares.url(&link)
+			views = append(views, viewShare(link, linkURL))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(views)
+	}
+}
+
+// shareCreate makes a link to relativePath, taking the optional form values expires (a duration such as 72h),
+// downloads (the most times the link can be used) and password
+func (h fileHandler) shareCreate(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	info, err := h.storage.Stat(relativePath)
+	if err != nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	link, ok := newShareLink(w, r, relativePath, user)
+	if !ok {
+		return
+	}
+	link.Subtree = info.IsDir()
+	if value := r.Form.Get("downloads"); value != "" {
+		if link.MaxDownloads, err = strconv.Atoi(value); err != nil || link.MaxDownloads < 0 {
+			http.Error(w, "Invalid Download Limit", 400)
+			return
+		}
+	}
+	if password := r.Form.Get("password"); password != "" {
+		if link.PasswordHash, err = auth.HashPassword([]byte(password)); err != nil {
+			http.Error(w, "Could not create share link", 500)
+			return
+		}
+	}
+	h.saveShare(w, link)
+}
+
+// newShareLink starts a link to relativePath for user, taking its expiry from the form value expires
+func newShareLink(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) (shareLink, bool) {
+	r.ParseForm()
+	expiry := defaultShareExpiry
+	if value := r.Form.Get("expires"); value != "" {
+		var err error
+		if expiry, err = time.ParseDuration(value); err != nil || expiry <= 0 || expiry > maxShareExpiry {
+			http.Error(w, "Invalid Expiry", 400)
+			return shareLink{}, false
+		}
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		http.Error(w, "Could not create share link", 500)
+		return shareLink{}, false
+	}
+	return shareLink{
+		ID:      hex.EncodeToString(idBytes),
+		Owner:   user.GetName(),
+		Path:    relativePath,
+		Expires: time.Now().Add(expiry).Truncate(time.Second),
+	}, true
+}
+
+// saveShare stores a new link and responds with it
+func (h fileHandler) saveShare(w http.ResponseWriter, link shareLink) {
+	linkURL, err := h.shares.url(&link)
+	if err == nil {
+		err = h.shares.add(link)
+	}
+	if err != nil {
+		fmt.Print("The following error occured while creating a share link for " + link.Path + ": ")
+		fmt.Println(err)
+		http.Error(w, "Could not create share link", 500)
+		return
+	}
+
+	fmt.Printf("Created share link %s to %s for %s\n", link.ID, link.Path, link.Owner)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", linkURL)
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(viewShare(link, linkURL))
+}
+
+// servesFromStart returns true if http.ServeContent could answer r with the start of a file of size bytes. It
+// reads Range the way ServeContent does: the whole file is sent without one, with one it doesn't follow, when
+// If-Range may not match, or when the ranges add up to more than the file, and otherwise the ranges are sent
+func servesFromStart(r *http.Request, size int64) bool {
+	header := r.Header.Get("Range")
+	if header == "" || r.Header.Get("If-Range") != "" {
+		return true
+	}
+	const unit = "bytes="
+	if !strings.HasPrefix(header, unit) {
+		return false
+	}
+	var sent int64
+	for _, spec := range strings.Split(header[len(unit):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			return false
+		}
+		first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+		var start, end int64
+		if first == "" {
+			// the final n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			if n > size {
+				n = size
+			}
+			start, end = size-n, size-1
+		} else {
+			var err error
+			start, err = strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return false
+			}
+			if start >= size {
+				// not satisfiable, so left out
+				continue
+			}
+			end = size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return false
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+		}
+		if start == 0 && end >= start {
+			return true
+		}
+		sent += end - start + 1
+	}
+	return sent > size
+}
+
+// shareHandler serves a request carrying a share link in place of an account. A password protected link takes
+// its password as the Basic auth password, or in X-Share-Password
+func (h fileHandler) shareHandler(w http.ResponseWriter, r *http.Request, relativePath string) {
+	if isStagingName(path.Base(relativePath)) {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	link, err := h.shares.check(r, relativePath)
+	if err == errShareInvalid {
+		http.Error(w, err.Error(), 403)
+		return
+	} else if err == errShareExpired {
+		http.Error(w, err.Error(), 410)
+		return
+	} else if err != nil {
+		fmt.Print("The following error occured while checking a share link: ")
+		fmt.Println(err)
+		http.Error(w, "500 Internal Server Error", 500)
+		return
+	}
+
+	if link.Drop {
+		h.dropHandler(w, r, relativePath, link)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Supported", 405)
+		return
+	}
+
+	// a link only lasts as long as its owner can read what it shares
+	if owner, found := h.accounts.GetUser(link.Owner); !found || !owner.CanRead(link.Path) {
+		http.Error(w, errShareExpired.Error(), 410)
+		return
+	}
+
+	if link.PasswordHash != "" {
+		_, password, _ := r.BasicAuth()
+		if password == "" {
+			password = r.Header.Get("X-Share-Password")
+		}
+		if password == "" || !(auth.Account{Hash: link.PasswordHash}).CheckPassword([]byte(password)) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Share Link Password"`)
+			http.Error(w, "Share Link Password Required", 401)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	info, err := h.storage.Stat(relativePath)
+	if err == nil && info.IsDir() {
+		h.listHandler(w, r, relativePath, auth.Account{Readable: []string{link.Path}})
+		return
+	}
+
+	// a download is counted when the file is sent from the start, so resuming doesn't use up the link
+	if err == nil && r.Method == http.MethodGet && servesFromStart(r, info.Size()) {
+		if err := h.shares.download(link.ID); err == errShareUsed || err == errShareExpired {
+			http.Error(w, err.Error(), 410)
+			return
+		} else if err != nil {
+			fmt.Print("The following error occured while counting a download of share link " + link.ID + ": ")
+			fmt.Println(err)
+		}
+	}
+	h.serveFile(w, r, relativePath)
+}
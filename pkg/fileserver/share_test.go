@@ -0,0 +1,157 @@
+package fileserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeShareKeys(t *testing.T, filename string, keys ...string) {
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, base64.StdEncoding.EncodeToString([]byte(key)))
+	}
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func makeShare(t *testing.T, handler http.Handler, target string, form string) shareView {
+	rec := doRequest(handler, http.MethodPost, target, "reader", form, map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	var view shareView
+	if rec.Code != 201 || json.Unmarshal(rec.Body.Bytes(), &view) != nil {
+		t.Fatalf("Creating a share link to %s got %d %q", target, rec.Code, rec.Body.String())
+	}
+	return view
+}
+
+func TestServesFromStart(t *testing.T) {
+	var tests = []struct {
+		rangeHeader string
+		ifRange     string
+		want        bool
+	}{
+		{"", "", true},
+		{"bytes=0-", "", true},
+		{"bytes= 0-", "", true},
+		{"bytes=8-", "", false},
+		{"bytes=8-,0-0", "", true},
+		{"bytes=-100", "", true},
+		{"bytes=-4", "", false},
+		{"bytes=1-,1-", "", true},
+		{"bytes=1-5, 6-9", "", false},
+		{"bytes=100-", "", false},
+		{"items=0-", "", false},
+		{"bytes=8-", `"etag"`, true},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Range", tt.rangeHeader)
+		if tt.ifRange != "" {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+		if got := servesFromStart(r, 16); got != tt.want {
+			t.Errorf("Range %q, If-Range %q: got %t, want %t", tt.rangeHeader, tt.ifRange, got, tt.want)
+		}
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "sharekeys")
+	writeShareKeys(t, keyFile, "the first signing key")
+	options := Options{ShareKeyFile: keyFile, ShareFile: filepath.Join(t.TempDir(), "shares.json")}
+	handler, dataDir := makeTestHandler(t, options)
+	writeTestFile(t, dataDir, "/docs/report.txt", "quarterly report")
+	writeTestFile(t, dataDir, "/docs/sub/notes.txt", "notes")
+	writeTestFile(t, dataDir, "/private/secret.txt", "secret")
+
+	limited := makeShare(t, handler, "/docs/report.txt?share", "downloads=2")
+	spaced := makeShare(t, handler, "/docs/report.txt?share", "downloads=1")
+	multi := makeShare(t, handler, "/docs/report.txt?share", "downloads=1")
+	tree := makeShare(t, handler, "/docs?share", "")
+	protected := makeShare(t, handler, "/docs/report.txt?share", "password=hunter2")
+	query := func(link shareView) string { return link.URL[strings.Index(link.URL, "?"):] }
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		user        string
+		headers     map[string]string
+		status      int
+		response    string
+	}{
+		{"download", http.MethodGet, limited.URL, "", nil, 200, "quarterly report"},
+		{"resuming isn't counted", http.MethodGet, limited.URL, "", map[string]string{"Range": "bytes=8-"}, 206, "report"},
+		{"second download", http.MethodGet, limited.URL, "", nil, 200, "quarterly report"},
+		{"download limit reached", http.MethodGet, limited.URL, "", nil, 410, ""},
+		{"range with a space", http.MethodGet, spaced.URL, "", map[string]string{"Range": "bytes= 0-"}, 206, "quarterly report"},
+		{"range with a space is counted", http.MethodGet, spaced.URL, "", map[string]string{"Range": "bytes= 0-"}, 410, ""},
+		{"several ranges", http.MethodGet, multi.URL, "", map[string]string{"Range": "bytes=1-,0-0"}, 206, "uarterly report"},
+		{"several ranges are counted", http.MethodGet, multi.URL, "", map[string]string{"Range": "bytes=1-,0-0"}, 410, ""},
+		{"other path", http.MethodGet, "/private/secret.txt" + query(tree), "", nil, 403, ""},
+		{"changed expiry", http.MethodGet, strings.Replace(tree.URL, "exp=", "exp=9", 1), "", nil, 403, ""},
+		{"file in a shared directory", http.MethodGet, "/docs/sub/notes.txt" + query(tree), "", nil, 200, "notes"},
+		{"listing a shared directory", http.MethodGet, tree.URL, "", nil, 200, "report.txt"},
+		{"only for downloads", http.MethodPut, "/docs/new.txt" + query(tree), "", nil, 405, ""},
+		{"password missing", http.MethodGet, protected.URL, "", nil, 401, ""},
+		{"password wrong", http.MethodGet, protected.URL, "", map[string]string{"X-Share-Password": "guess"}, 401, ""},
+		{"password given", http.MethodGet, protected.URL, "", map[string]string{"X-Share-Password": "hunter2"}, 200, "quarterly report"},
+		{"anonymous can't share", http.MethodPost, "/docs?share", "", nil, 401, ""},
+		{"invalid expiry", http.MethodPost, "/docs?share&expires=forever", "reader", nil, 400, ""},
+		{"only the owner revokes", http.MethodDelete, "/docs?share=" + tree.ID, "writer", nil, 404, ""},
+		{"revoke", http.MethodDelete, "/docs?share=" + tree.ID, "reader", nil, 204, ""},
+		{"revoked", http.MethodGet, "/docs/sub/notes.txt" + query(tree), "", nil, 410, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			rec := doRequest(handler, tt.method, tt.target, tt.user, "", tt.headers)
+			if rec.Code != tt.status {
+				t.Fatalf("Got %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.response != "" && !strings.Contains(rec.Body.String(), tt.response) {
+				t.Errorf("Got body %q, want %q", rec.Body.String(), tt.response)
+			}
+		})
+	}
+
+	rec := doRequest(handler, http.MethodGet, "/docs?shares", "reader", "", nil)
+	var views []shareView
+	if err := json.Unmarshal(rec.Body.Bytes(), &views); err != nil || len(views) != 5 {
+		t.Errorf("Listing got %v, %v", views, err)
+	}
+
+	// an expired link is refused even with a good signature
+	shares := handler.(fileHandler).shares
+	shares.links[protected.ID].Expires = time.Now().Add(-time.Minute).Truncate(time.Second)
+	expired, _ := shares.url(shares.links[protected.ID])
+	if rec := doRequest(handler, http.MethodGet, expired, "", "", map[string]string{"X-Share-Password": "hunter2"}); rec.Code != 410 {
+		t.Errorf("Expired link got %d", rec.Code)
+	}
+
+	// links survive a restart and keep their download counts
+	options.MaxBodySize = 1 << 20
+	restarted := MakeRequestHandlerWithOptions(handler.(fileHandler).accounts, dataDir, options)
+	if rec := doRequest(restarted, http.MethodGet, limited.URL, "", "", nil); rec.Code != 410 {
+		t.Errorf("Used up link got %d after a restart", rec.Code)
+	}
+
+	// rotating keeps links signed by keys still in the file, and removing a key invalidates its links
+	fresh := makeShare(t, restarted, "/docs/report.txt?share", "")
+	writeShareKeys(t, keyFile, "the second signing key", "the first signing key")
+	if rec := doRequest(restarted, http.MethodGet, fresh.URL, "", "", nil); rec.Code != 200 {
+		t.Errorf("Link signed by the old key got %d after rotating", rec.Code)
+	}
+	writeShareKeys(t, keyFile, "the second signing key")
+	if rec := doRequest(restarted, http.MethodGet, fresh.URL, "", "", nil); rec.Code != 403 {
+		t.Errorf("Link signed by a removed key got %d", rec.Code)
+	}
+	if rec := doRequest(restarted, http.MethodGet, "/docs?shares", "reader", "", nil); !strings.Contains(rec.Body.String(), fresh.ID) {
+		t.Errorf("Listing after rotating got %s", rec.Body.String())
+	}
+}
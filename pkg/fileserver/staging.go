@@ -0,0 +1,140 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// stagingPrefix marks files which hold an upload that has not been committed yet
+const stagingPrefix = ".upload-"
+
+func isStagingName(name string) bool {
+	return strings.HasPrefix(name, stagingPrefix)
+}
+
+// stagingName returns an unused staging name in the same directory as name
+func stagingName(name string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(name), stagingPrefix+hex.EncodeToString(b)), nil
+}
+
+// createStagingFile creates an empty file for an upload to diskPath. The file is placed next to
+// the target unless a staging directory is configured, which must be on the same filesystem
+func (storage *LocalStorage) createStagingFile(diskPath string) (*os.File, error) {
+	dir := filepath.Dir(diskPath)
+	if storage.stagingDir != "" {
+		dir = storage.stagingDir
+	}
+	return ioutil.TempFile(dir, stagingPrefix+"*")
+}
+
+// targetMode is the permission a file replacing diskPath should have, keeping that of the old file if there was one
+func targetMode(diskPath string) os.FileMode {
+	if info, err := os.Stat(diskPath); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+// commitStagingFile syncs the staged upload to disk and renames it over diskPath, returning the
+// committed file's info. The staged file is closed, and removed if it could not be committed
+func commitStagingFile(f *os.File, diskPath string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := f.Chmod(targetMode(diskPath))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		// renaming keeps the inode, size and modification time, so this describes the committed file
+		info, err = f.Stat()
+	}
+	if closeerr := f.Close(); err == nil {
+		err = closeerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), diskPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	// sync the directory so the rename itself survives a crash
+	syncDir(filepath.Dir(diskPath))
+	return info, nil
+}
+
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
+
+// discardStagingFile throws away an upload which failed or was rejected
+func discardStagingFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// cleanStagingFiles removes uploads left behind by a previous run of the server
+func (storage *LocalStorage) cleanStagingFiles() {
+	storage.cleanStagingDir(storage.root)
+	if storage.stagingDir != "" {
+		storage.cleanStagingDir(storage.stagingDir)
+	}
+}
+
+func (storage *LocalStorage) cleanStagingDir(root string) {
+	removed := 0
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !isStagingName(info.Name()) {
+			return nil
+		}
+		// directories are archives that were being extracted
+		if os.RemoveAll(p) == nil {
+			removed++
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	if removed > 0 {
+		fmt.Printf("Removed %d stale staging files from %s\n", removed, root)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over filename,
+// so a crash never leaves filename half written
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeerr := tmp.Close(); err == nil {
+		err = closeerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package fileserver
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Storage is where the request handler keeps files. Names are slash separated paths starting at "/",
+// the same paths requests are made for, and are already cleaned by the handler
+type Storage interface {
+	// Open opens a file or directory for reading
+	Open(name string) (StorageFile, error)
+	// Stat describes a file or directory
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir lists a directory sorted by name
+	ReadDir(name string) ([]os.FileInfo, error)
+	// Create starts writing a file which only appears at name, replacing what was there, once it is committed.
+	// The directory it is in must already exist
+	Create(name string) (StagedFile, error)
+	// MkdirAll creates a directory and any parents it needs
+	MkdirAll(name string) error
+	// Rename moves a file or directory, replacing a file at newName
+	Rename(oldName string, newName string) error
+	// Remove removes a file or an empty directory
+	Remove(name string) error
+	// RemoveAll removes a file or a directory and everything in it. A name which doesn't exist is not an error
+	RemoveAll(name string) error
+}
+
+// StorageFile is an open file or directory. Reading a directory returns an error
+type StorageFile interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// StagedFile is a file being written by Storage.Create
+type StagedFile interface {
+	io.Writer
+	// Commit makes the file visible, replacing anything at its name, and returns its info
+	Commit() (os.FileInfo, error)
+	// Abort throws the file away
+	Abort()
+}
+
+// walkStorage calls fn for name and everything under it, parents before their contents.
+// Returning filepath.SkipDir from fn for a directory skips its contents
+func walkStorage(storage Storage, name string, fn func(name string, info os.FileInfo) error) error {
+	info, err := storage.Stat(name)
+	if err != nil {
+		return err
+	}
+	return walkStorageInfo(storage, name, info, fn)
+}
+
+func walkStorageInfo(storage Storage, name string, info os.FileInfo, fn func(name string, info os.FileInfo) error) error {
+	if err := fn(name, info); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	infos, err := storage.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, child := range infos {
+		if err := walkStorageInfo(storage, path.Join(name, child.Name()), child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LocalStorage implements Storage with a directory on the local filesystem
+type LocalStorage struct {
+	root       string
+	stagingDir string
+}
+
+// MakeLocalStorage creates a Storage of the directory root, removing uploads left unfinished by a previous run.
+// Files being uploaded are kept in stagingDir, or next to where they are going if it is empty,
+// which must be on the same filesystem as root
+func MakeLocalStorage(root string, stagingDir string) *LocalStorage {
+	storage := OpenLocalStorage(root, stagingDir)
+	storage.cleanStagingFiles()
+	return storage
+}
+
+// OpenLocalStorage creates a Storage of the directory root like MakeLocalStorage, but leaves unfinished uploads
+// alone, for tools which run alongside a server using the same directory
+func OpenLocalStorage(root string, stagingDir string) *LocalStorage {
+	return &LocalStorage{root: filepath.Clean(root), stagingDir: stagingDir}
+}
+
+// diskPath returns where name is on the local filesystem
+func (storage *LocalStorage) diskPath(name string) string {
+	return filepath.Join(storage.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// Open opens the file with os.Open
+func (storage *LocalStorage) Open(name string) (StorageFile, error) {
+	return os.Open(storage.diskPath(name))
+}
+
+// Stat follows symlinks like os.Stat
+func (storage *LocalStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(storage.diskPath(name))
+}
+
+// ReadDir lists the directory without following symlinks
+func (storage *LocalStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(storage.diskPath(name))
+}
+
+// Create writes to a staging file which is renamed into place on commit
+func (storage *LocalStorage) Create(name string) (StagedFile, error) {
+	diskPath := storage.diskPath(name)
+	f, err := storage.createStagingFile(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	return localStagedFile{File: f, diskPath: diskPath}, nil
+}
+
+// MkdirAll creates the directory with os.MkdirAll
+func (storage *LocalStorage) MkdirAll(name string) error {
+	return os.MkdirAll(storage.diskPath(name), os.ModePerm)
+}
+
+// Rename renames with os.Rename and syncs the directory so the rename survives a crash
+func (storage *LocalStorage) Rename(oldName string, newName string) error {
+	newPath := storage.diskPath(newName)
+	if err := os.Rename(storage.diskPath(oldName), newPath); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(newPath))
+	return nil
+}
+
+// Remove removes with os.Remove
+func (storage *LocalStorage) Remove(name string) error {
+	return os.Remove(storage.diskPath(name))
+}
+
+// RemoveAll removes with os.RemoveAll
+func (storage *LocalStorage) RemoveAll(name string) error {
+	return os.RemoveAll(storage.diskPath(name))
+}
+
+// adopt moves a file from elsewhere on the same filesystem to name without copying it
+func (storage *LocalStorage) adopt(localPath string, name string) (os.FileInfo, error) {
+	diskPath := storage.diskPath(name)
+	if err := os.Chmod(localPath, targetMode(diskPath)); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(localPath, diskPath); err != nil {
+		return nil, err
+	}
+	syncDir(filepath.Dir(diskPath))
+	return os.Stat(diskPath)
+}
+
+type localStagedFile struct {
+	*os.File
+	diskPath string
+}
+
+func (f localStagedFile) Commit() (os.FileInfo, error) {
+	info, err := commitStagingFile(f.File, f.diskPath)
+	if err != nil {
+		return nil, err
+	}
+	return renamedFileInfo{FileInfo: info, name: filepath.Base(f.diskPath)}, nil
+}
+
+// renamedFileInfo describes a staged file by the name it was committed to
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (info renamedFileInfo) Name() string {
+	return info.name
+}
+
+func (f localStagedFile) Abort() {
+	discardStagingFile(f.File)
+}
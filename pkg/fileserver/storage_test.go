@@ -0,0 +1,162 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func writeStorageFile(t *testing.T, storage Storage, name string, contents string) {
+	f, err := storage.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(contents))
+	if _, err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readStorageFile(storage Storage, name string) string {
+	f, err := storage.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	data, _ := ioutil.ReadAll(f)
+	return string(data)
+}
+
+func TestStorage(t *testing.T) {
+	_, server := makeFakeS3(t)
+	storages := map[string]Storage{
+		"local":  MakeLocalStorage(t.TempDir(), ""),
+		"memory": MakeMemStorage(),
+		"s3":     makeTestS3Storage(t, server, 4),
+	}
+	dedup, err := MakeDedupStorage(MakeMemStorage(), MakeMemStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storages["dedup"] = dedup
+	storages["encrypted"] = MakeEncryptedStorage(MakeMemStorage(), makeTestKeyring(t, "storage"))
+	for kind, storage := range storages {
+		t.Run(kind, func(t *testing.T) {
+			if _, err := storage.Create("/missing/file"); err == nil {
+				t.Error("Create without the parent directory succeeded")
+			}
+			if err := storage.MkdirAll("/a/b"); err != nil {
+				t.Fatal(err)
+			}
+
+			staged, err := storage.Create("/a/b/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			staged.Write([]byte("hello"))
+			if _, err := storage.Stat("/a/b/file"); !os.IsNotExist(err) {
+				t.Error("File visible before it was committed")
+			}
+			info, err := staged.Commit()
+			if err != nil || info.Size() != 5 || info.Name() != "file" {
+				t.Fatalf("Commit got %v, %v", info, err)
+			}
+
+			aborted, _ := storage.Create("/a/b/file")
+			aborted.Write([]byte("discarded"))
+			aborted.Abort()
+			if got := readStorageFile(storage, "/a/b/file"); got != "hello" {
+				t.Errorf("Read %q after an aborted replace", got)
+			}
+
+			writeStorageFile(t, storage, "/a/other", "x")
+			infos, err := storage.ReadDir("/a")
+			if err != nil || len(infos) != 2 || infos[0].Name() != "b" || !infos[0].IsDir() || infos[1].Name() != "other" {
+				t.Errorf("ReadDir got %v, %v", infos, err)
+			}
+
+			if err := storage.Remove("/a/b"); err == nil {
+				t.Error("Removed a directory which is not empty")
+			}
+			if err := storage.Rename("/a/b", "/c"); err != nil {
+				t.Fatal(err)
+			}
+			if got := readStorageFile(storage, "/c/file"); got != "hello" {
+				t.Errorf("Read %q after renaming the directory", got)
+			}
+			if _, err := storage.Stat("/a/b/file"); !os.IsNotExist(err) {
+				t.Error("Renamed file still at the old name")
+			}
+			if err := storage.Rename("/a/other", "/c/file"); err != nil || readStorageFile(storage, "/c/file") != "x" {
+				t.Errorf("Rename over a file got %v", err)
+			}
+
+			if err := storage.RemoveAll("/c"); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.RemoveAll("/c"); err != nil {
+				t.Errorf("RemoveAll of a missing name got %v", err)
+			}
+			if _, err := storage.Stat("/c/file"); !os.IsNotExist(err) {
+				t.Error("File still there after RemoveAll")
+			}
+		})
+	}
+}
+
+func TestMemStorageHandler(t *testing.T) {
+	storage := MakeMemStorage()
+	handler, dataDir := makeTestHandler(t, Options{Storage: storage})
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		user        string
+		body        string
+		headers     map[string]string
+		status      int
+		response    string
+	}{
+		{"upload", http.MethodPut, "/dir/file.txt", "writer", "hello world", nil, 201, ""},
+		{"replace", http.MethodPut, "/dir/file.txt", "writer", "hello storage", nil, 204, ""},
+		{"download", http.MethodGet, "/dir/file.txt", "reader", "", nil, 200, "hello storage"},
+		{"range", http.MethodGet, "/dir/file.txt", "reader", "", map[string]string{"Range": "bytes=6-"}, 206, "storage"},
+		{"missing", http.MethodGet, "/nothing.txt", "reader", "", nil, 404, ""},
+		{"directory redirect", http.MethodGet, "/dir", "reader", "", nil, 301, ""},
+		{"not empty", http.MethodDelete, "/dir", "writer", "", nil, 409, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			rec := doRequest(handler, tt.method, tt.target, tt.user, tt.body, tt.headers)
+			if rec.Code != tt.status {
+				t.Fatalf("Got %d, want %d", rec.Code, tt.status)
+			}
+			if tt.response != "" && rec.Body.String() != tt.response {
+				t.Errorf("Got body %q, want %q", rec.Body.String(), tt.response)
+			}
+		})
+	}
+
+	if exists(dataDir, "/dir") {
+		t.Error("Upload was written to the data directory instead of the storage")
+	}
+
+	rec := doRequest(handler, http.MethodGet, "/dir/", "reader", "", map[string]string{"Accept": "application/json"})
+	var listing listResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Entries) != 1 || listing.Entries[0].Name != "file.txt" || listing.Entries[0].Size != 13 {
+		t.Errorf("Unexpected listing %+v", listing.Entries)
+	}
+
+	if rec := doRequest(handler, http.MethodDelete, "/dir/file.txt", "writer", "", nil); rec.Code != 204 {
+		t.Fatalf("DELETE got %d", rec.Code)
+	}
+	if _, err := storage.Stat("/dir/file.txt"); !os.IsNotExist(err) {
+		t.Error("Deleted file still in the storage")
+	}
+}
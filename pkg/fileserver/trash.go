@@ -0,0 +1,314 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// defaultTrashRetention is how long deleted items are kept when Options.TrashRetention is not set
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashInfoFile and trashItemName are the record and the deleted file or directory in each item's directory
+const (
+	trashInfoFile = "info.json"
+	trashItemName = "item"
+)
+
+var errTrashConflict = errors.New("Something already exists at the original path")
+
+// trashItem records where a deleted file or directory came from and who deleted it
+type trashItem struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	User    string    `json:"user"`
+	Deleted time.Time `json:"deleted"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+}
+
+// trashStore keeps deleted items under dir, one directory per item, outside the served data directory
+type trashStore struct {
+	dir       string
+	retention time.Duration
+	lock      sync.Mutex
+}
+
+func (store *trashStore) itemDir(id string) string {
+	return filepath.Join(store.dir, id)
+}
+
+// isTrashID makes sure an id from a request can't name anything but an item directory
+func isTrashID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (store *trashStore) load(id string) (trashItem, error) {
+	var item trashItem
+	data, err := ioutil.ReadFile(filepath.Join(store.itemDir(id), trashInfoFile))
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(data, &item)
+	return item, err
+}
+
+// put moves relativePath from storage into the trash, recording it was deleted by user
+func (store *trashStore) put(storage Storage, relativePath string, user string) (trashItem, error) {
+	info, err := storage.Stat(relativePath)
+	if err != nil {
+		return trashItem{}, err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return trashItem{}, err
+	}
+	item := trashItem{
+		ID:      hex.EncodeToString(b),
+		Path:    relativePath,
+		User:    user,
+		Deleted: time.Now().UTC(),
+		Type:    entryType(info.Mode()),
+		Size:    info.Size(),
+	}
+
+	dir := store.itemDir(item.ID)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return trashItem{}, err
+	}
+	data, _ := json.Marshal(item)
+	// the record is written first so an item is never in the trash without one
+	if err := writeFileAtomic(filepath.Join(dir, trashInfoFile), data); err != nil {
+		os.RemoveAll(dir)
+		return trashItem{}, err
+	}
+	if err := moveOutOfStorage(sealedStorage(storage), relativePath, filepath.Join(dir, trashItemName)); err != nil {
+		os.RemoveAll(dir)
+		return trashItem{}, err
+	}
+	return item, nil
+}
+
+// moveOutOfStorage moves name from storage to the local path dst. A LocalStorage file is simply renamed,
+// anything else is copied out and then removed
+func moveOutOfStorage(storage Storage, name string, dst string) error {
+	if local, ok := storage.(*LocalStorage); ok {
+		return os.Rename(local.diskPath(name), dst)
+	}
+	err := walkStorage(storage, name, func(p string, info os.FileInfo) error {
+		target := filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(p, name)))
+		if info.IsDir() {
+			return os.Mkdir(target, 0700)
+		}
+		return copyFromStorage(storage, p, target)
+	})
+	if err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return storage.RemoveAll(name)
+}
+
+// moveIntoStorage is the reverse of moveOutOfStorage
+func moveIntoStorage(src string, storage Storage, name string) error {
+	if local, ok := storage.(*LocalStorage); ok {
+		return os.Rename(src, local.diskPath(name))
+	}
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := path.Join(name, filepath.ToSlash(strings.TrimPrefix(p, src)))
+		if info.IsDir() {
+			return storage.MkdirAll(target)
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := storage.Create(target)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Abort()
+			return err
+		}
+		_, err = out.Commit()
+		return err
+	})
+	if err != nil {
+		storage.RemoveAll(name)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// list returns the items deleted by user from relativePath or below, newest first
+func (store *trashStore) list(user string, relativePath string) []trashItem {
+	infos, _ := filepath.Glob(filepath.Join(store.dir, "*", trashInfoFile))
+	items := []trashItem{}
+	prefix := strings.TrimSuffix(relativePath, "/") + "/"
+	for _, infoPath := range infos {
+		item, err := store.load(filepath.Base(filepath.Dir(infoPath)))
+		if err != nil || item.User != user {
+			continue
+		}
+		if item.Path == relativePath || strings.HasPrefix(item.Path, prefix) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items
+}
+
+// restore moves an item back to where it was deleted from in storage, refusing to replace anything now there
+func (store *trashStore) restore(item trashItem, storage Storage) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, err := storage.Stat(item.Path); err == nil {
+		return errTrashConflict
+	}
+	if err := storage.MkdirAll(path.Dir(item.Path)); err != nil {
+		return err
+	}
+	if err := moveIntoStorage(filepath.Join(store.itemDir(item.ID), trashItemName), sealedStorage(storage), item.Path); err != nil {
+		return err
+	}
+	return os.RemoveAll(store.itemDir(item.ID))
+}
+
+// files returns the size of every file in item, named as it will be once restored
+func (store *trashStore) files(item trashItem, storage Storage) map[string]int64 {
+	src := filepath.Join(store.itemDir(item.ID), trashItemName)
+	_, sealed := storage.(sealingStorage)
+	files := make(map[string]int64)
+	filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if sealed {
+			info = plainInfo(info)
+		}
+		files[path.Join(item.Path, filepath.ToSlash(strings.TrimPrefix(p, src)))] = info.Size()
+		return nil
+	})
+	return files
+}
+
+// purge removes items deleted longer ago than the retention
+func (store *trashStore) purge(now time.Time) {
+	infos, _ := filepath.Glob(filepath.Join(store.dir, "*", trashInfoFile))
+	for _, infoPath := range infos {
+		id := filepath.Base(filepath.Dir(infoPath))
+		item, err := store.load(id)
+		if err == nil && now.Sub(item.Deleted) > store.retention {
+			store.lock.Lock()
+			if err := os.RemoveAll(store.itemDir(id)); err == nil {
+				fmt.Printf("Purged %s deleted by %s from the trash\n", item.Path, item.User)
+			}
+			store.lock.Unlock()
+		}
+	}
+}
+
+// purgeTrash periodically removes items which have been in the trash longer than the retention
+func (h fileHandler) purgeTrash() {
+	interval := h.trash.retention / 10
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	for {
+		h.trash.purge(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// moveToTrash deletes relativePath by moving it into the trash, forgetting anything cached about it
+func (h fileHandler) moveToTrash(relativePath string, user auth.Account) error {
+	if _, err := h.trash.put(h.storage, relativePath, user.GetName()); err != nil {
+		return err
+	}
+	if h.DigestCache != nil {
+		h.DigestCache.Forget(relativePath)
+	}
+	return nil
+}
+
+// trashHandler lists the caller's deleted items from relativePath or below with GET ?trash, and restores one
+// to where it was deleted from with POST ?untrash=<id>. Only the account which deleted an item can see or restore it
+func (h fileHandler) trashHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	if user.GetName() == "" {
+		requestAuth(w)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.trash.list(user.GetName(), relativePath))
+		return
+	}
+
+	id := r.URL.Query().Get("untrash")
+	if !isTrashID(id) {
+		http.Error(w, "Invalid Trash Item", 400)
+		return
+	}
+	item, err := h.trash.load(id)
+	if err != nil || item.User != user.GetName() {
+		http.Error(w, "Trash Item Not Found", 404)
+		return
+	}
+	if !user.CanWrite(item.Path) {
+		requestAuth(w)
+		return
+	}
+
+	unlock := h.locks.lock(item.Path)
+	defer unlock()
+	before := h.quotas.snapshot(item.Path)
+	reserved, quotaerr := h.quotas.reserve(user, before, h.trash.files(item, h.storage))
+	if quotaerr != nil {
+		http.Error(w, "Insufficient Storage", 507)
+		return
+	}
+	defer h.quotas.release(reserved)
+	defer h.quotas.settle(item.Path, before)
+	if err := h.trash.restore(item, h.storage); err == errTrashConflict {
+		http.Error(w, err.Error(), 409)
+		return
+	} else if os.IsNotExist(err) {
+		http.Error(w, "Trash Item Not Found", 404)
+		return
+	} else if err != nil {
+		fmt.Print("The following error occured while restoring " + item.Path + " from the trash: ")
+		fmt.Println(err)
+		http.Error(w, "Restore Error", 500)
+		return
+	}
+
+	fmt.Printf("Restored %s from the trash for %s\n", item.Path, user.GetName())
+	w.Header().Set("Location", item.Path)
+	w.WriteHeader(201)
+}
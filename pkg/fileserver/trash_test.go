@@ -0,0 +1,102 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+func listTrash(t *testing.T, handler http.Handler, target string, user string) []trashItem {
+	rec := doRequest(handler, http.MethodGet, target+"?trash", user, "", nil)
+	if rec.Code != 200 {
+		t.Fatalf("Listing trash got %d", rec.Code)
+	}
+	var items []trashItem
+	if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestTrash(t *testing.T) {
+	trashDir := t.TempDir()
+	handler, dataDir := makeTestHandler(t, Options{TrashDir: trashDir})
+	handler.(fileHandler).accounts.AddUser(auth.Account{User: "other", Readable: []string{"/"}, Writeable: []string{"/"}})
+	writeTestFile(t, dataDir, "/docs/a.txt", "a")
+	writeTestFile(t, dataDir, "/docs/sub/b.txt", "b")
+
+	if rec := doRequest(handler, http.MethodDelete, "/docs/a.txt", "writer", "", nil); rec.Code != 204 {
+		t.Fatalf("DELETE got %d", rec.Code)
+	}
+	if rec := doRequest(handler, http.MethodDelete, "/docs/sub?recursive", "writer", "", nil); rec.Code != 204 {
+		t.Fatalf("Recursive DELETE got %d", rec.Code)
+	}
+	if exists(dataDir, "/docs/a.txt") || exists(dataDir, "/docs/sub") {
+		t.Fatal("Deleted items still in the data directory")
+	}
+
+	items := listTrash(t, handler, "/docs/", "writer")
+	if len(items) != 2 || items[0].Path != "/docs/sub" || items[0].Type != "dir" || items[1].User != "writer" {
+		t.Fatalf("Unexpected trash listing %+v", items)
+	}
+	if others := listTrash(t, handler, "/", "other"); len(others) != 0 {
+		t.Errorf("Another account sees %d trashed items", len(others))
+	}
+	if elsewhere := listTrash(t, handler, "/else/", "writer"); len(elsewhere) != 0 {
+		t.Errorf("Listing another directory shows %d items", len(elsewhere))
+	}
+
+	var tests = []struct {
+		description string
+		target      string
+		user        string
+		status      int
+	}{
+		{"anonymous cannot list", "/?trash", "", 401},
+		{"not your item", "/?untrash=" + items[1].ID, "other", 404},
+		{"bad id", "/?untrash=../../etc", "writer", 400},
+		{"restore file", "/?untrash=" + items[1].ID, "writer", 201},
+		{"restore directory", "/?untrash=" + items[0].ID, "writer", 201},
+		{"already restored", "/?untrash=" + items[0].ID, "writer", 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			method := http.MethodPost
+			if tt.target == "/?trash" {
+				method = http.MethodGet
+			}
+			if rec := doRequest(handler, method, tt.target, tt.user, "", nil); rec.Code != tt.status {
+				t.Errorf("Got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+	if readTestFile(t, dataDir, "/docs/a.txt") != "a" || readTestFile(t, dataDir, "/docs/sub/b.txt") != "b" {
+		t.Error("Restored files have the wrong contents")
+	}
+
+	// restoring never replaces what is there now
+	doRequest(handler, http.MethodDelete, "/docs/a.txt", "writer", "", nil)
+	writeTestFile(t, dataDir, "/docs/a.txt", "new")
+	items = listTrash(t, handler, "/", "writer")
+	if rec := doRequest(handler, http.MethodPost, "/?untrash="+items[0].ID, "writer", "", nil); rec.Code != 409 {
+		t.Errorf("Restoring over an existing file got %d", rec.Code)
+	}
+
+	store := &trashStore{dir: trashDir, retention: time.Hour}
+	store.purge(time.Now().Add(2 * time.Hour))
+	if left, _ := filepath.Glob(filepath.Join(trashDir, "*")); len(left) != 0 {
+		t.Errorf("Purge left %v", left)
+	}
+}
+
+func TestTrashInsideDataDir(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{})
+	h := MakeRequestHandlerWithOptions(handler.(fileHandler).accounts, dataDir, Options{MaxBodySize: 1 << 20, TrashDir: filepath.Join(dataDir, "trash")})
+	if h.(fileHandler).trash != nil {
+		t.Error("Trash inside the data directory was enabled")
+	}
+}
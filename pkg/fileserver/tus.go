@@ -0,0 +1,593 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// tusVersion is the only version of the tus resumable upload protocol we speak
+const tusVersion = "1.0.0"
+
+// tusDefaultExpiry is how long an unfinished upload is kept when Options.TusExpiry is not set
+const tusDefaultExpiry = 24 * time.Hour
+
+// tusUpload describes an unfinished upload. It is stored as <id>.info next to the data in <id>.bin
+type tusUpload struct {
+	ID          string
+	Owner       string
+	Destination string
+	Length      int64
+	Metadata    string
+	Expires     time.Time
+	// Key is the data key the staged data is encrypted with, wrapped like in the header of an encrypted file.
+	// It is only set when the storage is encrypted
+	Key []byte `json:",omitempty"`
+	// Conditions are the precondition headers the upload was created with, checked again as it completes
+	Conditions map[string]string `json:",omitempty"`
+}
+
+// tusConditions are the headers of checkPreconditions, which apply to the upload as a whole
+var tusConditions = []string{"If-Match", "If-None-Match", "If-Unmodified-Since"}
+
+// tusAlgorithms maps the names tus clients use for Upload-Checksum onto hashAlgorithms
+var tusAlgorithms = map[string]string{
+	"md5":     "md5",
+	"sha1":    "sha-1",
+	"sha-1":   "sha-1",
+	"sha256":  "sha-256",
+	"sha-256": "sha-256",
+	"sha512":  "sha-512",
+	"sha-512": "sha-512",
+}
+
+func (h fileHandler) tusExpiry() time.Duration {
+	if h.TusExpiry > 0 {
+		return h.TusExpiry
+	}
+	return tusDefaultExpiry
+}
+
+func (h fileHandler) tusInfoPath(id string) string {
+	return filepath.Join(h.TusDir, id+".info")
+}
+
+func (h fileHandler) tusDataPath(id string) string {
+	return filepath.Join(h.TusDir, id+".bin")
+}
+
+// isTusID makes sure an id from a URL can only ever name a file directly inside TusDir
+func isTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (h fileHandler) loadTusUpload(id string) (tusUpload, error) {
+	var upload tusUpload
+	data, err := ioutil.ReadFile(h.tusInfoPath(id))
+	if err != nil {
+		return upload, err
+	}
+	err = json.Unmarshal(data, &upload)
+	return upload, err
+}
+
+func (h fileHandler) saveTusUpload(upload tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(h.tusInfoPath(upload.ID), data, 0600)
+}
+
+func (h fileHandler) removeTusUpload(id string) {
+	os.Remove(h.tusDataPath(id))
+	os.Remove(h.tusInfoPath(id))
+}
+
+// tusStream is the AES-CTR key stream of an upload's staged data from offset on. Unlike the chunks of an
+// encrypted file it can start at any byte, so data can be appended however it arrives and cut back after a bad chunk
+func (h fileHandler) tusStream(upload tusUpload, offset int64) (cipher.Stream, error) {
+	keyring := storageKeyring(h.storage)
+	if keyring == nil {
+		return nil, errUnknownKey
+	}
+	dataKey, _, err := keyring.unwrap(upload.Key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	// every upload has its own data key, so the counter can simply start at zero
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(block, iv)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream, nil
+}
+
+// openTusData opens the staged data of an upload for reading its plaintext
+func (h fileHandler) openTusData(upload tusUpload) (io.ReadCloser, error) {
+	f, err := os.Open(h.tusDataPath(upload.ID))
+	if err != nil || upload.Key == nil {
+		return f, err
+	}
+	stream, err := h.tusStream(upload, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{cipher.StreamReader{S: stream, R: f}, f}, nil
+}
+
+// expireTusUploads periodically removes unfinished uploads which have passed their expiry
+func (h fileHandler) expireTusUploads() {
+	interval := h.tusExpiry() / 10
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+
+	for {
+		infos, _ := filepath.Glob(filepath.Join(h.TusDir, "*.info"))
+		for _, infoPath := range infos {
+			id := strings.TrimSuffix(filepath.Base(infoPath), ".info")
+			upload, err := h.loadTusUpload(id)
+			if err == nil && time.Now().After(upload.Expires) {
+				fmt.Printf("Expiring unfinished upload %s to %s\n", id, upload.Destination)
+				h.removeTusUpload(id)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header of comma separated "key base64value" pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(kv) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(decoded)
+		}
+		metadata[kv[0]] = value
+	}
+	return metadata, nil
+}
+
+// insertTusOptions advertises the parts of tus we support
+func (h fileHandler) insertTusOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,checksum,expiration")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxBodySize, 10))
+	w.Header().Set("Tus-Checksum-Algorithm", "sha1,sha256,sha512,md5")
+}
+
+// tusHandler implements the tus 1.0 core protocol with the creation, termination, checksum and
+// expiration extensions. A POST with Tus-Resumable to a file path creates an upload which is then
+// addressed as that path with ?tus=<id>, and is moved into place once every byte has arrived
+func (h fileHandler) tusHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported Tus Version", 412)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		h.tusCreate(w, r, relativePath, user)
+		return
+	}
+
+	id := r.URL.Query().Get("tus")
+	if !isTusID(id) {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	unlock := h.locks.lock(h.tusInfoPath(id))
+	defer unlock()
+
+	upload, loaderr := h.loadTusUpload(id)
+	if loaderr != nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	// an upload is only reachable through its own path, by the account which created it
+	if upload.Destination != relativePath || upload.Owner != user.GetName() || !user.CanWrite(upload.Destination) {
+		requestAuth(w)
+		return
+	}
+	if time.Now().After(upload.Expires) {
+		h.removeTusUpload(id)
+		http.Error(w, "Upload Expired", 410)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		h.tusHead(w, upload)
+	case http.MethodPatch:
+		// the last chunk moves the upload into place, so every chunk must be allowed to change the file like a PUT
+		release, ok := h.confirmDavLocks(w, r, upload.Destination)
+		if !ok {
+			return
+		}
+		defer release()
+		h.tusPatch(w, r, upload, user)
+	case http.MethodDelete:
+		h.removeTusUpload(id)
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method Not Supported", 405)
+	}
+}
+
+func (h fileHandler) tusCreate(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	length, parseerr := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if parseerr != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", 400)
+		return
+	}
+	if length > h.MaxBodySize {
+		http.Error(w, "Request Body Too Large", 413)
+		return
+	}
+
+	metadata, metaerr := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if metaerr != nil {
+		http.Error(w, "Invalid Upload-Metadata", 400)
+		return
+	}
+
+	// creating in a directory names the file after the filename metadata
+	destination := relativePath
+	if info, err := h.storage.Stat(relativePath); err == nil && info.IsDir() {
+		filename := path.Base(path.Clean("/" + metadata["filename"]))
+		if filename == "/" || isStagingName(filename) {
+			http.Error(w, "Upload-Metadata Needs A Filename", 400)
+			return
+		}
+		destination = path.Join(relativePath, filename)
+	}
+
+	if !user.CanWrite(destination) {
+		requestAuth(w)
+		return
+	}
+
+	// fail early rather than receive data that could never be stored, as for a PUT
+	release, ok := h.confirmDavLocks(w, r, destination)
+	if !ok {
+		return
+	}
+	release()
+	if !h.checkPreconditions(w, r, destination) {
+		return
+	}
+
+	if left, quotaerr := h.quotas.headroom(user, destination, h.quotas.fileUsage(destination)); quotaerr != nil || (left >= 0 && length > left) {
+		fmt.Printf("Rejecting upload to %s for %s as it is over quota\n", destination, user.GetName())
+		http.Error(w, "Insufficient Storage", 507)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		http.Error(w, "Could not create upload", 500)
+		return
+	}
+
+	upload := tusUpload{
+		ID:          hex.EncodeToString(idBytes),
+		Owner:       user.GetName(),
+		Destination: destination,
+		Length:      length,
+		Metadata:    r.Header.Get("Upload-Metadata"),
+		Expires:     time.Now().Add(h.tusExpiry()),
+	}
+	for _, header := range tusConditions {
+		if value := r.Header.Get(header); value != "" {
+			if upload.Conditions == nil {
+				upload.Conditions = make(map[string]string)
+			}
+			upload.Conditions[header] = value
+		}
+	}
+	// the data waits in TusDir until it is complete, so it is kept as safe as it will be in storage
+	if keyring := storageKeyring(h.storage); keyring != nil {
+		dataKey := make([]byte, 32)
+		_, keyerr := rand.Read(dataKey)
+		if keyerr == nil {
+			upload.Key, keyerr = keyring.header(dataKey)
+		}
+		if keyerr != nil {
+			http.Error(w, "Could not create upload", 500)
+			return
+		}
+	}
+
+	f, createerr := os.OpenFile(h.tusDataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if createerr == nil {
+		f.Close()
+		createerr = h.saveTusUpload(upload)
+	}
+	if createerr != nil {
+		h.removeTusUpload(upload.ID)
+		fmt.Print("The following error occured while trying to create an upload for " + destination + ": ")
+		fmt.Println(createerr)
+		http.Error(w, "Could not create upload", 500)
+		return
+	}
+
+	fmt.Printf("Created upload %s of %d bytes to %s for %s\n", upload.ID, length, destination, upload.Owner)
+
+	location := url.URL{Path: destination, RawQuery: "tus=" + upload.ID}
+	w.Header().Set("Location", location.String())
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(201)
+}
+
+func (h fileHandler) tusHead(w http.ResponseWriter, upload tusUpload) {
+	info, staterr := os.Stat(h.tusDataPath(upload.ID))
+	if staterr != nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+}
+
+// parseUploadChecksum parses an Upload-Checksum header of the form "<algorithm> <base64 digest>"
+func parseUploadChecksum(header string) (string, []byte, bool) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	algorithm, ok := tusAlgorithms[strings.ToLower(parts[0])]
+	if !ok {
+		return "", nil, false
+	}
+	sum, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, false
+	}
+	return algorithm, sum, true
+}
+
+func (h fileHandler) tusPatch(w http.ResponseWriter, r *http.Request, upload tusUpload, user auth.Account) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Unsupported Media Type", 415)
+		return
+	}
+
+	var checksumAlgorithm string
+	var checksum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		var ok bool
+		if checksumAlgorithm, checksum, ok = parseUploadChecksum(header); !ok {
+			http.Error(w, "Unsupported Upload-Checksum", 400)
+			return
+		}
+	}
+
+	f, openerr := os.OpenFile(h.tusDataPath(upload.ID), os.O_WRONLY, 0600)
+	if openerr != nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	defer f.Close()
+
+	offset, _ := f.Seek(0, io.SeekEnd)
+	if requested, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || requested != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, "Upload-Offset Conflict", 409)
+		return
+	}
+
+	remaining := upload.Length - offset
+	if r.ContentLength > remaining {
+		http.Error(w, "Body Exceeds Upload-Length", 413)
+		return
+	}
+
+	// the quota may have filled up since the upload was created, so check it before every chunk as for a PUT
+	if left, quotaerr := h.quotas.headroom(user, upload.Destination, h.quotas.fileUsage(upload.Destination)); quotaerr != nil || (left >= 0 && upload.Length > left) {
+		h.removeTusUpload(upload.ID)
+		fmt.Printf("Discarding upload %s to %s for %s as it is over quota\n", upload.ID, upload.Destination, user.GetName())
+		http.Error(w, "Insufficient Storage", 507)
+		return
+	}
+
+	var staged io.Writer = f
+	if upload.Key != nil {
+		stream, keyerr := h.tusStream(upload, offset)
+		if keyerr != nil {
+			fmt.Print("The following error occured while unwrapping the key of upload " + upload.ID + ": ")
+			fmt.Println(keyerr)
+			http.Error(w, "Write Error", 500)
+			return
+		}
+		staged = cipher.StreamWriter{S: stream, W: f}
+	}
+
+	digests := newDigestSet([]string{checksumAlgorithm})
+	// read one byte past the end so a body without Content-Length can't overflow the upload unnoticed
+	written, writeerr := io.Copy(digests.writer(staged), io.LimitReader(r.Body, remaining+1))
+
+	if written > remaining {
+		f.Truncate(offset)
+		http.Error(w, "Body Exceeds Upload-Length", 413)
+		return
+	}
+	if checksum != nil {
+		if writeerr != nil || !bytes.Equal(checksum, digests.sums()[checksumAlgorithm]) {
+			// the checksum covers the whole chunk, so a partial or corrupt chunk is thrown away entirely
+			f.Truncate(offset)
+			http.Error(w, "Checksum Mismatch", 460)
+			return
+		}
+	}
+	if syncerr := f.Sync(); syncerr != nil && writeerr == nil {
+		writeerr = syncerr
+	}
+
+	// keep whatever did arrive so the client can resume from it
+	offset += written
+	upload.Expires = time.Now().Add(h.tusExpiry())
+	h.saveTusUpload(upload)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+
+	if writeerr != nil {
+		fmt.Print("The following error occured while writing to upload " + upload.ID + ": ")
+		fmt.Println(writeerr)
+		http.Error(w, "Write Error", 500)
+		return
+	}
+
+	if offset == upload.Length && !h.tusComplete(w, upload, user) {
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// tusComplete moves a finished upload into storage. With a LocalStorage, TusDir must be on the same filesystem
+func (h fileHandler) tusComplete(w http.ResponseWriter, upload tusUpload, user auth.Account) bool {
+	name := upload.Destination
+
+	algorithms := []string{"sha-256"}
+	if h.DigestCache != nil {
+		algorithms = append(algorithms, indexedAlgorithms...)
+	}
+	digests := newDigestSet(algorithms)
+
+	f, openerr := h.openTusData(upload)
+	if os.IsNotExist(openerr) {
+		http.Error(w, "Not Found", 404)
+		return false
+	}
+	readerr := openerr
+	if readerr == nil {
+		_, readerr = io.Copy(digests.writer(ioutil.Discard), f)
+		f.Close()
+	}
+
+	if readerr == nil {
+		readerr = h.makeParents(name)
+	}
+	if readerr == nil {
+		unlock := h.locks.lock(name)
+		// another request may have changed the file while the upload was arriving
+		conditions := &http.Request{Header: make(http.Header)}
+		for header, value := range upload.Conditions {
+			conditions.Header.Set(header, value)
+		}
+		if !h.checkPreconditions(w, conditions, name) {
+			unlock()
+			h.removeTusUpload(upload.ID)
+			fmt.Printf("Discarding upload %s to %s as its preconditions no longer hold\n", upload.ID, name)
+			return false
+		}
+
+		// the quota may have filled up while the upload was arriving
+		before, after := h.quotas.fileUsage(name), quotaUsage{Bytes: upload.Length, Files: 1}
+		readerr = h.quotas.charge(user, name, before, after)
+		if readerr == nil {
+			readerr = h.saveVersion(name)
+			var info os.FileInfo
+			if readerr == nil {
+				info, readerr = h.storeTusData(upload, name)
+			}
+			if readerr != nil {
+				h.quotas.refund(name, before, after)
+			} else if h.DigestCache != nil {
+				h.DigestCache.Set(name, info, digests.sums())
+			}
+		}
+		unlock()
+	}
+	if readerr == errQuotaExceeded {
+		h.removeTusUpload(upload.ID)
+		fmt.Printf("Discarding upload %s to %s for %s as it is over quota\n", upload.ID, name, user.GetName())
+		http.Error(w, "Insufficient Storage", 507)
+		return false
+	} else if readerr != nil {
+		fmt.Print("The following error occured while completing upload " + upload.ID + " to " + name + ": ")
+		fmt.Println(readerr)
+		http.Error(w, "Could not complete upload", 500)
+		return false
+	}
+
+	os.Remove(h.tusDataPath(upload.ID))
+	os.Remove(h.tusInfoPath(upload.ID))
+	fmt.Printf("Completed upload %s to %s\n", upload.ID, upload.Destination)
+	w.Header().Set("ETag", formatETag(digests.sums()["sha-256"]))
+	return true
+}
+
+// storeTusData puts the staged data of an upload into storage as name. A LocalStorage takes the file
+// as it is, otherwise it is copied and left for the caller to remove
+func (h fileHandler) storeTusData(upload tusUpload, name string) (os.FileInfo, error) {
+	if local, ok := h.storage.(*LocalStorage); ok && upload.Key == nil {
+		return local.adopt(h.tusDataPath(upload.ID), name)
+	}
+
+	in, err := h.openTusData(upload)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := h.storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return nil, err
+	}
+	return out.Commit()
+}
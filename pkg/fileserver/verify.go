@@ -0,0 +1,118 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// expectedDigest is a digest the client sent with an upload, checked against the body as it streams in
+type expectedDigest struct {
+	header    string
+	algorithm string
+	// candidates are the acceptable decodings of the value. Digest values are meant to be base64
+	// but this server has always sent hex, so clients may echo either
+	candidates [][]byte
+}
+
+func (d expectedDigest) matches(sum []byte) bool {
+	for _, c := range d.candidates {
+		if bytes.Equal(c, sum) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeDigestValue(value string) [][]byte {
+	var candidates [][]byte
+	if b, err := base64.StdEncoding.DecodeString(value); err == nil {
+		candidates = append(candidates, b)
+	}
+	if b, err := hex.DecodeString(value); err == nil {
+		candidates = append(candidates, b)
+	}
+	return candidates
+}
+
+// parseExpectedDigests collects every digest of a supported algorithm from the Digest,
+// Content-Digest and Content-MD5 headers. Unsupported algorithms are ignored
+func parseExpectedDigests(header http.Header) ([]expectedDigest, error) {
+	var digests []expectedDigest
+
+	add := func(headerName string, algorithm string, candidates [][]byte) error {
+		if _, ok := hashAlgorithms[strings.ToLower(algorithm)]; !ok {
+			return nil
+		}
+		if len(candidates) == 0 {
+			return errors.New("Could not decode " + headerName + " value for " + algorithm)
+		}
+		digests = append(digests, expectedDigest{header: headerName, algorithm: algorithm, candidates: candidates})
+		return nil
+	}
+
+	// RFC 3230: Digest: sha-256=base64, md5=base64
+	for _, line := range header.Values("Digest") {
+		for _, item := range strings.Split(line, ",") {
+			kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("Malformed Digest header")
+			}
+			if err := add("Digest", kv[0], decodeDigestValue(kv[1])); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// RFC 9530: Content-Digest: sha-256=:base64:, sha-512=:base64:
+	for _, line := range header.Values("Content-Digest") {
+		for _, item := range strings.Split(line, ",") {
+			kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(kv) != 2 || len(kv[1]) < 2 || !strings.HasPrefix(kv[1], ":") || !strings.HasSuffix(kv[1], ":") {
+				return nil, errors.New("Malformed Content-Digest header")
+			}
+			var candidates [][]byte
+			if b, err := base64.StdEncoding.DecodeString(strings.Trim(kv[1], ":")); err == nil {
+				candidates = append(candidates, b)
+			}
+			if err := add("Content-Digest", kv[0], candidates); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// RFC 1864: Content-MD5: base64
+	if value := header.Get("Content-MD5"); value != "" {
+		var candidates [][]byte
+		if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value)); err == nil {
+			candidates = append(candidates, b)
+		}
+		if err := add("Content-MD5", "md5", candidates); err != nil {
+			return nil, err
+		}
+	}
+
+	return digests, nil
+}
+
+// expectedAlgorithms lists the algorithms needed to check the expected digests
+func expectedAlgorithms(digests []expectedDigest) []string {
+	algorithms := make([]string, len(digests))
+	for i, d := range digests {
+		algorithms[i] = d.algorithm
+	}
+	return algorithms
+}
+
+// firstMismatch returns the first expected digest which does not match the received sums, or nil
+func firstMismatch(digests []expectedDigest, sums map[string][]byte) *expectedDigest {
+	for i := range digests {
+		if !digests[i].matches(sums[canonicalAlgorithm(digests[i].algorithm)]) {
+			return &digests[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zggz/securefileserver/pkg/auth"
+)
+
+// versionsFile is the name of the index kept alongside the versions of each file
+const versionsFile = "versions.json"
+
+// VersionPolicy is how long previous versions of files under Prefix are kept. A version is removed once
+// there are more than KeepLast newer ones, or it is older than KeepFor. Zero means no limit
+type VersionPolicy struct {
+	Prefix   string
+	KeepLast int
+	KeepFor  time.Duration
+}
+
+// ParseVersionPolicies reads policies written as comma separated prefix=keepLast:days, such as
+// "/=20:90,/releases=5:0"
+func ParseVersionPolicies(spec string) ([]VersionPolicy, error) {
+	var policies []VersionPolicy
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") {
+			return nil, fmt.Errorf("Invalid version policy %q", item)
+		}
+		limits := strings.SplitN(kv[1], ":", 2)
+		if len(limits) != 2 {
+			return nil, fmt.Errorf("Invalid version policy %q", item)
+		}
+		keepLast, lasterr := strconv.Atoi(limits[0])
+		days, dayserr := strconv.Atoi(limits[1])
+		if lasterr != nil || dayserr != nil || keepLast < 0 || days < 0 {
+			return nil, fmt.Errorf("Invalid version policy %q", item)
+		}
+		policies = append(policies, VersionPolicy{Prefix: path.Clean(kv[0]), KeepLast: keepLast, KeepFor: time.Duration(days) * 24 * time.Hour})
+	}
+	return policies, nil
+}
+
+// fileVersion is one previous content of a file
+type fileVersion struct {
+	Version  int       `json:"version"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Archived time.Time `json:"archived"`
+}
+
+// versionIndex lists the versions kept of one path
+type versionIndex struct {
+	Path     string        `json:"path"`
+	Next     int           `json:"next"`
+	Versions []fileVersion `json:"versions"`
+}
+
+// versionStore keeps previous versions of files under dir, one directory per path named by the hash of
+// the path, so files and directories of the same name never collide. Versions are hard links where
+// possible so keeping them costs nothing until the file is replaced
+type versionStore struct {
+	dir      string
+	policies []VersionPolicy
+	lock     sync.Mutex
+}
+
+func makeVersionStore(dir string, policies []VersionPolicy) *versionStore {
+	return &versionStore{dir: dir, policies: policies}
+}
+
+func (store *versionStore) keyDir(relativePath string) string {
+	sum := sha256.Sum256([]byte(relativePath))
+	return filepath.Join(store.dir, hex.EncodeToString(sum[:]))
+}
+
+func (store *versionStore) versionPath(relativePath string, version int) string {
+	return filepath.Join(store.keyDir(relativePath), strconv.Itoa(version))
+}
+
+// load reads the index of relativePath. Must be called with the lock held
+func (store *versionStore) load(relativePath string) (versionIndex, error) {
+	index := versionIndex{Path: relativePath, Next: 1}
+	data, err := ioutil.ReadFile(filepath.Join(store.keyDir(relativePath), versionsFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
+
+// save writes the index, removing the directory once no versions are left. Must be called with the lock held
+func (store *versionStore) save(index versionIndex) error {
+	dir := store.keyDir(index.Path)
+	if len(index.Versions) == 0 {
+		return os.RemoveAll(dir)
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, versionsFile), data)
+}
+
+// policy returns the policy with the longest prefix covering relativePath
+func (store *versionStore) policy(relativePath string) VersionPolicy {
+	best := VersionPolicy{Prefix: ""}
+	for _, p := range store.policies {
+		covers := p.Prefix == "/" || relativePath == p.Prefix || strings.HasPrefix(relativePath, p.Prefix+"/")
+		if covers && len(p.Prefix) > len(best.Prefix) {
+			best = p
+		}
+	}
+	return best
+}
+
+// prune drops the versions the path's policy no longer keeps. Must be called with the lock held
+func (store *versionStore) prune(index *versionIndex, now time.Time) {
+	policy := store.policy(index.Path)
+	kept := index.Versions[:0]
+	for i, v := range index.Versions {
+		newer := len(index.Versions) - 1 - i
+		expired := policy.KeepFor > 0 && now.Sub(v.Archived) > policy.KeepFor
+		if (policy.KeepLast > 0 && newer >= policy.KeepLast) || expired {
+			os.Remove(store.versionPath(index.Path, v.Version))
+			continue
+		}
+		kept = append(kept, v)
+	}
+	index.Versions = kept
+}
+
+// add keeps the current content of relativePath in storage as its newest version.
+// It does nothing if there is no regular file there
+func (store *versionStore) add(storage Storage, relativePath string) error {
+	info, err := storage.Stat(relativePath)
+	if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	index, err := store.load(relativePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(store.keyDir(relativePath), 0700); err != nil {
+		return err
+	}
+
+	version := index.Next
+	target := store.versionPath(relativePath, version)
+	// a local file is hard linked rather than copied when the version directory is on the same filesystem
+	stored := sealedStorage(storage)
+	local, isLocal := stored.(*LocalStorage)
+	if !isLocal || os.Link(local.diskPath(relativePath), target) != nil {
+		if copyerr := copyFromStorage(stored, relativePath, target); copyerr != nil {
+			return copyerr
+		}
+	}
+
+	index.Next++
+	index.Versions = append(index.Versions, fileVersion{Version: version, Size: info.Size(), ModTime: info.ModTime().UTC(), Archived: time.Now().UTC()})
+	store.prune(&index, time.Now())
+	return store.save(index)
+}
+
+// list returns the versions kept of relativePath, oldest first
+func (store *versionStore) list(relativePath string) ([]fileVersion, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	index, err := store.load(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	return index.Versions, nil
+}
+
+// open returns one version of relativePath, which was kept from storage
+func (store *versionStore) open(storage Storage, relativePath string, version int) (StorageFile, fileVersion, error) {
+	versions, err := store.list(relativePath)
+	if err != nil {
+		return nil, fileVersion{}, err
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			f, err := os.Open(store.versionPath(relativePath, version))
+			if s, ok := storage.(sealingStorage); ok && err == nil {
+				unsealed, unsealerr := s.unseal(f)
+				if unsealerr != nil {
+					f.Close()
+				}
+				return unsealed, v, unsealerr
+			}
+			return f, v, err
+		}
+	}
+	return nil, fileVersion{}, os.ErrNotExist
+}
+
+// expire applies the retention policies to every path, so versions age out even if a file is never written again
+func (store *versionStore) expire() {
+	indexes, _ := filepath.Glob(filepath.Join(store.dir, "*", versionsFile))
+	for _, indexPath := range indexes {
+		data, err := ioutil.ReadFile(indexPath)
+		var index versionIndex
+		if err != nil || json.Unmarshal(data, &index) != nil {
+			continue
+		}
+
+		store.lock.Lock()
+		if index, err = store.load(index.Path); err == nil {
+			before := len(index.Versions)
+			store.prune(&index, time.Now())
+			if len(index.Versions) != before {
+				store.save(index)
+			}
+		}
+		store.lock.Unlock()
+	}
+}
+
+// copyFromStorage copies the file name in storage to a new local file dst
+func copyFromStorage(storage Storage, name string, dst string) error {
+	in, err := storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeerr := out.Close(); err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// saveVersion keeps the content of relativePath before it is replaced or deleted, if versioning is enabled
+func (h fileHandler) saveVersion(relativePath string) error {
+	if h.versions == nil {
+		return nil
+	}
+	return h.versions.add(h.storage, relativePath)
+}
+
+// saveTreeVersions keeps every file under relativePath before a directory is deleted or replaced
+func (h fileHandler) saveTreeVersions(relativePath string) error {
+	if h.versions == nil {
+		return nil
+	}
+	return walkStorage(h.storage, relativePath, func(name string, info os.FileInfo) error {
+		if info.Mode().IsRegular() && !isStagingName(info.Name()) {
+			return h.saveVersion(name)
+		}
+		return nil
+	})
+}
+
+// expireVersions periodically applies the retention policies
+func (h fileHandler) expireVersions() {
+	for {
+		h.versions.expire()
+		time.Sleep(time.Hour)
+	}
+}
+
+// versionNumber parses the version asked for in a query parameter
+func versionNumber(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, errors.New("Invalid version")
+	}
+	return n, nil
+}
+
+// versionsHandler answers ?versions with the versions kept of a file as JSON, and ?version=N with that version's content
+func (h fileHandler) versionsHandler(w http.ResponseWriter, r *http.Request, relativePath string) {
+	if value := r.URL.Query().Get("version"); value != "" {
+		version, err := versionNumber(value)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		f, v, err := h.versions.open(h.storage, relativePath, version)
+		if err != nil {
+			http.Error(w, "Version Not Found", 404)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("X-Version", strconv.Itoa(v.Version))
+		http.ServeContent(w, r, path.Base(relativePath), v.ModTime, f)
+		return
+	}
+
+	versions, err := h.versions.list(relativePath)
+	if err != nil {
+		http.Error(w, "Could not read versions", 500)
+		return
+	}
+	if versions == nil {
+		versions = []fileVersion{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Path     string        `json:"path"`
+		Versions []fileVersion `json:"versions"`
+	}{relativePath, versions})
+}
+
+// restoreHandler replaces a file with one of its versions given by ?restore=N. The content being replaced
+// becomes a version itself, so a restore can be undone
+func (h fileHandler) restoreHandler(w http.ResponseWriter, r *http.Request, relativePath string, user auth.Account) {
+	version, err := versionNumber(r.URL.Query().Get("restore"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	src, _, err := h.versions.open(h.storage, relativePath, version)
+	if err != nil {
+		http.Error(w, "Version Not Found", 404)
+		return
+	}
+	defer src.Close()
+
+	if err := h.makeParents(relativePath); err != nil {
+		http.Error(w, "Could not create required directories", 500)
+		return
+	}
+	f, err := h.storage.Create(relativePath)
+	if err != nil {
+		http.Error(w, "File Create Error", 500)
+		return
+	}
+	digests := newDigestSet([]string{"sha-256"})
+	written, err := io.Copy(digests.writer(f), src)
+	if err != nil {
+		f.Abort()
+		http.Error(w, "Write Error", 500)
+		return
+	}
+	unlock := h.locks.lock(relativePath)
+	defer unlock()
+	if !h.checkPreconditions(w, r, relativePath) {
+		f.Abort()
+		return
+	}
+	if info, err := h.storage.Stat(relativePath); err == nil && info.IsDir() {
+		f.Abort()
+		http.Error(w, "Is A Directory", 409)
+		return
+	}
+	_, staterr := h.storage.Stat(relativePath)
+	created := os.IsNotExist(staterr)
+
+	before, after := h.quotas.fileUsage(relativePath), quotaUsage{Bytes: written, Files: 1}
+	if err := h.quotas.charge(user, relativePath, before, after); err != nil {
+		f.Abort()
+		http.Error(w, "Insufficient Storage", 507)
+		return
+	}
+
+	if err := h.saveVersion(relativePath); err != nil {
+		h.quotas.refund(relativePath, before, after)
+		f.Abort()
+		fmt.Print("The following error occured while keeping a version of " + relativePath + ": ")
+		fmt.Println(err)
+		http.Error(w, "Version Error", 500)
+		return
+	}
+	if _, err := f.Commit(); err != nil {
+		h.quotas.refund(relativePath, before, after)
+		fmt.Print("The following error occured while restoring " + relativePath + ": ")
+		fmt.Println(err)
+		http.Error(w, "Write Error", 500)
+		return
+	}
+	if h.DigestCache != nil {
+		h.DigestCache.Forget(relativePath)
+	}
+
+	fmt.Printf("Restored version %d of %s for %s\n", version, relativePath, user.GetName())
+	w.Header().Set("ETag", formatETag(digests.sums()["sha-256"]))
+	if created {
+		w.WriteHeader(201)
+	} else {
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,121 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func listVersions(t *testing.T, handler http.Handler, target string, user string) []int {
+	rec := doRequest(handler, http.MethodGet, target+"?versions", user, "", nil)
+	if rec.Code != 200 {
+		t.Fatalf("Listing versions of %s got %d", target, rec.Code)
+	}
+	var response struct {
+		Versions []fileVersion `json:"versions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	numbers := []int{}
+	for _, v := range response.Versions {
+		numbers = append(numbers, v.Version)
+	}
+	return numbers
+}
+
+func TestVersions(t *testing.T) {
+	handler, dataDir := makeTestHandler(t, Options{VersionDir: t.TempDir()})
+
+	for _, contents := range []string{"one", "two", "three"} {
+		if rec := doRequest(handler, http.MethodPut, "/doc.txt", "writer", contents, nil); rec.Code != 201 && rec.Code != 204 {
+			t.Fatalf("PUT got %d", rec.Code)
+		}
+	}
+	if got := listVersions(t, handler, "/doc.txt", "reader"); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Got versions %v, want [1 2]", got)
+	}
+
+	var tests = []struct {
+		description string
+		method      string
+		target      string
+		user        string
+		status      int
+		body        string
+	}{
+		{"get a version", http.MethodGet, "/doc.txt?version=1", "reader", 200, "one"},
+		{"missing version", http.MethodGet, "/doc.txt?version=9", "reader", 404, ""},
+		{"bad version", http.MethodGet, "/doc.txt?version=x", "reader", 400, ""},
+		{"anonymous cannot list", http.MethodGet, "/doc.txt?versions", "", 401, ""},
+		{"reader cannot restore", http.MethodPost, "/doc.txt?restore=1", "reader", 401, ""},
+		{"restore", http.MethodPost, "/doc.txt?restore=1", "writer", 204, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			rec := doRequest(handler, tt.method, tt.target, tt.user, "", nil)
+			if rec.Code != tt.status {
+				t.Fatalf("Got %d, want %d", rec.Code, tt.status)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("Got body %q, want %q", rec.Body.String(), tt.body)
+			}
+		})
+	}
+
+	if got := readTestFile(t, dataDir, "/doc.txt"); got != "one" {
+		t.Errorf("Restored file is %q", got)
+	}
+	// the replaced content is kept too, so the restore can be undone
+	if got := listVersions(t, handler, "/doc.txt", "reader"); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("Got versions %v after restore, want [1 2 3]", got)
+	}
+
+	if rec := doRequest(handler, http.MethodDelete, "/doc.txt", "writer", "", nil); rec.Code != 204 {
+		t.Fatalf("DELETE got %d", rec.Code)
+	}
+	if got := listVersions(t, handler, "/doc.txt", "reader"); !reflect.DeepEqual(got, []int{1, 2, 3, 4}) {
+		t.Errorf("Got versions %v after delete, want [1 2 3 4]", got)
+	}
+	if rec := doRequest(handler, http.MethodPost, "/doc.txt?restore=4", "writer", "", nil); rec.Code != 201 {
+		t.Errorf("Restoring a deleted file got %d", rec.Code)
+	}
+}
+
+func TestVersionRetention(t *testing.T) {
+	policies, err := ParseVersionPolicies("/=0:0, /keep2=2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := makeTestHandler(t, Options{VersionDir: t.TempDir(), VersionPolicies: policies})
+
+	for _, contents := range []string{"a", "b", "c", "d", "e"} {
+		doRequest(handler, http.MethodPut, "/keep2/f", "writer", contents, nil)
+		doRequest(handler, http.MethodPut, "/all/f", "writer", contents, nil)
+	}
+	if got := listVersions(t, handler, "/keep2/f", "reader"); !reflect.DeepEqual(got, []int{3, 4}) {
+		t.Errorf("Got versions %v under /keep2, want [3 4]", got)
+	}
+	if got := listVersions(t, handler, "/all/f", "reader"); len(got) != 4 {
+		t.Errorf("Got versions %v under /all, want all 4", got)
+	}
+
+	store := makeVersionStore(handler.(fileHandler).VersionDir, []VersionPolicy{{Prefix: "/all", KeepFor: time.Hour}})
+	store.lock.Lock()
+	index, _ := store.load("/all/f")
+	index.Versions[0].Archived = time.Now().Add(-2 * time.Hour)
+	store.save(index)
+	store.lock.Unlock()
+	store.expire()
+	if got := listVersions(t, handler, "/all/f", "reader"); !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Errorf("Got versions %v after expiry, want [2 3 4]", got)
+	}
+
+	for _, spec := range []string{"releases=1:1", "/a=1", "/a=x:1", "/a=-1:0"} {
+		if _, err := ParseVersionPolicies(spec); err == nil {
+			t.Errorf("Policy %q should not parse", spec)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package https
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Options are the optional settings for StartServerWithOptions
+type Options struct {
+	// ClientCAFile is a PEM bundle of the CAs client certificates are verified against. Clients may still
+	// connect without a certificate. Default is not to ask for client certificates
+	ClientCAFile string
+	// ClientCRLFile holds PEM or DER revocation lists from those CAs. It is read again when it changes
+	ClientCRLFile string
+}
+
+// LoadClientCAs reads a PEM bundle of CA certificates
+func LoadClientCAs(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("No certificates found in " + filename)
+	}
+	return pool, nil
+}
+
+// revocationLists checks client certificates against the CRLs in a file, reading it again when it changes
+type revocationLists struct {
+	filename string
+	lock     sync.Mutex
+	modTime  time.Time
+	size     int64
+	lists    []*pkix.CertificateList
+}
+
+func (crls *revocationLists) current() ([]*pkix.CertificateList, error) {
+	info, err := os.Stat(crls.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	crls.lock.Lock()
+	defer crls.lock.Unlock()
+	if crls.lists != nil && info.ModTime().Equal(crls.modTime) && info.Size() == crls.size {
+		return crls.lists, nil
+	}
+
+	data, err := ioutil.ReadFile(crls.filename)
+	if err != nil {
+		return nil, err
+	}
+	var lists []*pkix.CertificateList
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		list, err := x509.ParseCRL(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	if len(lists) == 0 {
+		// not PEM, so it should be a single DER encoded list
+		list, err := x509.ParseCRL(data)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	crls.lists, crls.modTime, crls.size = lists, info.ModTime(), info.Size()
+	return lists, nil
+}
+
+// check refuses a connection if any certificate in its verified chains was revoked by its issuer. Only lists
+// signed by the issuer count, so a list can't be used to revoke another CA's certificates
+func (crls *revocationLists) check(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+	lists, err := crls.current()
+	if err != nil {
+		// failing closed, as a broken file would otherwise let revoked certificates back in
+		fmt.Print("The following error occured while reading the client CRL: ")
+		fmt.Println(err)
+		return errors.New("Could not check client certificate revocation")
+	}
+
+	for _, chain := range verifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for _, list := range lists {
+				if issuer.CheckCRLSignature(list) != nil {
+					continue
+				}
+				if list.HasExpired(time.Now()) {
+					fmt.Println("Warning: the client CRL from " + issuer.Subject.String() + " is past its next update")
+				}
+				for _, revoked := range list.TBSCertList.RevokedCertificates {
+					if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+						return errors.New("Client certificate " + cert.SerialNumber.String() + " has been revoked")
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// clientAuthConfig asks clients for a certificate, which must chain to one of the CAs in options and not be
+// revoked, and sets it up on config. Nothing changes if options has no CAs
+func clientAuthConfig(config *tls.Config, options Options) error {
+	if options.ClientCAFile == "" {
+		return nil
+	}
+	pool, err := LoadClientCAs(options.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	// clients without a certificate can still use a password, so only check the ones given
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = pool
+
+	if options.ClientCRLFile != "" {
+		crls := &revocationLists{filename: options.ClientCRLFile}
+		if _, err := crls.current(); err != nil {
+			return err
+		}
+		config.VerifyPeerCertificate = crls.check
+		// resumed sessions skip VerifyPeerCertificate, which would let a revoked certificate keep working
+		config.SessionTicketsDisabled = true
+	}
+	return nil
+}
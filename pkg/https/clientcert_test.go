@@ -0,0 +1,114 @@
+package https
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func makeTestCA(t *testing.T, name string) testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return testCA{cert, key}
+}
+
+func (ca testCA) issue(t *testing.T, serial int64) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func (ca testCA) crl(t *testing.T, revoked ...int64) []byte {
+	template := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+	for _, serial := range revoked {
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestClientCertificateRevocation(t *testing.T) {
+	ca := makeTestCA(t, "internal")
+	other := makeTestCA(t, "other")
+	dir := t.TempDir()
+	caFile, crlFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "crl.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644)
+	// the other CA's list names serial 2 too, but can't revoke certificates it didn't issue
+	ioutil.WriteFile(crlFile, append(ca.crl(t, 3), other.crl(t, 2)...), 0644)
+
+	config := &tls.Config{}
+	if err := clientAuthConfig(config, Options{ClientCAFile: caFile, ClientCRLFile: crlFile}); err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.VerifyClientCertIfGiven || config.VerifyPeerCertificate == nil {
+		t.Fatal("Client certificates were not set up")
+	}
+
+	chain := func(cert *x509.Certificate) [][]*x509.Certificate {
+		return [][]*x509.Certificate{{cert, ca.cert}}
+	}
+	var tests = []struct {
+		description string
+		chains      [][]*x509.Certificate
+		valid       bool
+	}{
+		{"no certificate", nil, true},
+		{"good certificate", chain(ca.issue(t, 2)), true},
+		{"revoked certificate", chain(ca.issue(t, 3)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			if err := config.VerifyPeerCertificate(nil, tt.chains); (err == nil) != tt.valid {
+				t.Errorf("Got %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+
+	// the list is read again when it changes
+	time.Sleep(10 * time.Millisecond)
+	ioutil.WriteFile(crlFile, ca.crl(t, 2, 3), 0644)
+	if err := config.VerifyPeerCertificate(nil, chain(ca.issue(t, 2))); err == nil {
+		t.Error("Accepted a certificate revoked after the list was first read")
+	}
+}
@@ -18,6 +18,11 @@ func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
 
 // StartServer creates a server using the passed arguments. baseServer can be nil
 func StartServer(useTLS bool, certDir string, host string, httpAddr string, httpsAddr string, handler http.Handler, baseServer *http.Server) {
+	StartServerWithOptions(useTLS, certDir, host, httpAddr, httpsAddr, handler, baseServer, Options{})
+}
+
+// StartServerWithOptions is StartServer with the optional settings in options, such as client certificates
+func StartServerWithOptions(useTLS bool, certDir string, host string, httpAddr string, httpsAddr string, handler http.Handler, baseServer *http.Server, options Options) {
 	if baseServer == nil {
 		baseServer = &http.Server{}
 	}
@@ -33,6 +38,11 @@ func StartServer(useTLS bool, certDir string, host string, httpAddr string, http
 
 		baseServer.Addr = httpsAddr
 		baseServer.TLSConfig = certManager.TLSConfig()
+		if err := clientAuthConfig(baseServer.TLSConfig, options); err != nil {
+			fmt.Print("The following error occured while setting up client certificates: ")
+			fmt.Println(err)
+			return
+		}
 
 		redirectServer := &http.Server{
 			Addr:         httpAddr,
@@ -47,6 +57,9 @@ func StartServer(useTLS bool, certDir string, host string, httpAddr string, http
 		fmt.Println("Starting https server on address " + httpsAddr)
 		fmt.Println(baseServer.ListenAndServeTLS("", ""))
 	} else {
+		if options.ClientCAFile != "" {
+			fmt.Println("Warning: client certificates need tls, so only passwords and tokens will work")
+		}
 		baseServer.Addr = httpAddr
 
 		fmt.Println("Starting http server on address " + httpAddr)